@@ -51,6 +51,8 @@ func main() {
 type Metrics struct {
 	TotalGames      int
 	TotalMoves      int
+	TotalEmotes     int
+	ByEmote         map[string]int
 	ByWinner        map[string]int
 	ByHour          map[string]int
 	ByDay           map[string]int
@@ -78,6 +80,7 @@ type UserStats struct {
 func NewMetrics() *Metrics {
 	return &Metrics{
 		ByWinner:  map[string]int{},
+		ByEmote:   map[string]int{},
 		ByHour:    map[string]int{},
 		ByDay:     map[string]int{},
 		UserStats: map[string]*UserStats{},
@@ -137,6 +140,11 @@ func (m *Metrics) ProcessEvent(e map[string]interface{}) {
 		}
 	case "move":
 		m.TotalMoves++
+	case "emote":
+		m.TotalEmotes++
+		if name, ok := e["emote"].(string); ok {
+			m.ByEmote[name]++
+		}
 	default:
 		// ignore other events
 	}
@@ -180,6 +188,7 @@ func (m *Metrics) LogSnapshot() {
 	fmt.Println("\n========== GAME ANALYTICS SNAPSHOT ==========")
 	fmt.Printf("Total Games: %d\n", m.TotalGames)
 	fmt.Printf("Total Moves: %d\n", m.TotalMoves)
+	fmt.Printf("Total Emotes: %d\n", m.TotalEmotes)
 	fmt.Printf("Average Game Duration: %.2f seconds\n", m.AverageDuration)
 	fmt.Printf("Bot Games: %d | Player vs Player: %d\n", m.BotGames, m.PlayerGames)
 	fmt.Printf("Draws: %d | Forfeits: %d\n", m.Draws, m.Forfeits)
@@ -189,6 +198,11 @@ func (m *Metrics) LogSnapshot() {
 		fmt.Printf("  %s: %d wins\n", winner, count)
 	}
 
+	fmt.Println("\n--- Emotes ---")
+	for name, count := range m.ByEmote {
+		fmt.Printf("  %s: %d\n", name, count)
+	}
+
 	fmt.Println("\n--- Games Per Day ---")
 	for day, count := range m.ByDay {
 		fmt.Printf("  %s: %d games\n", day, count)
@@ -200,5 +214,5 @@ func (m *Metrics) LogSnapshot() {
 			username, stats.GamesPlayed, stats.Wins, stats.Losses, stats.Draws, stats.WinRate, stats.AvgDuration)
 	}
 
-	fmt.Println("=============================================\n")
+	fmt.Print("=============================================\n\n")
 }
@@ -1,5 +1,7 @@
 package main
 
+import "math/rand"
+
 // Bot aims to be competitive: block immediate wins, take immediate wins, else pick center/near-center.
 
 func BotNextMove(g *Game, botPlayer int) int {
@@ -54,6 +56,33 @@ func BotNextMove(g *Game, botPlayer int) int {
 	return 0
 }
 
+// botFullStrength is the rating from which the bot plays every move as
+// well as it can
+const botFullStrength = 1500
+
+// BotMoveForRating plays like BotNextMove against opponents rated
+// botFullStrength or more. Against weaker ones it sometimes drops a disc in
+// a random column instead, the more often the weaker they are, so that
+// queue players who fall back to the bot meet one of about their strength.
+func BotMoveForRating(g *Game, botPlayer, rating int) int {
+	blunder := float64(botFullStrength-rating) / 1000
+	if blunder > 0.7 {
+		blunder = 0.7
+	}
+	if rand.Float64() < blunder {
+		var open []int
+		for c := 0; c < g.Cols; c++ {
+			if firstEmptyRow(g.Board, c) != -1 {
+				open = append(open, c)
+			}
+		}
+		if len(open) > 0 {
+			return open[rand.Intn(len(open))]
+		}
+	}
+	return BotNextMove(g, botPlayer)
+}
+
 func firstEmptyRow(b [][]int, col int) int {
 	for r := 0; r < len(b); r++ {
 		if b[r][col] != 0 {
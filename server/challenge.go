@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// A challenge is held by the node of the user who sent it, which expires
+// it and starts the game when it is accepted. The node of the user
+// challenged keeps a copy so it can show and answer it; answers travel back
+// as "challenge_accept" and "challenge_closed" cluster messages.
+
+// validSettings checks settings against what the server can play and fills
+// in the defaults
+func validSettings(s *GameSettings) error {
+	if s.Variant == "" {
+		s.Variant = variantStandard
+	}
+	if _, ok := variants[s.Variant]; !ok {
+		return fmt.Errorf("unknown variant %q", s.Variant)
+	}
+	if s.TimeControl != "" {
+		if _, _, err := parseTimeControl(s.TimeControl); err != nil {
+			return err
+		}
+	}
+	switch s.Colour {
+	case "":
+		s.Colour = "random"
+	case "first", "second", "random":
+	default:
+		return fmt.Errorf("colour must be first, second or random")
+	}
+	return nil
+}
+
+// handleChallenge sends a challenge from c to another online user
+func (n *Node) handleChallenge(c *Client, m *ChallengeMessage) error {
+	if m.To == "" || m.To == c.Username {
+		return c.reject(ErrBadMessage, "challenge another player")
+	}
+	settings := m.settings()
+	if err := validSettings(&settings); err != nil {
+		return c.reject(ErrInvalidSettings, err.Error())
+	}
+	if err := n.canStartGame(c); err != nil {
+		return err
+	}
+	targetNode, err := n.cluster.UserNode(m.To)
+	if err != nil {
+		return c.reject(ErrUserOffline, m.To+" is not online")
+	}
+
+	now := time.Now()
+	ch := &Challenge{
+		ID:        fmt.Sprintf("c_%d", now.UnixNano()),
+		From:      c.Username,
+		To:        m.To,
+		Settings:  settings,
+		Node:      n.cluster.NodeID(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(config.ChallengeTimeout) * time.Second),
+	}
+	n.challengesMu.Lock()
+	n.challenges[ch.ID] = ch
+	n.challengesMu.Unlock()
+	time.AfterFunc(time.Until(ch.ExpiresAt), func() { n.closeChallenge(ch.ID, "expired") })
+
+	// the game goes to this tab if the challenge is accepted
+	c.setSeeking(true)
+	log.Printf("Player %s challenged %s (%s)", ch.From, ch.To, ch.ID)
+	c.SendJSON(ChallengeEvent{Type: MsgChallenge, Challenge: ch})
+	if targetNode == n.cluster.NodeID() {
+		n.showChallenge(ch)
+	} else {
+		payload, _ := json.Marshal(ch)
+		n.cluster.Send(targetNode, ClusterMessage{Kind: "challenge", Username: ch.To, Payload: payload})
+	}
+	return nil
+}
+
+// showChallenge sends a challenge to every connection of the user
+// challenged
+func (n *Node) showChallenge(ch *Challenge) {
+	n.challengesMu.Lock()
+	n.challenges[ch.ID] = ch
+	n.challengesMu.Unlock()
+	for _, c := range n.clientsOf(ch.To) {
+		c.SendJSON(ChallengeEvent{Type: MsgChallenge, Challenge: ch})
+	}
+}
+
+// handleChallengeReply accepts, declines or cancels a challenge for c
+func (n *Node) handleChallengeReply(c *Client, env Envelope, m *ChallengeReplyMessage) error {
+	n.challengesMu.Lock()
+	ch, ok := n.challenges[m.ChallengeID]
+	n.challengesMu.Unlock()
+	sender := env.Type == MsgCancel
+	if !ok || (sender && ch.From != c.Username) || (!sender && ch.To != c.Username) {
+		return c.reject(ErrChallengeNotFound, "no such challenge")
+	}
+
+	switch env.Type {
+	case MsgAccept:
+		if err := n.canStartGame(c); err != nil {
+			return err
+		}
+		c.setSeeking(true)
+		if ch.Node == n.cluster.NodeID() {
+			n.acceptChallenge(ch.ID)
+		} else {
+			n.cluster.Send(ch.Node, ClusterMessage{Kind: "challenge_accept", Username: c.Username, GameID: ch.ID})
+		}
+	case MsgDecline:
+		n.closeChallenge(ch.ID, "declined")
+	case MsgCancel:
+		n.closeChallenge(ch.ID, "cancelled")
+	}
+	return nil
+}
+
+// acceptChallenge starts the game for a challenge this node holds
+func (n *Node) acceptChallenge(id string) {
+	n.challengesMu.Lock()
+	ch, ok := n.challenges[id]
+	n.challengesMu.Unlock()
+	if !ok || ch.Node != n.cluster.NodeID() {
+		return // expired or cancelled in the meantime
+	}
+	// the challenger may have started another game since
+	if len(n.clientsOf(ch.From)) == 0 || n.playing(ch.From) {
+		n.closeChallenge(id, "unavailable")
+		return
+	}
+
+	n.closeChallenge(id, "accepted")
+	// neither player goes on looking for another game
+	for _, u := range []string{ch.From, ch.To} {
+		if ok, _ := n.cluster.QueueRemove(u); ok {
+			log.Printf("Player %s is starting a challenge, removed from matchmaking queue", u)
+			n.queueLeft(u, "challenge")
+		}
+		n.vacateRooms(u)
+	}
+	p1, p2 := ch.From, ch.To
+	if ch.Settings.Colour == "second" || (ch.Settings.Colour == "random" && rand.Intn(2) == 0) {
+		p1, p2 = p2, p1
+	}
+	go n.startGame(p1, p2, ch.Settings)
+}
+
+// closeChallenge ends a challenge and tells both players why. Called on
+// the challenged user's node for a challenge held elsewhere, it forwards
+// the answer to the holder, which tells the challenger.
+func (n *Node) closeChallenge(id, reason string) {
+	n.challengesMu.Lock()
+	ch, ok := n.challenges[id]
+	delete(n.challenges, id)
+	n.challengesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	msg := ChallengeClosedMessage{Type: MsgChallengeClosed, ChallengeID: id, Reason: reason}
+	payload, _ := json.Marshal(msg)
+	if ch.Node != n.cluster.NodeID() {
+		n.cluster.Send(ch.Node, ClusterMessage{Kind: "challenge_closed", GameID: id, Payload: payload})
+		n.tellChallenged(ch.To, msg)
+		return
+	}
+
+	log.Printf("Challenge %s from %s to %s %s", id, ch.From, ch.To, reason)
+	n.tellChallenged(ch.From, msg)
+	if node, err := n.cluster.UserNode(ch.To); err == nil && node != n.cluster.NodeID() {
+		n.cluster.Send(node, ClusterMessage{Kind: "challenge_closed", GameID: id, Payload: payload})
+	} else {
+		n.tellChallenged(ch.To, msg)
+	}
+}
+
+func (n *Node) tellChallenged(username string, msg ChallengeClosedMessage) {
+	for _, c := range n.clientsOf(username) {
+		c.SendJSON(msg)
+	}
+}
+
+// dropChallenges closes the challenges sent by or to a user whose last
+// connection to this node has gone
+func (n *Node) dropChallenges(username string) {
+	if len(n.clientsOf(username)) > 0 {
+		return
+	}
+	n.challengesMu.Lock()
+	var ids []string
+	for id, ch := range n.challenges {
+		if ch.From == username || ch.To == username {
+			ids = append(ids, id)
+		}
+	}
+	n.challengesMu.Unlock()
+	for _, id := range ids {
+		n.closeChallenge(id, "unavailable")
+	}
+}
+
+// handleClusterChallenge processes challenge traffic from another node
+func (n *Node) handleClusterChallenge(m ClusterMessage) {
+	switch m.Kind {
+	case "challenge":
+		var ch Challenge
+		if err := json.Unmarshal(m.Payload, &ch); err == nil {
+			n.showChallenge(&ch)
+		}
+	case "challenge_accept":
+		n.acceptChallenge(m.GameID)
+	case "challenge_closed":
+		var msg ChallengeClosedMessage
+		if err := json.Unmarshal(m.Payload, &msg); err != nil {
+			return
+		}
+		n.challengesMu.Lock()
+		ch, ok := n.challenges[m.GameID]
+		n.challengesMu.Unlock()
+		if !ok {
+			return
+		}
+		if ch.Node == n.cluster.NodeID() {
+			// an answer from the challenged user's node
+			n.closeChallenge(m.GameID, msg.Reason)
+			return
+		}
+		// the holder has closed it
+		n.challengesMu.Lock()
+		delete(n.challenges, m.GameID)
+		n.challengesMu.Unlock()
+		n.tellChallenged(ch.To, msg)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// challenge sends a challenge from one connection and returns its id as
+// the challenged user sees it
+func challenge(t *testing.T, from, to *websocket.Conn, username string) string {
+	t.Helper()
+	from.WriteJSON(map[string]any{"type": "challenge", "to": username})
+	return readUntil(t, to, "challenge")["challenge"].(map[string]any)["id"].(string)
+}
+
+func TestChallengeTakesPlayersOutOfQueueAndRooms(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	readUntil(t, bob, "welcome")
+
+	// alice looks for other games while her challenge is open
+	id := challenge(t, alice, bob, "bob")
+	alice.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, alice, "waiting")
+
+	bob.WriteJSON(map[string]any{"type": "accept_challenge", "challengeId": id})
+	if m := readUntil(t, alice, "queue_left"); m["reason"] != "challenge" {
+		t.Fatalf("alice left the queue with %v, want challenge", m["reason"])
+	}
+	readUntil(t, alice, "start")
+	readUntil(t, bob, "start")
+	if q := queued(t, n); len(q) != 0 {
+		t.Fatalf("queue is %v once the challenge started", q)
+	}
+
+	// carol queueing now is not paired with alice
+	carol := dial(t, srv, map[string]any{"type": "hello", "username": "carol"})
+	readUntil(t, carol, "welcome")
+	carol.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, carol, "waiting")
+	time.Sleep(3 * matchPoll)
+	if q := queued(t, n); len(q) != 1 || q[0] != "carol" {
+		t.Fatalf("queue is %v, want carol still waiting", q)
+	}
+}
+
+func TestChallengeClosesHostedRoom(t *testing.T) {
+	_, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	readUntil(t, bob, "welcome")
+
+	id := challenge(t, alice, bob, "bob")
+	alice.WriteJSON(map[string]any{"type": "create_room", "roomName": "waiting"})
+	roomID := readUntil(t, alice, "room_created")["roomId"].(string)
+
+	bob.WriteJSON(map[string]any{"type": "accept_challenge", "challengeId": id})
+	readUntil(t, alice, "start")
+	if s := roomStatus(t, srv.URL, roomID); s != "" {
+		t.Fatalf("alice's room is still %q after her challenge started", s)
+	}
+}
+
+func TestBusyPlayerCannotAcceptChallenge(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	readUntil(t, bob, "welcome")
+
+	id := challenge(t, alice, bob, "bob")
+	bob.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, bob, "waiting")
+	bob.WriteJSON(map[string]any{"type": "accept_challenge", "challengeId": id})
+	if m := readUntil(t, bob, "error"); m["code"] != ErrAlreadyQueued {
+		t.Fatalf("accepting while queued got %v, want already_queued", m)
+	}
+
+	bob.WriteJSON(map[string]any{"type": "leave_queue"})
+	readUntil(t, bob, "queue_left")
+	bob.WriteJSON(map[string]any{"type": "create_room", "roomName": "bob's"})
+	readUntil(t, bob, "room_created")
+	bob.WriteJSON(map[string]any{"type": "accept_challenge", "challengeId": id})
+	if m := readUntil(t, bob, "error"); m["code"] != ErrAlreadyInRoom {
+		t.Fatalf("accepting while seated in a room got %v, want already_in_room", m)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Chat is scoped to a game (its players), a room (the players waiting in
+// it) or the lobby (everyone connected to any node). Lines are checked
+// against the length and rate limits, run through the word filter, and
+// recorded in data/chat.jsonl for moderation. Game chat is also saved with
+// the game record.
+
+// Chat scopes
+const (
+	ChatGame  = "game"
+	ChatRoom  = "room"
+	ChatLobby = "lobby"
+)
+
+// ChatEntry is one line of chat
+type ChatEntry struct {
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+var (
+	chatLog    = &jsonlLog{name: "chat.jsonl"}
+	chatFilter *regexp.Regexp // nil when no words are filtered
+)
+
+// loadChatFilter compiles the configured word list
+func loadChatFilter(config *Config) {
+	var words []string
+	for _, w := range config.ChatFilter {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, regexp.QuoteMeta(w))
+		}
+	}
+	if len(words) == 0 {
+		chatFilter = nil
+		return
+	}
+	chatFilter = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+}
+
+// filterChat masks filtered words with asterisks
+func filterChat(text string) string {
+	if chatFilter == nil {
+		return text
+	}
+	return chatFilter.ReplaceAllStringFunc(text, func(w string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(w))
+	})
+}
+
+// chatLimiter allows a user config.ChatRateLimit lines per ChatRateWindow
+// seconds. It is kept by username rather than by connection, so the limit
+// and mutes hold across tabs and reconnects, until reapChat forgets a user
+// who has been gone for longer than either could matter.
+type chatLimiter struct {
+	mu    sync.Mutex
+	sent  []time.Time
+	muted map[string]bool // users whose chat this user does not want
+	left  time.Time       // when the user's last connection to this node closed
+}
+
+// chatOf returns username's chat limiter
+func (n *Node) chatOf(username string) *chatLimiter {
+	n.chatMu.Lock()
+	defer n.chatMu.Unlock()
+	l, ok := n.chatUsers[username]
+	if !ok {
+		l = &chatLimiter{}
+		n.chatUsers[username] = l
+	}
+	return l
+}
+
+// chatLeft notes that username's last connection to this node has closed
+func (n *Node) chatLeft(username string) {
+	n.chatMu.Lock()
+	l, ok := n.chatUsers[username]
+	n.chatMu.Unlock()
+	if ok {
+		l.mu.Lock()
+		l.left = time.Now()
+		l.mu.Unlock()
+	}
+}
+
+// reapChat forgets the chat limiters of users who left longer ago than the
+// reconnect timeout and the rate window
+func (n *Node) reapChat() {
+	keep := config.ReconnectTimeout
+	if config.ChatRateWindow > keep {
+		keep = config.ChatRateWindow
+	}
+	n.chatMu.Lock()
+	var gone []string
+	for username, l := range n.chatUsers {
+		l.mu.Lock()
+		if !l.left.IsZero() && time.Since(l.left) > time.Duration(keep)*time.Second {
+			gone = append(gone, username)
+		}
+		l.mu.Unlock()
+	}
+	n.chatMu.Unlock()
+
+	for _, username := range gone {
+		if len(n.clientsOf(username)) > 0 {
+			continue // came back and has not left again
+		}
+		n.chatMu.Lock()
+		delete(n.chatUsers, username)
+		n.chatMu.Unlock()
+	}
+}
+
+func (l *chatLimiter) allow() bool {
+	if config.ChatRateLimit <= 0 {
+		return true
+	}
+	window := time.Duration(config.ChatRateWindow) * time.Second
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.sent) > 0 && now.Sub(l.sent[0]) >= window {
+		l.sent = l.sent[1:]
+	}
+	if len(l.sent) >= config.ChatRateLimit {
+		return false
+	}
+	l.sent = append(l.sent, now)
+	return true
+}
+
+func (l *chatLimiter) setMuted(username string, muted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.muted == nil {
+		l.muted = map[string]bool{}
+	}
+	if muted {
+		l.muted[username] = true
+	} else {
+		delete(l.muted, username)
+	}
+}
+
+func (l *chatLimiter) isMuted(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.muted[username]
+}
+
+// SendChat delivers a chat line unless the client's user has muted its
+// sender
+func (c *Client) SendChat(e ChatEvent) error {
+	if c.node != nil && c.node.chatOf(c.Username).isMuted(e.From) {
+		return nil
+	}
+	return c.SendJSON(e)
+}
+
+// handleChat checks a chat line and passes it to its scope
+func (n *Node) handleChat(c *Client, m *ChatMessage) error {
+	text := strings.TrimSpace(m.Text)
+	if text == "" {
+		return nil
+	}
+	if max := config.ChatMaxLength; max > 0 && utf8.RuneCountInString(text) > max {
+		return c.reject(ErrChatTooLong, fmt.Sprintf("chat messages are limited to %d characters", max))
+	}
+	if !n.chatOf(c.Username).allow() {
+		return c.reject(ErrRateLimited, "you are sending messages too quickly")
+	}
+	entry := ChatEntry{From: c.Username, Text: filterChat(text), At: time.Now()}
+
+	switch m.Scope {
+	case ChatGame:
+		if m.Target == "" || m.Target != c.currentGame() {
+			return c.reject(ErrChatNotAllowed, "you are not in that game")
+		}
+		if sess, ok := n.localGame(m.Target); ok {
+			sess.chat(entry)
+		} else {
+			n.forwardToOwner("game_chat", c.Username, m.Target, entry)
+		}
+
+	case ChatRoom:
+		room, err := n.cluster.UpdateRoom(m.Target, func(room *Room) error {
+			if room.Player1 != c.Username && room.Player2 != c.Username {
+				return errNotAPlayer
+			}
+			room.Chat = appendChat(room.Chat, entry)
+			return nil
+		})
+		if err != nil {
+			return c.reject(ErrChatNotAllowed, "you are not in that room")
+		}
+		ev := chatEvent(ChatRoom, room.ID, entry)
+		for _, u := range []string{room.Player1, room.Player2} {
+			if u != "" {
+				n.deliverChat(u, ev)
+			}
+		}
+
+	case ChatLobby:
+		n.postLobby(entry)
+
+	default:
+		return c.reject(ErrBadMessage, "unknown chat scope "+m.Scope)
+	}
+
+	rec := map[string]interface{}{
+		"scope":  m.Scope,
+		"target": m.Target,
+		"from":   entry.From,
+		"text":   entry.Text,
+		"at":     entry.At,
+	}
+	if entry.Text != text {
+		rec["original"] = text
+	}
+	chatLog.write(rec)
+	return nil
+}
+
+func chatEvent(scope, target string, e ChatEntry) ChatEvent {
+	return ChatEvent{Type: MsgChat, Scope: scope, Target: target, From: e.From, Text: e.Text, At: e.At}
+}
+
+// appendChat adds e to a history, keeping the newest config.ChatHistory
+// lines. It never modifies history's backing array, which may be shared.
+func appendChat(history []ChatEntry, e ChatEntry) []ChatEntry {
+	out := append(append([]ChatEntry{}, history...), e)
+	if max := config.ChatHistory; max > 0 && len(out) > max {
+		out = out[len(out)-max:]
+	}
+	return out
+}
+
+// deliverChat sends a chat line to all of username's connections, wherever
+// they are
+func (n *Node) deliverChat(username string, ev ChatEvent) {
+	if conns := n.clientsOf(username); len(conns) > 0 {
+		for _, c := range conns {
+			c.SendChat(ev)
+		}
+		return
+	}
+	if node, err := n.cluster.UserNode(username); err == nil {
+		payload, _ := json.Marshal(ev)
+		n.cluster.Send(node, ClusterMessage{Kind: "chat", Username: username, Payload: payload})
+	}
+}
+
+// postLobby shows a lobby line to everyone on this node and passes it to
+// the other nodes
+func (n *Node) postLobby(e ChatEntry) {
+	n.receiveLobby(e)
+	nodes, err := n.cluster.Nodes()
+	if err != nil {
+		return
+	}
+	payload, _ := json.Marshal(e)
+	for _, node := range nodes {
+		if node != n.cluster.NodeID() {
+			n.cluster.Send(node, ClusterMessage{Kind: "lobby_chat", Payload: payload})
+		}
+	}
+}
+
+// receiveLobby records a lobby line and delivers it to this node's clients
+func (n *Node) receiveLobby(e ChatEntry) {
+	n.lobbyMu.Lock()
+	n.lobby = appendChat(n.lobby, e)
+	n.lobbyMu.Unlock()
+
+	ev := chatEvent(ChatLobby, "", e)
+	for _, c := range n.allClients() {
+		c.SendChat(ev)
+	}
+}
+
+// lobbyHistory returns the recent lobby chat
+func (n *Node) lobbyHistory() []ChatEntry {
+	n.lobbyMu.Lock()
+	defer n.lobbyMu.Unlock()
+	return n.lobby
+}
+
+// chat records a line in the game and shows it to everyone in it
+func (s *GameSession) chat(e ChatEntry) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	s.Chat = appendChat(s.Chat, e)
+	ev := chatEvent(ChatGame, s.ID, e)
+	for _, cl := range s.clients {
+		cl.SendChat(ev)
+	}
+}
+
+// sendHistory replays a chat history, if there is any
+func sendHistory(p Peer, scope, target string, history []ChatEntry) {
+	if len(history) > 0 {
+		p.SendJSON(ChatHistoryMessage{Type: MsgChatHistory, Scope: scope, Target: target, Messages: history})
+	}
+}
+
+// handleClusterChat processes chat messages from other nodes
+func (n *Node) handleClusterChat(m ClusterMessage) {
+	switch m.Kind {
+	case "chat":
+		var ev ChatEvent
+		if err := json.Unmarshal(m.Payload, &ev); err != nil {
+			return
+		}
+		for _, c := range n.clientsOf(m.Username) {
+			c.SendChat(ev)
+		}
+	case "game_chat":
+		var e ChatEntry
+		if err := json.Unmarshal(m.Payload, &e); err != nil {
+			return
+		}
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.chat(e)
+		}
+	case "lobby_chat":
+		var e ChatEntry
+		if err := json.Unmarshal(m.Payload, &e); err != nil {
+			return
+		}
+		n.receiveLobby(e)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readChat reads until a chat line from one of the given users arrives
+func readChat(t *testing.T, conn *websocket.Conn, from ...string) map[string]any {
+	t.Helper()
+	for {
+		m := readUntil(t, conn, "chat")
+		for _, f := range from {
+			if m["from"] == f {
+				return m
+			}
+		}
+	}
+}
+
+func lobbyChat(conn *websocket.Conn, text string) {
+	conn.WriteJSON(map[string]any{"type": "chat", "scope": "lobby", "text": text})
+}
+
+func TestChatLimitsFollowTheUser(t *testing.T) {
+	limit, window := config.ChatRateLimit, config.ChatRateWindow
+	config.ChatRateLimit, config.ChatRateWindow = 2, 60
+	t.Cleanup(func() { config.ChatRateLimit, config.ChatRateWindow = limit, window })
+
+	_, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"]
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	readUntil(t, bob, "welcome")
+	carol := dial(t, srv, map[string]any{"type": "hello", "username": "carol"})
+	readUntil(t, carol, "welcome")
+
+	// alice mutes bob in one tab, then opens another
+	alice.WriteJSON(map[string]any{"type": "mute", "username": "bob", "muted": true})
+	lobbyChat(alice, "one")
+	readChat(t, alice, "alice")
+	alice2 := dial(t, srv, map[string]any{"type": "hello", "username": "alice", "token": token})
+	readUntil(t, alice2, "welcome")
+
+	// bob's lines are done being delivered once his second one comes back
+	lobbyChat(bob, "hidden")
+	lobbyChat(bob, "hidden too")
+	readChat(t, bob, "bob")
+	readChat(t, bob, "bob")
+	lobbyChat(carol, "shown")
+	if m := readChat(t, alice2, "bob", "carol"); m["from"] != "carol" {
+		t.Fatalf("the new tab got %v from a muted user", m["text"])
+	}
+
+	// the rate limit counts lines from both tabs, and outlasts them
+	lobbyChat(alice2, "two")
+	readChat(t, alice2, "alice")
+	lobbyChat(alice2, "three")
+	if m := readUntil(t, alice2, "error"); m["code"] != ErrRateLimited {
+		t.Fatalf("third line got %v, want rate_limited", m)
+	}
+	alice.Close()
+	alice2.Close()
+	alice3 := dial(t, srv, map[string]any{"type": "hello", "username": "alice", "token": token})
+	readUntil(t, alice3, "welcome")
+	lobbyChat(alice3, "four")
+	if m := readUntil(t, alice3, "error"); m["code"] != ErrRateLimited {
+		t.Fatalf("line after reconnecting got %v, want rate_limited", m)
+	}
+}
+
+func TestChatLimitsForgottenAfterLeaving(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	readUntil(t, bob, "welcome")
+	lobbyChat(alice, "hi")
+	lobbyChat(bob, "hello")
+	readChat(t, bob, "alice", "bob")
+	readChat(t, bob, "alice", "bob")
+
+	limiter := func(username string) (*chatLimiter, bool) {
+		n.chatMu.Lock()
+		defer n.chatMu.Unlock()
+		l, ok := n.chatUsers[username]
+		return l, ok
+	}
+
+	// a recent departure is kept in case alice reconnects
+	alice.Close()
+	eventually(t, "alice leaves", func() bool {
+		l, _ := limiter("alice")
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return !l.left.IsZero()
+	})
+	n.reapChat()
+	l, ok := limiter("alice")
+	if !ok {
+		t.Fatal("alice's chat limit was dropped as soon as she left")
+	}
+
+	// long gone, she is forgotten, while bob is still connected
+	l.mu.Lock()
+	l.left = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+	n.reapChat()
+	if _, ok := limiter("alice"); ok {
+		t.Error("alice's chat limit outlived her by an hour")
+	}
+	if _, ok := limiter("bob"); !ok {
+		t.Error("bob's chat limit was dropped while he is connected")
+	}
+}
+
+func TestRoomUpdatesLeaveOutChat(t *testing.T) {
+	_, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "create_room", "username": "alice", "roomName": "chatty"})
+	id := readUntil(t, alice, "room_created")["roomId"]
+	bob := dial(t, srv, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	readUntil(t, bob, "room_joined")
+
+	for i := 0; i < 3; i++ {
+		alice.WriteJSON(map[string]any{"type": "chat", "scope": "room", "target": id, "text": "hello"})
+		readChat(t, bob, "alice")
+	}
+	alice.WriteJSON(map[string]any{"type": "room_ready", "roomId": id, "ready": true})
+	room := readUntil(t, bob, "room_update")["room"].(map[string]any)
+	if _, ok := room["chat"]; ok {
+		t.Fatalf("room update carries the chat: %v", room["chat"])
+	}
+
+	// the history is still replayed to players who join
+	bob.Close()
+	readUntil(t, alice, "room_update")
+	carol := dial(t, srv, map[string]any{"type": "join_room", "username": "carol", "roomId": id})
+	if m := readUntil(t, carol, "chat_history"); len(m["messages"].([]any)) != 3 {
+		t.Fatalf("history has %d lines, want 3", len(m["messages"].([]any)))
+	}
+}
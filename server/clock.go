@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// A time control gives each player a budget for the whole game, written
+// "M+S": M minutes each, plus S seconds added to a player's clock after
+// each of their moves. A player whose clock runs out loses. Games without a
+// time control are untimed.
+//
+// The server only sees a move once it has crossed the network, so the
+// player to move is credited with half their measured round-trip time
+// (see latency.go) on every turn. The credit is capped so a player cannot
+// buy time by delaying their pongs.
+
+const (
+	maxTimeControlMinutes = 180
+	maxIncrementSeconds   = 60
+	maxLagCredit          = 500 * time.Millisecond
+)
+
+// parseTimeControl returns the budget and increment of a time control
+func parseTimeControl(tc string) (base, increment time.Duration, err error) {
+	var m, s int
+	if _, err := fmt.Sscanf(tc, "%d+%d", &m, &s); err != nil || fmt.Sprintf("%d+%d", m, s) != tc {
+		return 0, 0, fmt.Errorf("time control %q must be minutes each plus seconds per move, such as 5+3", tc)
+	}
+	if m < 1 || m > maxTimeControlMinutes || s < 0 || s > maxIncrementSeconds {
+		return 0, 0, fmt.Errorf("time control %q must be 1 to %d minutes plus 0 to %d seconds", tc, maxTimeControlMinutes, maxIncrementSeconds)
+	}
+	return time.Duration(m) * time.Minute, time.Duration(s) * time.Second, nil
+}
+
+// setTimeControl puts the game on a clock; an empty or invalid time
+// control leaves it untimed. Call before the game begins.
+func (s *GameSession) setTimeControl(tc string) {
+	base, increment, err := parseTimeControl(tc)
+	if err != nil {
+		return
+	}
+	s.timeControl, s.increment = tc, increment
+	s.clocks = []time.Duration{base, base}
+}
+
+// startClock starts the clock of the player to move, who loses if they
+// have not moved when it runs out. Caller must hold TurnMu.
+func (s *GameSession) startClock() {
+	if s.clocks == nil || s.State != "playing" {
+		return
+	}
+	if s.flagTimer != nil {
+		s.flagTimer.Stop()
+	}
+	s.turnStart = time.Now()
+	s.armFlag(s.clocks[s.Game.Turn-1] + s.lagCredit())
+}
+
+// armFlag flags the player to move after d unless they move first
+func (s *GameSession) armFlag(d time.Duration) {
+	ply := len(s.Moves)
+	s.flagTimer = time.AfterFunc(d, func() { s.flag(ply) })
+}
+
+// lagCredit is the part of the turn the player to move is assumed to have
+// spent waiting on the network. Caller must hold TurnMu.
+func (s *GameSession) lagCredit() time.Duration {
+	for name, n := range s.Players {
+		if n == s.Game.Turn {
+			if credit := s.latency[name] / 2; credit < maxLagCredit {
+				return credit
+			}
+			return maxLagCredit
+		}
+	}
+	return 0
+}
+
+// thinkingTime is how long the player to move has taken so far, less their
+// lag credit. Caller must hold TurnMu.
+func (s *GameSession) thinkingTime() time.Duration {
+	if d := time.Since(s.turnStart) - s.lagCredit(); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// outOfTime reports whether the player to move has used up their clock.
+// Caller must hold TurnMu.
+func (s *GameSession) outOfTime() bool {
+	return s.clocks != nil && s.thinkingTime() >= s.clocks[s.Game.Turn-1]
+}
+
+// stopClock charges the player to move for their turn and adds the
+// increment. Caller must hold TurnMu.
+func (s *GameSession) stopClock() {
+	if s.clocks == nil {
+		return
+	}
+	p := s.Game.Turn - 1
+	s.clocks[p] -= s.thinkingTime()
+	if s.clocks[p] < 0 {
+		s.clocks[p] = 0
+	}
+	s.clocks[p] += s.increment
+}
+
+// flag ends the game on time if the player to move at ply still has not
+// moved. Their lag credit may have grown since the timer was set, in which
+// case it is set again for the time left.
+func (s *GameSession) flag(ply int) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	if s.State != "playing" || len(s.Moves) != ply {
+		return
+	}
+	if !s.outOfTime() {
+		s.armFlag(s.clocks[s.Game.Turn-1] - s.thinkingTime())
+		return
+	}
+	s.clocks[s.Game.Turn-1] = 0
+	s.loseOnTime()
+}
+
+// loseOnTime ends the game against the player to move. Caller must hold
+// TurnMu.
+func (s *GameSession) loseOnTime() {
+	loser, winner := s.Player1, s.Player2
+	if s.Game.Turn == 2 {
+		loser, winner = winner, loser
+	}
+	log.Printf("Player %s ran out of time in game %s", loser, s.ID)
+	s.finish(winner, "timeout", nil)
+}
+
+// clocksLeft returns the milliseconds left on both players' clocks, or nil
+// for an untimed game. Caller must hold TurnMu.
+func (s *GameSession) clocksLeft() []int64 {
+	if s.clocks == nil {
+		return nil
+	}
+	left := []time.Duration{s.clocks[0], s.clocks[1]}
+	if s.State == "playing" && !s.turnStart.IsZero() {
+		p := s.Game.Turn - 1
+		if left[p] -= s.thinkingTime(); left[p] < 0 {
+			left[p] = 0
+		}
+	}
+	return []int64{left[0].Milliseconds(), left[1].Milliseconds()}
+}
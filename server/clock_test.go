@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeControl(t *testing.T) {
+	tests := []struct {
+		tc              string
+		base, increment time.Duration
+		ok              bool
+	}{
+		{"5+3", 5 * time.Minute, 3 * time.Second, true},
+		{"1+0", time.Minute, 0, true},
+		{"180+60", 180 * time.Minute, time.Minute, true},
+		{"0+5", 0, 0, false},
+		{"181+0", 0, 0, false},
+		{"5+61", 0, 0, false},
+		{"5", 0, 0, false},
+		{"5+3s", 0, 0, false},
+		{"05+3", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		base, increment, err := parseTimeControl(tt.tc)
+		if (err == nil) != tt.ok || base != tt.base || increment != tt.increment {
+			t.Errorf("parseTimeControl(%q) = %s, %s, %v; want %s, %s, ok = %v", tt.tc, base, increment, err, tt.base, tt.increment, tt.ok)
+		}
+	}
+}
+
+func TestClockIncrement(t *testing.T) {
+	s, _ := testSession()
+	s.applySettings(GameSettings{Variant: variantStandard, TimeControl: "1+5"})
+	s.startClock()
+	s.applyMove(MoveRequest{Username: "alice", Ply: 0, Col: 3})
+	s.finish("draw", "draw", nil)
+
+	// alice gained her increment for moving; bob's clock has not run
+	if s.clocks[0] <= time.Minute || s.clocks[0] > time.Minute+5*time.Second {
+		t.Errorf("alice has %s left after one quick move, want just under 1m5s", s.clocks[0])
+	}
+	if s.clocks[1] != time.Minute {
+		t.Errorf("bob has %s left before moving, want 1m", s.clocks[1])
+	}
+}
+
+func TestClockRunsOut(t *testing.T) {
+	s, peers := testSession()
+	s.applySettings(GameSettings{Variant: variantStandard, TimeControl: "1+0"})
+	s.startClock()
+	s.applyMove(MoveRequest{Username: "alice", Ply: 0, Col: 3})
+
+	// bob is left with almost no time and does not move
+	s.TurnMu.Lock()
+	s.clocks[1] = 20 * time.Millisecond
+	s.startClock()
+	s.TurnMu.Unlock()
+	eventually(t, "bob runs out of time", func() bool {
+		s.TurnMu.Lock()
+		defer s.TurnMu.Unlock()
+		return s.State == "finished"
+	})
+	if s.Result != "alice" {
+		t.Errorf("result is %q, want alice winning on time", s.Result)
+	}
+	if left := s.clocksLeft(); left[1] != 0 {
+		t.Errorf("bob's clock shows %dms, want 0", left[1])
+	}
+
+	// a move arriving after the flag is refused
+	peers["bob"].take()
+	s.applyMove(MoveRequest{Username: "bob", MoveID: "late", Ply: 1, Col: 3})
+	if ack, _ := lastAck(peers["bob"].take()); ack.Accepted || ack.Reason != "game_over" {
+		t.Errorf("late move got %+v, want game_over", ack)
+	}
+}
+
+func TestMoveAfterTimeIsUp(t *testing.T) {
+	s, peers := testSession()
+	s.applySettings(GameSettings{Variant: variantStandard, TimeControl: "1+0"})
+	s.startClock()
+	// the flag has not fallen yet, but alice's time is gone when she moves
+	s.flagTimer.Stop()
+	s.turnStart = time.Now().Add(-2 * time.Minute)
+
+	s.applyMove(MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: 3})
+	if ack, _ := lastAck(peers["alice"].take()); ack.Accepted || ack.Reason != "timeout" {
+		t.Errorf("move after time ran out got %+v, want timeout", ack)
+	}
+	if s.State != "finished" || s.Result != "bob" || len(s.Moves) != 0 {
+		t.Errorf("game is %s with result %q and %d moves, want bob winning before any move", s.State, s.Result, len(s.Moves))
+	}
+}
+
+func TestClockLagCredit(t *testing.T) {
+	tests := []struct {
+		name  string
+		rtt   time.Duration
+		spent time.Duration
+	}{
+		{"no measurement", 0, 0},
+		{"half the round trip", 300 * time.Millisecond, 150 * time.Millisecond},
+		{"capped", 5 * time.Second, maxLagCredit},
+	}
+	for _, tt := range tests {
+		s, _ := testSession()
+		s.applySettings(GameSettings{Variant: variantStandard, TimeControl: "1+0"})
+		s.latency = map[string]time.Duration{"alice": tt.rtt, "bob": time.Second}
+		s.startClock()
+		s.flagTimer.Stop()
+
+		// alice's move took a second to reach the server
+		s.turnStart = time.Now().Add(-time.Second)
+		s.applyMove(MoveRequest{Username: "alice", Ply: 0, Col: 3})
+		s.finish("draw", "draw", nil)
+		charged := time.Minute - s.clocks[0]
+		if want := time.Second - tt.spent; charged < want || charged > want+100*time.Millisecond {
+			t.Errorf("%s: alice was charged %s, want about %s", tt.name, charged, want)
+		}
+	}
+}
+
+func TestFlagWaitsForLagCredit(t *testing.T) {
+	s, _ := testSession()
+	s.applySettings(GameSettings{Variant: variantStandard, TimeControl: "1+0"})
+	s.TurnMu.Lock()
+	s.startClock()
+	s.clocks[0] = 20 * time.Millisecond
+	s.startClock()
+	// alice's connection turns out slower once the timer is running
+	s.latency = map[string]time.Duration{"alice": 400 * time.Millisecond}
+	s.TurnMu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	s.TurnMu.Lock()
+	state := s.State
+	s.TurnMu.Unlock()
+	if state != "playing" {
+		t.Fatalf("alice was flagged with her lag credit still to run")
+	}
+	eventually(t, "alice runs out of time", func() bool {
+		s.TurnMu.Lock()
+		defer s.TurnMu.Unlock()
+		return s.State == "finished"
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cluster is the state shared between server instances: which node owns a
+// game, which node a user is connected to, the matchmaking queue and the
+// rooms. Everything else (connections, running sessions) stays local to the
+// node that owns it and is reached through Send.
+type Cluster interface {
+	NodeID() string
+
+	// Sessions are owned by the node running them. ClaimSession fails with
+	// errSessionOwned if another live node already owns the game.
+	ClaimSession(gameID string) error
+	ReleaseSession(gameID string) error
+	SessionOwner(gameID string) (string, error)
+
+	// Users are registered on the node holding their connection
+	RegisterUser(username string) error
+	UnregisterUser(username string) error
+	UserNode(username string) (string, error)
+
+	// Session tokens vouch for a connected user's further connections and
+	// API requests. Every node with connections of the user holds the
+	// token, which is gone once the last of them releases it.
+	// PutSessionToken replaces the token and its holders with this node.
+	PutSessionToken(username, token string) error
+	HoldSessionToken(username string) error
+	ReleaseSessionToken(username string) error
+	SessionToken(username string) (string, error)
+
+	// Matchmaking queues, oldest entry first, with each entry naming its
+	// queue. QueueAdd returns errQueued if the user is already in any of them.
+	QueueAdd(e QueueEntry) error
+	QueueRemove(username string) (bool, error)
+	QueueEntries() ([]QueueEntry, error)
+	// QueueTake removes all of usernames from the queue, or none of them if
+	// any is missing (already matched elsewhere)
+	QueueTake(usernames ...string) (bool, error)
+
+	// Rooms
+	PutRoom(room *Room) error
+	GetRoom(id string) (*Room, error)
+	// UpdateRoom applies fn to the room atomically and stores the result
+	UpdateRoom(id string, fn func(room *Room) error) (*Room, error)
+	DeleteRoom(id string) error
+	Rooms() ([]*Room, error)
+
+	// Live games are published by each node as a whole, replacing what it
+	// published before. LiveGames returns them by node, for live nodes only.
+	PublishLiveGames(games []LiveGame) error
+	LiveGames() (map[string][]LiveGame, error)
+	// Presence works the same way for the users online on each node
+	PublishPresence(users []Presence) error
+	Presence() (map[string][]Presence, error)
+
+	// Nodes lists the live nodes, including this one
+	Nodes() ([]string, error)
+	// Send delivers m to the given node; Receive sets the handler for
+	// messages addressed to this node
+	Send(node string, m ClusterMessage) error
+	Receive(handler func(ClusterMessage))
+
+	Close() error
+}
+
+var (
+	errNotFound     = errors.New("not found")
+	errSessionOwned = errors.New("session owned by another node")
+	errQueued       = errors.New("already queued")
+)
+
+// QueueEntry is a player waiting in the matchmaking queue
+type QueueEntry struct {
+	Username string    `json:"username"`
+	Node     string    `json:"node"`
+	JoinedAt time.Time `json:"joined_at"`
+	Rating   int       `json:"rating"`
+	Queue    string    `json:"queue"` // name of the queue joined
+}
+
+// ClusterMessage is passed between nodes
+type ClusterMessage struct {
+	Kind     string          `json:"kind"` // deliver, state, move, left, rejoin
+	From     string          `json:"from"`
+	Username string          `json:"username,omitempty"`
+	GameID   string          `json:"gameId,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// MemoryBackend holds cluster state for nodes living in the same process.
+// It is used for single-instance deployments and tests.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	sessions map[string]string     // gameId -> node
+	users    map[string]string     // username -> node
+	tokens   map[string]*heldToken // username -> session token
+	queue    []QueueEntry
+	rooms    map[string]*Room
+	live     map[string][]LiveGame          // node -> games it published
+	presence map[string][]Presence          // node -> users it published
+	inboxes  map[string]chan ClusterMessage // node -> pending messages
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		sessions: map[string]string{},
+		users:    map[string]string{},
+		tokens:   map[string]*heldToken{},
+		rooms:    map[string]*Room{},
+		live:     map[string][]LiveGame{},
+		presence: map[string][]Presence{},
+		inboxes:  map[string]chan ClusterMessage{},
+	}
+}
+
+// Join returns the Cluster view for one node
+func (b *MemoryBackend) Join(nodeID string) Cluster {
+	b.mu.Lock()
+	b.inboxes[nodeID] = make(chan ClusterMessage, 1024)
+	b.mu.Unlock()
+	return &memoryCluster{b: b, node: nodeID}
+}
+
+type memoryCluster struct {
+	b    *MemoryBackend
+	node string
+}
+
+func (m *memoryCluster) NodeID() string { return m.node }
+
+func (m *memoryCluster) ClaimSession(gameID string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	if owner, ok := m.b.sessions[gameID]; ok && owner != m.node {
+		if _, alive := m.b.inboxes[owner]; alive {
+			return errSessionOwned
+		}
+	}
+	m.b.sessions[gameID] = m.node
+	return nil
+}
+
+func (m *memoryCluster) ReleaseSession(gameID string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	if m.b.sessions[gameID] == m.node {
+		delete(m.b.sessions, gameID)
+	}
+	return nil
+}
+
+func (m *memoryCluster) SessionOwner(gameID string) (string, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	owner, ok := m.b.sessions[gameID]
+	if !ok {
+		return "", errNotFound
+	}
+	return owner, nil
+}
+
+func (m *memoryCluster) RegisterUser(username string) error {
+	m.b.mu.Lock()
+	m.b.users[username] = m.node
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) UnregisterUser(username string) error {
+	m.b.mu.Lock()
+	if m.b.users[username] == m.node {
+		delete(m.b.users, username)
+	}
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) UserNode(username string) (string, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	node, ok := m.b.users[username]
+	if !ok {
+		return "", errNotFound
+	}
+	return node, nil
+}
+
+// heldToken is a session token and the nodes holding it
+type heldToken struct {
+	token string
+	nodes map[string]bool
+}
+
+func (m *memoryCluster) PutSessionToken(username, token string) error {
+	m.b.mu.Lock()
+	m.b.tokens[username] = &heldToken{token: token, nodes: map[string]bool{m.node: true}}
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) HoldSessionToken(username string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	held, ok := m.b.tokens[username]
+	if !ok {
+		return errNotFound
+	}
+	held.nodes[m.node] = true
+	return nil
+}
+
+func (m *memoryCluster) ReleaseSessionToken(username string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	if held, ok := m.b.tokens[username]; ok {
+		delete(held.nodes, m.node)
+		if len(held.nodes) == 0 {
+			delete(m.b.tokens, username)
+		}
+	}
+	return nil
+}
+
+func (m *memoryCluster) SessionToken(username string) (string, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	held, ok := m.b.tokens[username]
+	if !ok {
+		return "", errNotFound
+	}
+	return held.token, nil
+}
+
+func (m *memoryCluster) QueueAdd(e QueueEntry) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	for _, other := range m.b.queue {
+		if other.Username == e.Username {
+			return errQueued
+		}
+	}
+	m.b.queue = append(m.b.queue, e)
+	return nil
+}
+
+func (m *memoryCluster) QueueRemove(username string) (bool, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	for i, e := range m.b.queue {
+		if e.Username == username {
+			m.b.queue = append(m.b.queue[:i], m.b.queue[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryCluster) QueueEntries() ([]QueueEntry, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	return append([]QueueEntry(nil), m.b.queue...), nil
+}
+
+func (m *memoryCluster) QueueTake(usernames ...string) (bool, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	want := map[string]bool{}
+	for _, u := range usernames {
+		want[u] = true
+	}
+	found := 0
+	for _, e := range m.b.queue {
+		if want[e.Username] {
+			found++
+		}
+	}
+	if found < len(want) {
+		return false, nil
+	}
+	rest := m.b.queue[:0]
+	for _, e := range m.b.queue {
+		if !want[e.Username] {
+			rest = append(rest, e)
+		}
+	}
+	m.b.queue = rest
+	return true, nil
+}
+
+func (m *memoryCluster) PutRoom(room *Room) error {
+	m.b.mu.Lock()
+	cp := *room
+	m.b.rooms[room.ID] = &cp
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) GetRoom(id string) (*Room, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	room, ok := m.b.rooms[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	cp := *room
+	return &cp, nil
+}
+
+func (m *memoryCluster) UpdateRoom(id string, fn func(room *Room) error) (*Room, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	room, ok := m.b.rooms[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	cp := *room
+	if err := fn(&cp); err != nil {
+		return nil, err
+	}
+	m.b.rooms[id] = &cp
+	out := cp
+	return &out, nil
+}
+
+func (m *memoryCluster) DeleteRoom(id string) error {
+	m.b.mu.Lock()
+	delete(m.b.rooms, id)
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) Rooms() ([]*Room, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	list := make([]*Room, 0, len(m.b.rooms))
+	for _, room := range m.b.rooms {
+		cp := *room
+		list = append(list, &cp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (m *memoryCluster) PublishLiveGames(games []LiveGame) error {
+	m.b.mu.Lock()
+	m.b.live[m.node] = append([]LiveGame(nil), games...)
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) LiveGames() (map[string][]LiveGame, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	out := map[string][]LiveGame{}
+	for node, games := range m.b.live {
+		if _, alive := m.b.inboxes[node]; alive {
+			out[node] = append([]LiveGame(nil), games...)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryCluster) PublishPresence(users []Presence) error {
+	m.b.mu.Lock()
+	m.b.presence[m.node] = append([]Presence(nil), users...)
+	m.b.mu.Unlock()
+	return nil
+}
+
+func (m *memoryCluster) Presence() (map[string][]Presence, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	out := map[string][]Presence{}
+	for node, users := range m.b.presence {
+		if _, alive := m.b.inboxes[node]; alive {
+			out[node] = append([]Presence(nil), users...)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryCluster) Nodes() ([]string, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	nodes := make([]string, 0, len(m.b.inboxes))
+	for id := range m.b.inboxes {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func (m *memoryCluster) Send(node string, msg ClusterMessage) error {
+	m.b.mu.Lock()
+	inbox, ok := m.b.inboxes[node]
+	m.b.mu.Unlock()
+	if !ok {
+		return errNotFound
+	}
+	msg.From = m.node
+	inbox <- msg
+	return nil
+}
+
+// Receive dispatches messages one at a time so their order is preserved
+func (m *memoryCluster) Receive(handler func(ClusterMessage)) {
+	m.b.mu.Lock()
+	inbox := m.b.inboxes[m.node]
+	m.b.mu.Unlock()
+	go func() {
+		for msg := range inbox {
+			handler(msg)
+		}
+	}()
+}
+
+func (m *memoryCluster) Close() error {
+	m.b.mu.Lock()
+	// the inbox is left open so a concurrent Send cannot panic
+	delete(m.b.inboxes, m.node)
+	delete(m.b.live, m.node)
+	m.b.mu.Unlock()
+	return nil
+}
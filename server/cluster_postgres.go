@@ -0,0 +1,561 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	heartbeatPeriod = 5 * time.Second
+	nodeExpiry      = 20 * time.Second // a node missing heartbeats this long is considered dead
+)
+
+// PostgresCluster shares cluster state through the game database and relays
+// messages between nodes with LISTEN/NOTIFY.
+type PostgresCluster struct {
+	db       *sql.DB
+	node     string
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// NewPostgresCluster registers nodeID in the database and starts its heartbeat
+func NewPostgresCluster(config *Config, db *sql.DB, nodeID string) (*PostgresCluster, error) {
+	if err := initClusterSchema(db); err != nil {
+		return nil, err
+	}
+
+	listener := pq.NewListener(dsn(config), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Cluster listener: %v", err)
+		}
+	})
+	if err := listener.Listen(nodeChannel(nodeID)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	pc := &PostgresCluster{db: db, node: nodeID, listener: listener, done: make(chan struct{})}
+	if err := pc.heartbeat(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// users from a previous run of this node are no longer connected
+	if _, err := db.Exec(`DELETE FROM cluster_users WHERE node_id = $1`, nodeID); err != nil {
+		log.Printf("Failed to clear stale cluster users: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM cluster_tokens WHERE node_id = $1`, nodeID); err != nil {
+		log.Printf("Failed to clear stale session tokens: %v", err)
+	}
+	// nor is anybody it had waiting in the matchmaking queue
+	if _, err := db.Exec(`DELETE FROM cluster_queue WHERE node_id = $1`, nodeID); err != nil {
+		log.Printf("Failed to clear stale queue entries: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(heartbeatPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pc.done:
+				return
+			case <-ticker.C:
+				if err := pc.heartbeat(); err != nil {
+					log.Printf("Cluster heartbeat failed: %v", err)
+				}
+			}
+		}
+	}()
+	return pc, nil
+}
+
+func initClusterSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS cluster_nodes (
+		node_id VARCHAR(255) PRIMARY KEY,
+		heartbeat_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_sessions (
+		game_id VARCHAR(255) PRIMARY KEY,
+		node_id VARCHAR(255) NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_users (
+		username VARCHAR(255) PRIMARY KEY,
+		node_id VARCHAR(255) NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_tokens (
+		username VARCHAR(255) NOT NULL,
+		node_id VARCHAR(255) NOT NULL,
+		token VARCHAR(255) NOT NULL,
+		PRIMARY KEY (username, node_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_queue (
+		username VARCHAR(255) PRIMARY KEY,
+		node_id VARCHAR(255) NOT NULL,
+		joined_at TIMESTAMP NOT NULL
+	);
+
+	ALTER TABLE cluster_queue ADD COLUMN IF NOT EXISTS rating INT NOT NULL DEFAULT 1200;
+	ALTER TABLE cluster_queue ADD COLUMN IF NOT EXISTS queue TEXT NOT NULL DEFAULT 'standard';
+
+	CREATE TABLE IF NOT EXISTS cluster_rooms (
+		id VARCHAR(255) PRIMARY KEY,
+		data JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_live_games (
+		node_id VARCHAR(255) PRIMARY KEY,
+		data JSONB NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS cluster_presence (
+		node_id VARCHAR(255) PRIMARY KEY,
+		data JSONB NOT NULL
+	);
+	`
+
+	_, err := db.Exec(schema)
+	return err
+}
+
+// nodeChannel is the NOTIFY channel a node listens on
+func nodeChannel(nodeID string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, nodeID)
+	return "c4_node_" + clean
+}
+
+func (pc *PostgresCluster) heartbeat() error {
+	_, err := pc.db.Exec(`
+		INSERT INTO cluster_nodes (node_id, heartbeat_at) VALUES ($1, $2)
+		ON CONFLICT (node_id) DO UPDATE SET heartbeat_at = $2
+	`, pc.node, time.Now())
+	return err
+}
+
+func (pc *PostgresCluster) NodeID() string { return pc.node }
+
+// ClaimSession takes the game if it is unowned, already ours, or owned by a
+// node whose heartbeat has expired
+func (pc *PostgresCluster) ClaimSession(gameID string) error {
+	res, err := pc.db.Exec(`
+		INSERT INTO cluster_sessions (game_id, node_id) VALUES ($1, $2)
+		ON CONFLICT (game_id) DO UPDATE SET node_id = $2
+		WHERE cluster_sessions.node_id = $2
+		   OR cluster_sessions.node_id NOT IN (SELECT node_id FROM cluster_nodes WHERE heartbeat_at > $3)
+	`, gameID, pc.node, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSessionOwned
+	}
+	return nil
+}
+
+func (pc *PostgresCluster) ReleaseSession(gameID string) error {
+	_, err := pc.db.Exec(`DELETE FROM cluster_sessions WHERE game_id = $1 AND node_id = $2`, gameID, pc.node)
+	return err
+}
+
+func (pc *PostgresCluster) SessionOwner(gameID string) (string, error) {
+	var node string
+	err := pc.db.QueryRow(`SELECT node_id FROM cluster_sessions WHERE game_id = $1`, gameID).Scan(&node)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return node, err
+}
+
+func (pc *PostgresCluster) RegisterUser(username string) error {
+	_, err := pc.db.Exec(`
+		INSERT INTO cluster_users (username, node_id) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET node_id = $2
+	`, username, pc.node)
+	return err
+}
+
+func (pc *PostgresCluster) UnregisterUser(username string) error {
+	_, err := pc.db.Exec(`DELETE FROM cluster_users WHERE username = $1 AND node_id = $2`, username, pc.node)
+	return err
+}
+
+// UserNode ignores registrations left behind by nodes that have died
+func (pc *PostgresCluster) UserNode(username string) (string, error) {
+	var node string
+	err := pc.db.QueryRow(`
+		SELECT u.node_id FROM cluster_users u
+		JOIN cluster_nodes n ON n.node_id = u.node_id
+		WHERE u.username = $1 AND n.heartbeat_at > $2
+	`, username, time.Now().Add(-nodeExpiry)).Scan(&node)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return node, err
+}
+
+// PutSessionToken keeps one row per node holding the token
+func (pc *PostgresCluster) PutSessionToken(username, token string) error {
+	tx, err := pc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM cluster_tokens WHERE username = $1`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO cluster_tokens (username, node_id, token) VALUES ($1, $2, $3)`, username, pc.node, token); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pc *PostgresCluster) HoldSessionToken(username string) error {
+	res, err := pc.db.Exec(`
+		INSERT INTO cluster_tokens (username, node_id, token)
+		SELECT username, $2, token FROM cluster_tokens WHERE username = $1 LIMIT 1
+		ON CONFLICT (username, node_id) DO NOTHING
+	`, username, pc.node)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := pc.SessionToken(username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *PostgresCluster) ReleaseSessionToken(username string) error {
+	_, err := pc.db.Exec(`DELETE FROM cluster_tokens WHERE username = $1 AND node_id = $2`, username, pc.node)
+	return err
+}
+
+// SessionToken ignores holders that have died, as the connections they
+// vouched for are gone
+func (pc *PostgresCluster) SessionToken(username string) (string, error) {
+	var token string
+	err := pc.db.QueryRow(`
+		SELECT t.token FROM cluster_tokens t
+		JOIN cluster_nodes n ON n.node_id = t.node_id
+		WHERE t.username = $1 AND n.heartbeat_at > $2
+		LIMIT 1
+	`, username, time.Now().Add(-nodeExpiry)).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return token, err
+}
+
+// QueueAdd replaces an entry left behind by a node that has died
+func (pc *PostgresCluster) QueueAdd(e QueueEntry) error {
+	res, err := pc.db.Exec(`
+		INSERT INTO cluster_queue (username, node_id, joined_at, rating, queue) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (username) DO UPDATE
+		SET node_id = $2, joined_at = $3, rating = $4, queue = $5
+		WHERE cluster_queue.node_id NOT IN (SELECT node_id FROM cluster_nodes WHERE heartbeat_at > $6)
+	`, e.Username, e.Node, e.JoinedAt, e.Rating, e.Queue, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errQueued
+	}
+	return nil
+}
+
+func (pc *PostgresCluster) QueueRemove(username string) (bool, error) {
+	res, err := pc.db.Exec(`DELETE FROM cluster_queue WHERE username = $1`, username)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// QueueEntries skips players queued on nodes that have died, as nobody is
+// left to start their games
+func (pc *PostgresCluster) QueueEntries() ([]QueueEntry, error) {
+	rows, err := pc.db.Query(`
+		SELECT q.username, q.node_id, q.joined_at, q.rating, q.queue FROM cluster_queue q
+		JOIN cluster_nodes n ON n.node_id = q.node_id
+		WHERE n.heartbeat_at > $1
+		ORDER BY q.joined_at
+	`, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []QueueEntry
+	for rows.Next() {
+		var e QueueEntry
+		if err := rows.Scan(&e.Username, &e.Node, &e.JoinedAt, &e.Rating, &e.Queue); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// QueueTake fails if any of the players is only queued on a dead node
+func (pc *PostgresCluster) QueueTake(usernames ...string) (bool, error) {
+	tx, err := pc.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		DELETE FROM cluster_queue
+		WHERE username = ANY($1) AND node_id IN (SELECT node_id FROM cluster_nodes WHERE heartbeat_at > $2)
+	`, pq.Array(usernames), time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); int(n) != len(usernames) {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+func (pc *PostgresCluster) PutRoom(room *Room) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	_, err = pc.db.Exec(`
+		INSERT INTO cluster_rooms (id, data, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET data = $2
+	`, room.ID, data, room.CreatedAt)
+	return err
+}
+
+func (pc *PostgresCluster) GetRoom(id string) (*Room, error) {
+	var data []byte
+	err := pc.db.QueryRow(`SELECT data FROM cluster_rooms WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var room Room
+	if err := json.Unmarshal(data, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (pc *PostgresCluster) UpdateRoom(id string, fn func(room *Room) error) (*Room, error) {
+	tx, err := pc.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow(`SELECT data FROM cluster_rooms WHERE id = $1 FOR UPDATE`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var room Room
+	if err := json.Unmarshal(data, &room); err != nil {
+		return nil, err
+	}
+	if err := fn(&room); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(&room); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE cluster_rooms SET data = $2 WHERE id = $1`, id, data); err != nil {
+		return nil, err
+	}
+	return &room, tx.Commit()
+}
+
+func (pc *PostgresCluster) DeleteRoom(id string) error {
+	_, err := pc.db.Exec(`DELETE FROM cluster_rooms WHERE id = $1`, id)
+	return err
+}
+
+func (pc *PostgresCluster) Rooms() ([]*Room, error) {
+	rows, err := pc.db.Query(`SELECT data FROM cluster_rooms ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Room
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			continue
+		}
+		var room Room
+		if err := json.Unmarshal(data, &room); err != nil {
+			continue
+		}
+		list = append(list, &room)
+	}
+	return list, rows.Err()
+}
+
+func (pc *PostgresCluster) PublishLiveGames(games []LiveGame) error {
+	data, err := json.Marshal(games)
+	if err != nil {
+		return err
+	}
+	_, err = pc.db.Exec(`
+		INSERT INTO cluster_live_games (node_id, data) VALUES ($1, $2)
+		ON CONFLICT (node_id) DO UPDATE SET data = $2
+	`, pc.node, data)
+	return err
+}
+
+// LiveGames skips nodes whose heartbeat has expired, as their games are no
+// longer being played there
+func (pc *PostgresCluster) LiveGames() (map[string][]LiveGame, error) {
+	rows, err := pc.db.Query(`
+		SELECT l.node_id, l.data FROM cluster_live_games l
+		JOIN cluster_nodes n ON n.node_id = l.node_id
+		WHERE n.heartbeat_at > $1
+	`, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string][]LiveGame{}
+	for rows.Next() {
+		var node string
+		var data []byte
+		if err := rows.Scan(&node, &data); err != nil {
+			return nil, err
+		}
+		var games []LiveGame
+		if err := json.Unmarshal(data, &games); err != nil {
+			continue
+		}
+		out[node] = games
+	}
+	return out, rows.Err()
+}
+
+func (pc *PostgresCluster) PublishPresence(users []Presence) error {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	_, err = pc.db.Exec(`
+		INSERT INTO cluster_presence (node_id, data) VALUES ($1, $2)
+		ON CONFLICT (node_id) DO UPDATE SET data = $2
+	`, pc.node, data)
+	return err
+}
+
+// Presence skips nodes whose heartbeat has expired, as their users have
+// been disconnected
+func (pc *PostgresCluster) Presence() (map[string][]Presence, error) {
+	rows, err := pc.db.Query(`
+		SELECT p.node_id, p.data FROM cluster_presence p
+		JOIN cluster_nodes n ON n.node_id = p.node_id
+		WHERE n.heartbeat_at > $1
+	`, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string][]Presence{}
+	for rows.Next() {
+		var node string
+		var data []byte
+		if err := rows.Scan(&node, &data); err != nil {
+			return nil, err
+		}
+		var users []Presence
+		if err := json.Unmarshal(data, &users); err != nil {
+			continue
+		}
+		out[node] = users
+	}
+	return out, rows.Err()
+}
+
+func (pc *PostgresCluster) Nodes() ([]string, error) {
+	rows, err := pc.db.Query(`SELECT node_id FROM cluster_nodes WHERE heartbeat_at > $1 ORDER BY node_id`, time.Now().Add(-nodeExpiry))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var nodes []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, id)
+	}
+	return nodes, rows.Err()
+}
+
+func (pc *PostgresCluster) Send(node string, m ClusterMessage) error {
+	m.From = pc.node
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = pc.db.Exec(`SELECT pg_notify($1, $2)`, nodeChannel(node), string(data))
+	return err
+}
+
+// Receive dispatches notifications one at a time so their order is preserved
+func (pc *PostgresCluster) Receive(handler func(ClusterMessage)) {
+	go func() {
+		for n := range pc.listener.Notify {
+			if n == nil {
+				continue // reconnected; anything sent meanwhile is lost
+			}
+			var m ClusterMessage
+			if err := json.Unmarshal([]byte(n.Extra), &m); err != nil {
+				log.Printf("Cluster: bad message: %v", err)
+				continue
+			}
+			handler(m)
+		}
+	}()
+}
+
+func (pc *PostgresCluster) Close() error {
+	close(pc.done)
+	pc.db.Exec(`DELETE FROM cluster_nodes WHERE node_id = $1`, pc.node)
+	pc.db.Exec(`DELETE FROM cluster_users WHERE node_id = $1`, pc.node)
+	pc.db.Exec(`DELETE FROM cluster_tokens WHERE node_id = $1`, pc.node)
+	pc.db.Exec(`DELETE FROM cluster_queue WHERE node_id = $1`, pc.node)
+	pc.db.Exec(`DELETE FROM cluster_live_games WHERE node_id = $1`, pc.node)
+	pc.db.Exec(`DELETE FROM cluster_presence WHERE node_id = $1`, pc.node)
+	return pc.listener.Close()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestMain points the global services at a temp dir with Kafka and
+// Postgres disabled. They are shared by all tests since sessions from one
+// test may still be winding down when the next starts.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "connect4-test")
+	if err != nil {
+		panic(err)
+	}
+	config = &Config{DataDir: dir, ReconnectTimeout: 5, ShutdownGrace: 1, MatchBotFallback: true, MatchWindow: 100, MatchWindowGrowth: 10, ChallengeTimeout: 60}
+	kafkaProducer = &KafkaProducer{}
+	database = &Database{}
+	store = NewFileStore(dir+"/games.json", dir+"/leaderboard.json", dir+"/sessions")
+
+	code := m.Run()
+	closeEventLog()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startNode runs a node on an httptest server
+func startNode(t *testing.T, backend *MemoryBackend, id string) (*Node, *httptest.Server) {
+	t.Helper()
+	n := NewNode(backend.Join(id))
+	n.matchWait = 200 * time.Millisecond
+	mux := http.NewServeMux()
+	n.routes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return n, srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, first map[string]any) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(first); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return conn
+}
+
+// readUntil reads messages until one of the given type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, typ string) map[string]any {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m map[string]any
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("waiting for %q: %v", typ, err)
+		}
+		if m["type"] == typ {
+			return m
+		}
+	}
+}
+
+// readUpdate reads until the next delta or full state message
+func readUpdate(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m map[string]any
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("waiting for update: %v", err)
+		}
+		if m["type"] == "delta" {
+			return m
+		}
+		if m["type"] == "state" {
+			// flatten to the fields of a delta
+			m["turn"] = m["state"].(map[string]any)["turn"]
+			return m
+		}
+	}
+}
+
+// readTurn reads updates until it is player's turn
+func readTurn(t *testing.T, conn *websocket.Conn, player int) {
+	t.Helper()
+	for {
+		if m := readUpdate(t, conn); m["turn"] == float64(player) {
+			return
+		}
+	}
+}
+
+// readFinished reads updates until the game is over
+func readFinished(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	for {
+		if m := readUpdate(t, conn); m["status"] == "finished" {
+			return m
+		}
+	}
+}
+
+func TestTwoNodesShareQueue(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "join", "username": "alice"})
+	bob := dial(t, srvB, map[string]any{"type": "join", "username": "bob"})
+
+	startA := readUntil(t, alice, "start")
+	startB := readUntil(t, bob, "start")
+	if startA["gameId"] != startB["gameId"] {
+		t.Fatalf("players were put in different games: %v vs %v", startA["gameId"], startB["gameId"])
+	}
+	if startA["opponent"] != "bob" || startB["opponent"] != "alice" {
+		t.Fatalf("unexpected opponents: %v, %v", startA["opponent"], startB["opponent"])
+	}
+
+	// player 1 stacks column 0, player 2 column 1; player 1 wins on move 7
+	first, second, winner := alice, bob, "alice"
+	if startB["you"] == float64(1) {
+		first, second, winner = bob, alice, "bob"
+	}
+	gameID := startA["gameId"]
+	for i := 0; i < 3; i++ {
+		first.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 0})
+		readTurn(t, second, 2)
+		second.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 1})
+		readTurn(t, first, 1)
+	}
+	first.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 0})
+
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		m := readFinished(t, conn)
+		if m["result"] != winner {
+			t.Fatalf("result = %v, want %s", m["result"], winner)
+		}
+	}
+}
+
+func TestRoomAcrossNodes(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "create_room", "username": "alice", "roomName": "shared"})
+	created := readUntil(t, alice, "room_created")
+
+	// the room is listed by the other node
+	resp, err := http.Get(srvB.URL + "/rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []RoomInfo
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].ID != created["roomId"] {
+		t.Fatalf("node b rooms = %+v, want room %v", list, created["roomId"])
+	}
+
+	bob := dial(t, srvB, map[string]any{"type": "join_room", "username": "bob", "roomId": created["roomId"]})
+	readUntil(t, bob, "room_joined")
+	readUntil(t, alice, "room_update")
+
+	// the game starts once both have pressed ready
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		conn.WriteJSON(map[string]any{"type": "room_ready", "roomId": created["roomId"], "ready": true})
+	}
+	startA := readUntil(t, alice, "start")
+	startB := readUntil(t, bob, "start")
+	if startA["gameId"] != startB["gameId"] {
+		t.Fatalf("players were put in different games")
+	}
+}
+
+func TestReconnectThroughOtherNode(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "join", "username": "alice"})
+	bob := dial(t, srvA, map[string]any{"type": "join", "username": "bob"})
+	start := readUntil(t, alice, "start")
+	readUntil(t, bob, "start")
+	gameID := start["gameId"]
+
+	// alice drops off node a and comes back through node b; without her
+	// token the seat is refused
+	alice.Close()
+	time.Sleep(100 * time.Millisecond)
+	mallory := dial(t, srvB, map[string]any{"type": "join", "username": "alice", "gameId": gameID, "reconnectToken": "forged"})
+	if m := readUntil(t, mallory, "error"); m["code"] != ErrReconnectRejected {
+		t.Fatalf("reconnect with forged token got %v, want error", m)
+	}
+	alice = dial(t, srvB, map[string]any{"type": "join", "username": "alice", "gameId": gameID, "reconnectToken": start["reconnectToken"]})
+	m := readUntil(t, alice, "reconnected")
+	if m["gameId"] != gameID {
+		t.Fatalf("reconnected to %v, want %v", m["gameId"], gameID)
+	}
+
+	// moves from node b reach the session on node a
+	mover, watcher := alice, bob
+	if start["you"] != float64(1) {
+		mover, watcher = bob, alice
+	}
+	mover.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 3})
+	readUpdate(t, watcher)
+
+	// a resync through node b is answered with a full snapshot
+	alice.WriteJSON(map[string]any{"type": "resync", "gameId": gameID})
+	if m := readUntil(t, alice, "state"); m["seq"] != float64(1) {
+		t.Fatalf("resync snapshot seq = %v, want 1", m["seq"])
+	}
+}
+
+func TestResyncForwardedToOwner(t *testing.T) {
+	backend := NewMemoryBackend()
+	nodeA, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "join", "username": "alice"})
+	bob := dial(t, srvB, map[string]any{"type": "join", "username": "bob"})
+	startA := readUntil(t, alice, "start")
+	startB := readUntil(t, bob, "start")
+	gameID := startA["gameId"].(string)
+
+	// remote is the player connected to the node that does not run the game
+	remote, local := bob, alice
+	remoteStart := startB
+	if _, ok := nodeA.localGame(gameID); !ok {
+		remote, local, remoteStart = alice, bob, startA
+	}
+	first, second := local, remote
+	if remoteStart["you"] == float64(1) {
+		first, second = remote, local
+	}
+
+	// three moves are played, keeping time on the local connection
+	for i, col := range []int{3, 4, 3} {
+		mover := first
+		if i%2 == 1 {
+			mover = second
+		}
+		mover.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": col})
+		if m := readUpdate(t, local); m["seq"] != float64(i+1) {
+			t.Fatalf("update seq = %v, want %d", m["seq"], i+1)
+		}
+	}
+
+	// drop the remote player's first delta, leaving a gap before seq 2
+	readUpdate(t, remote)
+	if m := readUpdate(t, remote); m["seq"] != float64(2) {
+		t.Fatalf("next update seq = %v, want 2", m["seq"])
+	}
+
+	// the resync goes through the remote player's node to the owner
+	remote.WriteJSON(map[string]any{"type": "resync", "gameId": gameID})
+	state := readUntil(t, remote, "state")
+	if state["seq"] != float64(3) || state["ply"] != float64(3) {
+		t.Fatalf("resync state has seq %v, ply %v; want 3 and 3", state["seq"], state["ply"])
+	}
+	board := state["state"].(map[string]any)["board"].([]any)
+	bottom := board[defaultRows-1].([]any)
+	if bottom[3] != float64(1) || bottom[4] != float64(2) {
+		t.Fatalf("resynced board is missing moves: %v", board)
+	}
+}
+
+func TestSessionTokenAcrossNodes(t *testing.T) {
+	backend := NewMemoryBackend()
+	a, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"]
+
+	// another tab on either node shares the session with the token only
+	tab := dial(t, srvB, map[string]any{"type": "hello", "username": "alice", "token": token})
+	if got := readUntil(t, tab, "welcome")["token"]; got != token {
+		t.Fatalf("second tab got token %v, want %v", got, token)
+	}
+	impostor := dial(t, srvB, map[string]any{"type": "hello", "username": "alice", "token": "forged"})
+	if m := readUntil(t, impostor, "error"); m["code"] != ErrUsernameTaken {
+		t.Fatalf("forged token got %v, want username_taken", m)
+	}
+
+	// the token outlives the first tab, whichever node the rest are on
+	alice.Close()
+	eventually(t, "alice's first tab closes", func() bool { return len(a.clientsOf("alice")) == 0 })
+	third := dial(t, srvA, map[string]any{"type": "hello", "username": "alice", "token": token})
+	readUntil(t, third, "welcome")
+	third.Close()
+	eventually(t, "alice's third tab closes", func() bool { return len(a.clientsOf("alice")) == 0 })
+	if _, err := a.cluster.SessionToken("alice"); err != nil {
+		t.Fatalf("token revoked while a tab is still open: %v", err)
+	}
+
+	// it dies with the last connection, and the next login gets a new one
+	tab.Close()
+	eventually(t, "alice's session ends", func() bool {
+		_, err := a.cluster.SessionToken("alice")
+		return err == errNotFound
+	})
+	again := dial(t, srvA, map[string]any{"type": "hello", "username": "alice"})
+	if fresh := readUntil(t, again, "welcome")["token"]; fresh == token || fresh == "" {
+		t.Fatalf("new login got token %v, want a fresh one", fresh)
+	}
+	stale := dial(t, srvB, map[string]any{"type": "hello", "username": "alice", "token": token})
+	if m := readUntil(t, stale, "error"); m["code"] != ErrUsernameTaken {
+		t.Fatalf("revoked token got %v, want username_taken", m)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes the protocol messages for one connection. Both codecs work
+// from the structs in protocol.go and their json tags, so a message has the
+// same fields whichever encoding the client picked.
+//
+// Clients choose an encoding with the WebSocket subprotocol header:
+//
+//	Sec-WebSocket-Protocol: connect4.msgpack
+//
+// Without one, or with "connect4.json", messages are JSON text frames.
+type Codec interface {
+	Name() string
+	FrameType() int // websocket.TextMessage or websocket.BinaryMessage
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+const (
+	SubprotocolJSON    = "connect4.json"
+	SubprotocolMsgpack = "connect4.msgpack"
+)
+
+var codecs = map[string]Codec{
+	SubprotocolJSON:    jsonCodec{},
+	SubprotocolMsgpack: msgpackCodec{},
+}
+
+// codecFor returns the codec for the subprotocol agreed during the upgrade
+func codecFor(subprotocol string) Codec {
+	if c, ok := codecs[subprotocol]; ok {
+		return c
+	}
+	return jsonCodec{}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{SubprotocolMsgpack, SubprotocolJSON},
+}
+
+// writeFrame encodes v with codec and writes it to t
+func writeFrame(t Transport, codec Codec, v any) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.WriteFrame(data)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return SubprotocolJSON }
+func (jsonCodec) FrameType() int                     { return websocket.TextMessage }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec encodes messages as MessagePack. Values go through their JSON
+// form first, so field names and omitempty rules match the JSON codec, and
+// payloads relayed between nodes as json.RawMessage need no special casing.
+// Small integers such as board cells take a single byte.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return SubprotocolMsgpack }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	r := bytes.NewReader(data)
+	generic, err := msgpackDecode(r, 0)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return errors.New("msgpack: trailing data")
+	}
+	js, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+// msgpackEncode writes v, a value produced by decoding JSON with UseNumber
+func msgpackEncode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []any:
+		msgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		msgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msgpackEncode(buf, k)
+			if err := msgpackEncode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", v)
+	}
+	return nil
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// msgpackHeader writes a length prefix using the fix form when n < fixMax,
+// otherwise the 8 (if the type has one), 16 or 32 bit form
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// maxMsgpackDepth bounds nesting so a hostile frame cannot exhaust the stack
+const maxMsgpackDepth = 32
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// msgpackDecode reads one value. Only the types the protocol uses are
+// supported: nil, bool, integers, floats, strings, arrays and string-keyed maps.
+func msgpackDecode(r *bytes.Reader, depth int) (any, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, errMsgpackShort
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return msgpackString(r, int(b&0x1f))
+	case b&0xf0 == 0x90:
+		return msgpackArray(r, int(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return msgpackMap(r, int(b&0x0f), depth)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf, 0xd0, 0xd1, 0xd2, 0xd3:
+		return msgpackReadInt(r, b)
+	case 0xca:
+		var f float32
+		if err := binary.Read(r, binary.BigEndian, &f); err != nil {
+			return nil, errMsgpackShort
+		}
+		return float64(f), nil
+	case 0xcb:
+		var f float64
+		if err := binary.Read(r, binary.BigEndian, &f); err != nil {
+			return nil, errMsgpackShort
+		}
+		return f, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := msgpackLen(r, 1<<(b-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackString(r, n)
+	case 0xdc, 0xdd:
+		n, err := msgpackLen(r, 2<<(b-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackArray(r, n, depth)
+	case 0xde, 0xdf:
+		n, err := msgpackLen(r, 2<<(b-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackMap(r, n, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", b)
+}
+
+// msgpackLen reads a big-endian length of size bytes (1, 2 or 4)
+func msgpackLen(r *bytes.Reader, size int) (int, error) {
+	n := 0
+	for i := 0; i < size; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errMsgpackShort
+		}
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+func msgpackReadInt(r *bytes.Reader, b byte) (any, error) {
+	var err error
+	var i int64
+	switch b {
+	case 0xcc:
+		var v uint8
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xcd:
+		var v uint16
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xce:
+		var v uint32
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xcf:
+		var v uint64
+		err = binary.Read(r, binary.BigEndian, &v)
+		if v > math.MaxInt64 {
+			return float64(v), err
+		}
+		i = int64(v)
+	case 0xd0:
+		var v int8
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xd1:
+		var v int16
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xd2:
+		var v int32
+		err = binary.Read(r, binary.BigEndian, &v)
+		i = int64(v)
+	case 0xd3:
+		err = binary.Read(r, binary.BigEndian, &i)
+	}
+	if err != nil {
+		return nil, errMsgpackShort
+	}
+	return i, nil
+}
+
+func msgpackString(r *bytes.Reader, n int) (any, error) {
+	if n > r.Len() {
+		return nil, errMsgpackShort
+	}
+	s := make([]byte, n)
+	r.Read(s)
+	return string(s), nil
+}
+
+func msgpackArray(r *bytes.Reader, n int, depth int) (any, error) {
+	if n > r.Len() { // every element takes at least one byte
+		return nil, errMsgpackShort
+	}
+	out := make([]any, n)
+	for i := range out {
+		v, err := msgpackDecode(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func msgpackMap(r *bytes.Reader, n int, depth int) (any, error) {
+	if 2*n > r.Len() {
+		return nil, errMsgpackShort
+	}
+	out := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := msgpackDecode(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		v, err := msgpackDecode(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
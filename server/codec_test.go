@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fill sets every field reachable from v to a value that is not the zero
+// value, so that no field is left out by omitempty
+func fill(v reflect.Value, depth int) {
+	if depth > 6 {
+		return
+	}
+	switch v.Type() {
+	case reflect.TypeOf(time.Time{}):
+		v.Set(reflect.ValueOf(time.Date(2026, 10, 18, 12, 30, 45, 500, time.UTC)))
+		return
+	case reflect.TypeOf(json.RawMessage{}):
+		v.SetBytes([]byte(`{"nested":[1,-2,"three"]}`))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("text ünïcode")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(depth*1000 + 7))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(depth + 3))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.25)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem(), depth+1)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 2, 2))
+		for i := 0; i < 2; i++ {
+			fill(v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key := reflect.New(v.Type().Key()).Elem()
+		fill(key, depth+1)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fill(elem, depth+1)
+		v.SetMapIndex(key, elem)
+	case reflect.Interface:
+		v.Set(reflect.ValueOf("any"))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i), depth+1)
+			}
+		}
+	}
+}
+
+func TestMsgpackRoundTripsEveryMessage(t *testing.T) {
+	codec := codecFor(SubprotocolMsgpack)
+	for _, defs := range [][]messageDef{clientMessageDefs, serverMessageDefs} {
+		for _, d := range defs {
+			typ := reflect.TypeOf(d.Value)
+			msg := reflect.New(typ)
+			fill(msg.Elem(), 0)
+			if f := msg.Elem().FieldByName("Type"); f.IsValid() {
+				f.SetString(d.Type)
+			}
+
+			data, err := codec.Marshal(msg.Interface())
+			if err != nil {
+				t.Errorf("%s: marshal: %v", d.Type, err)
+				continue
+			}
+			back := reflect.New(typ)
+			if err := codec.Unmarshal(data, back.Interface()); err != nil {
+				t.Errorf("%s: unmarshal: %v", d.Type, err)
+				continue
+			}
+			want, _ := json.Marshal(msg.Interface())
+			got, _ := json.Marshal(back.Interface())
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: round trip\n got %s\nwant %s", d.Type, got, want)
+			}
+		}
+	}
+}
+
+func TestMsgpackRoundTripsValues(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("x", n) }
+	list := func(n int) []any {
+		out := make([]any, n)
+		for i := range out {
+			out[i] = i % 3
+		}
+		return out
+	}
+	values := []any{
+		nil, true, false,
+		0, 127, 128, 255, 256, 65535, 65536, math.MaxInt32, math.MaxInt32 + 1, int64(1) << 53,
+		-1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, -int64(1) << 53,
+		0.5, -1e300,
+		"", long(31), long(32), long(255), long(256), long(65536),
+		[]any{}, list(15), list(16), list(65536),
+		map[string]any{}, map[string]any{"a": 1, "b": []any{"c", nil}},
+	}
+	big := map[string]any{}
+	for i := 0; i < 20; i++ {
+		big[long(i+1)] = i
+	}
+	values = append(values, big)
+
+	codec := codecFor(SubprotocolMsgpack)
+	for _, v := range values {
+		data, err := codec.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", v, err)
+		}
+		var back any
+		if err := codec.Unmarshal(data, &back); err != nil {
+			t.Fatalf("unmarshal %v: %v", v, err)
+		}
+		want, _ := json.Marshal(v)
+		got, _ := json.Marshal(back)
+		if !bytes.Equal(got, want) {
+			t.Errorf("round trip of %.40s gave %.40s", want, got)
+		}
+	}
+
+	// decoding into any goes through float64, as with JSON; typed fields
+	// keep every bit
+	for _, n := range []int64{math.MaxInt64, math.MinInt64} {
+		data, _ := codec.Marshal(struct{ N int64 }{n})
+		var back struct{ N int64 }
+		if err := codec.Unmarshal(data, &back); err != nil || back.N != n {
+			t.Errorf("round trip of %d gave %d (%v)", n, back.N, err)
+		}
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	msg := StateMessage{Type: MsgState, GameID: "g_1", Seq: 300, State: newGame(defaultRows, defaultCols), Status: "playing", Ratings: map[string]int{"alice": 1500}}
+	data, err := msgpackCodec{}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i++ {
+		var back StateMessage
+		if err := (msgpackCodec{}).Unmarshal(data[:i], &back); err == nil {
+			t.Errorf("%d of %d bytes decoded without error", i, len(data))
+		}
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	nested := func(n int) []byte {
+		return append(bytes.Repeat([]byte{0x91}, n), 0xc0)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"str32 longer than the frame", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, false},
+		{"str8 longer than the frame", []byte{0xd9, 0x10, 'a', 'b'}, false},
+		{"array32 longer than the frame", []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}, false},
+		{"array16 longer than the frame", []byte{0xdc, 0x01, 0x00, 0xc0, 0xc0}, false},
+		{"map32 longer than the frame", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'k', 0xc0}, false},
+		{"fixmap longer than the frame", []byte{0x82, 0xa1, 'k', 0xc0}, false},
+		{"length cut short", []byte{0xda, 0x01}, false},
+		{"integer cut short", []byte{0xd2, 0x00, 0x01}, false},
+		{"float cut short", []byte{0xcb, 0x3f, 0xf0}, false},
+		{"non-string map key", []byte{0x81, 0x01, 0xc0}, false},
+		{"unsupported type", []byte{0xc1}, false},
+		{"binary is not supported", []byte{0xc4, 0x01, 0x00}, false},
+		{"trailing data", []byte{0xc0, 0xc0}, false},
+		{"empty frame", []byte{}, false},
+		{"nested to the limit", nested(maxMsgpackDepth), true},
+		{"nested too deeply", nested(maxMsgpackDepth + 1), false},
+		{"deep nesting in a map", append(bytes.Repeat([]byte{0x81, 0xa1, 'k'}, maxMsgpackDepth+1), 0xc0), false},
+	}
+	for _, tt := range tests {
+		var v any
+		err := msgpackCodec{}.Unmarshal(tt.data, &v)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	for proto, want := range map[string]string{
+		SubprotocolMsgpack: SubprotocolMsgpack,
+		SubprotocolJSON:    SubprotocolJSON,
+		"":                 SubprotocolJSON,
+		"unknown":          SubprotocolJSON,
+	} {
+		if got := codecFor(proto).Name(); got != want {
+			t.Errorf("codecFor(%q) = %s, want %s", proto, got, want)
+		}
+	}
+}
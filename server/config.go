@@ -19,7 +19,24 @@ type Config struct {
 	DBPassword      string
 	DBName          string
 	MatchTimeout    int // seconds to wait for matchmaking
+	MatchBotFallback bool // whether players nobody was found for play the bot instead of leaving the queue
 	ReconnectTimeout int // seconds to allow reconnection
+	ShutdownGrace    int // seconds to let active games finish on shutdown
+	ClusterBackend   string // "memory" (single instance) or "postgres"
+	NodeID           string // unique name of this instance within the cluster
+	ReconnectSecret  string // key for signing reconnect tokens; shared by all instances
+	ChatMaxLength    int      // characters allowed in one chat message
+	ChatRateLimit    int      // chat messages a player may send per ChatRateWindow
+	ChatRateWindow   int      // seconds
+	ChatFilter       []string // words masked out of chat
+	ChatHistory      int      // chat messages kept per game, room and lobby
+	EmoteCooldown    int      // seconds a player waits between emotes
+	SpectatorDelay   int      // seconds spectators lag behind games; rooms may ask for more
+	ChallengeTimeout int      // seconds a challenge waits for an answer
+	MatchWindow       int // rating difference allowed when a player joins the queue
+	MatchWindowGrowth int // points the window widens by per second of waiting
+
+	Queues []string // matchmaking queues as name[:variant[:time_control]]; the first is the default
 }
 
 // LoadConfig loads configuration from environment variables with defaults
@@ -37,8 +54,34 @@ func LoadConfig() *Config {
 		DBPassword:       getEnv("DB_PASSWORD", "postgres"),
 		DBName:           getEnv("DB_NAME", "connect4"),
 		MatchTimeout:     getEnvInt("MATCH_TIMEOUT", 10),
+		MatchBotFallback: getEnvBool("MATCH_BOT_FALLBACK", true),
 		ReconnectTimeout: getEnvInt("RECONNECT_TIMEOUT", 30),
+		ShutdownGrace:    getEnvInt("SHUTDOWN_GRACE", 30),
+		ClusterBackend:   getEnv("CLUSTER_BACKEND", "memory"),
+		NodeID:           getEnv("NODE_ID", defaultNodeID()),
+		ReconnectSecret:  getEnv("RECONNECT_SECRET", ""),
+		ChatMaxLength:    getEnvInt("CHAT_MAX_LENGTH", 200),
+		ChatRateLimit:    getEnvInt("CHAT_RATE_LIMIT", 5),
+		ChatRateWindow:   getEnvInt("CHAT_RATE_WINDOW", 10),
+		ChatFilter:       getEnvSlice("CHAT_FILTER", nil),
+		ChatHistory:      getEnvInt("CHAT_HISTORY", 50),
+		EmoteCooldown:    getEnvInt("EMOTE_COOLDOWN", 3),
+		SpectatorDelay:   getEnvInt("SPECTATOR_DELAY", 0),
+		ChallengeTimeout: getEnvInt("CHALLENGE_TIMEOUT", 60),
+		MatchWindow:       getEnvInt("MATCH_WINDOW", 100),
+		MatchWindowGrowth: getEnvInt("MATCH_WINDOW_GROWTH", 10),
+
+		Queues: getEnvSlice("QUEUES", []string{"standard"}),
+	}
+}
+
+// defaultNodeID names the instance after its host, which is stable across
+// restarts of the same container
+func defaultNodeID() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
 	}
+	return "node-" + strconv.Itoa(os.Getpid())
 }
 
 func getEnv(key, defaultVal string) string {
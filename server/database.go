@@ -2,11 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Database wraps a SQL database connection
@@ -22,10 +23,7 @@ func NewDatabase(config *Config) *Database {
 		return &Database{enabled: false}
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		config.DBHost, config.DBPort, config.DBUser, config.DBPassword, config.DBName)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", dsn(config))
 	if err != nil {
 		log.Printf("Failed to connect to database: %v. Falling back to file storage.", err)
 		return &Database{enabled: false}
@@ -47,6 +45,12 @@ func NewDatabase(config *Config) *Database {
 	return &Database{db: db, enabled: true}
 }
 
+// dsn builds the Postgres connection string from config
+func dsn(config *Config) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		config.DBHost, config.DBPort, config.DBUser, config.DBPassword, config.DBName)
+}
+
 // initSchema creates the necessary tables if they don't exist
 func initSchema(db *sql.DB) error {
 	schema := `
@@ -61,6 +65,8 @@ func initSchema(db *sql.DB) error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
+	ALTER TABLE games ADD COLUMN IF NOT EXISTS chat JSONB;
+
 	CREATE INDEX IF NOT EXISTS idx_games_player1 ON games(player1);
 	CREATE INDEX IF NOT EXISTS idx_games_player2 ON games(player2);
 	CREATE INDEX IF NOT EXISTS idx_games_winner ON games(winner);
@@ -71,6 +77,19 @@ func initSchema(db *sql.DB) error {
 		wins INT NOT NULL DEFAULT 0,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
+
+	CREATE TABLE IF NOT EXISTS ratings (
+		username VARCHAR(255) PRIMARY KEY,
+		rating INT NOT NULL,
+		games INT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS active_games (
+		id VARCHAR(255) PRIMARY KEY,
+		snapshot JSONB NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
 	`
 
 	_, err := db.Exec(schema)
@@ -84,11 +103,17 @@ func (d *Database) SaveGame(rec GameRecord) error {
 	}
 
 	query := `
-		INSERT INTO games (id, player1, player2, winner, duration_seconds, started_at, ended_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO games (id, player1, player2, winner, duration_seconds, started_at, ended_at, chat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 
-	_, err := d.db.Exec(query, rec.ID, rec.Player1, rec.Player2, rec.Winner, rec.Duration, rec.StartedAt, rec.EndedAt)
+	var chat interface{} // NULL when nobody chatted
+	if len(rec.Chat) > 0 {
+		b, _ := json.Marshal(rec.Chat)
+		chat = string(b)
+	}
+
+	_, err := d.db.Exec(query, rec.ID, rec.Player1, rec.Player2, rec.Winner, rec.Duration, rec.StartedAt, rec.EndedAt, chat)
 	if err != nil {
 		log.Printf("Failed to save game to database: %v", err)
 		return err
@@ -172,6 +197,169 @@ func (d *Database) GetGames() ([]GameRecord, error) {
 	return games, nil
 }
 
+// SaveSession upserts the snapshot of an in-progress game
+func (d *Database) SaveSession(snap SessionSnapshot) error {
+	if !d.enabled {
+		return nil
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO active_games (id, snapshot, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id)
+		DO UPDATE SET snapshot = $2, updated_at = $3
+	`
+
+	_, err = d.db.Exec(query, snap.ID, data, snap.UpdatedAt)
+	if err != nil {
+		log.Printf("Failed to save session to database: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteSession removes the snapshot of a game that is no longer in progress
+func (d *Database) DeleteSession(id string) error {
+	if !d.enabled {
+		return nil
+	}
+
+	_, err := d.db.Exec(`DELETE FROM active_games WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("Failed to delete session from database: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// LoadSessions retrieves all in-progress game snapshots
+func (d *Database) LoadSessions() ([]SessionSnapshot, error) {
+	if !d.enabled {
+		return nil, fmt.Errorf("database not enabled")
+	}
+
+	rows, err := d.db.Query(`SELECT snapshot FROM active_games`)
+	if err != nil {
+		log.Printf("Failed to query sessions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []SessionSnapshot
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			continue
+		}
+		var snap SessionSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, nil
+}
+
+// GetRatings retrieves every player's rating
+func (d *Database) GetRatings() (Ratings, error) {
+	if !d.enabled {
+		return nil, fmt.Errorf("database not enabled")
+	}
+
+	rows, err := d.db.Query(`SELECT username, rating FROM ratings`)
+	if err != nil {
+		log.Printf("Failed to query ratings: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := make(Ratings)
+	for rows.Next() {
+		var username string
+		var rating int
+		if err := rows.Scan(&username, &rating); err != nil {
+			continue
+		}
+		ratings[username] = rating
+	}
+
+	return ratings, nil
+}
+
+// GetRating retrieves one player's rating, defaultRating if they have none
+func (d *Database) GetRating(username string) (int, error) {
+	if !d.enabled {
+		return 0, fmt.Errorf("database not enabled")
+	}
+
+	var rating int
+	err := d.db.QueryRow(`SELECT rating FROM ratings WHERE username = $1`, username).Scan(&rating)
+	if err == sql.ErrNoRows {
+		return defaultRating, nil
+	}
+	if err != nil {
+		log.Printf("Failed to query rating: %v", err)
+		return 0, err
+	}
+	return rating, nil
+}
+
+// UpdateRatings replaces the ratings of two players with what update makes
+// of them, holding both rows locked so concurrent games cannot lose updates
+func (d *Database) UpdateRatings(p1, p2 string, update func(r1, r2 int) (int, int)) (int, int, error) {
+	if !d.enabled {
+		return 0, 0, fmt.Errorf("database not enabled")
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// lock in a fixed order so two games between the same players cannot deadlock
+	current := map[string]int{p1: defaultRating, p2: defaultRating}
+	rows, err := tx.Query(`SELECT username, rating FROM ratings WHERE username = ANY($1) ORDER BY username FOR UPDATE`, pq.Array([]string{p1, p2}))
+	if err != nil {
+		log.Printf("Failed to lock ratings: %v", err)
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var username string
+		var rating int
+		if err := rows.Scan(&username, &rating); err == nil {
+			current[username] = rating
+		}
+	}
+	rows.Close()
+
+	r1, r2 := update(current[p1], current[p2])
+	query := `
+		INSERT INTO ratings (username, rating, games, updated_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (username)
+		DO UPDATE SET rating = $2, games = ratings.games + 1, updated_at = $3
+	`
+	for _, r := range []struct {
+		username string
+		rating   int
+	}{{p1, r1}, {p2, r2}} {
+		if _, err := tx.Exec(query, r.username, r.rating, time.Now()); err != nil {
+			log.Printf("Failed to update rating in database: %v", err)
+			return 0, 0, err
+		}
+	}
+	return r1, r2, tx.Commit()
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
 	if d.enabled && d.db != nil {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Emotes are quick reactions from a fixed list, sent during a game. Unlike
+// chat they need no filtering, but each player has to wait
+// config.EmoteCooldown seconds between two of them.
+
+// emotes is the list of emotes players may send
+var emotes = map[string]bool{
+	"good_game":   true,
+	"good_luck":   true,
+	"nice_move":   true,
+	"oops":        true,
+	"thanks":      true,
+	"well_played": true,
+}
+
+// handleEmote passes an emote to the game it was sent in
+func (n *Node) handleEmote(c *Client, m *EmoteMessage) error {
+	if !emotes[m.Emote] {
+		return c.reject(ErrUnknownEmote, fmt.Sprintf("unknown emote %q", m.Emote))
+	}
+	if m.GameID == "" || m.GameID != c.currentGame() {
+		return c.reject(ErrChatNotAllowed, "you are not in that game")
+	}
+	if sess, ok := n.localGame(m.GameID); ok {
+		sess.emote(c.Username, m.Emote)
+	} else {
+		n.forwardToOwner("emote", c.Username, m.GameID, m)
+	}
+	return nil
+}
+
+// emote shows a player's emote to the players and spectators. The cooldown is
+// kept here rather than on the connection so reconnecting does not reset it.
+func (s *GameSession) emote(username, emote string) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	// a "good game" after the last move is fine, so finished games are
+	// not refused while the session is still around
+	if _, ok := s.Players[username]; !ok {
+		return
+	}
+	peer := s.clients[username]
+	now := time.Now()
+	cooldown := time.Duration(config.EmoteCooldown) * time.Second
+	if last, ok := s.emotedAt[username]; ok && now.Sub(last) < cooldown {
+		if peer != nil {
+			peer.SendJSON(newError(ErrRateLimited, "wait before sending another emote"))
+		}
+		return
+	}
+	if s.emotedAt == nil {
+		s.emotedAt = map[string]time.Time{}
+		s.emotes = map[string]int{}
+	}
+	s.emotedAt[username] = now
+	s.emotes[emote]++
+
+	ev := EmoteEvent{Type: MsgEmote, GameID: s.ID, From: username, Emote: emote}
+	for _, cl := range s.clients {
+		cl.SendJSON(ev)
+	}
+	for _, sp := range s.spectators {
+		sp.SendJSON(ev)
+	}
+	emitEvent(map[string]interface{}{
+		"type":     "emote",
+		"gameId":   s.ID,
+		"username": username,
+		"emote":    emote,
+	})
+}
+
+// emoteCounts returns how often each emote was sent in the game, for
+// analytics. Caller must hold TurnMu.
+func (s *GameSession) emoteCounts() map[string]int {
+	out := map[string]int{}
+	for name, n := range s.emotes {
+		out[name] = n
+	}
+	return out
+}
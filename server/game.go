@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
 	"sync"
@@ -23,28 +25,104 @@ type GameSession struct {
 	StartedAt  time.Time
 	FinishedAt time.Time
 	IsBot      bool
-	clients    map[string]*Client
+	Rated      bool           // whether the result changes the players' ratings
+	Ratings    map[string]int // ratings at the start; the bot's is the strength it plays at
+	NewRatings map[string]int // ratings after a rated game has finished
+	Moves      []int          // columns played, in order
+	MoveIDs    []string       // client move id for each entry in Moves
+	Seq        int            // sequence number of the last update sent to players
+	Chat       []ChatEntry
+	clients    map[string]Peer
+	latency    map[string]time.Duration // last reported round-trip time per player
+	emotedAt   map[string]time.Time     // when each player last sent an emote
+	emotes     map[string]int           // emotes sent in this game, by name
+
+	spectators     map[string]Peer     // username -> spectator connection
+	spectatorDelay time.Duration       // how far spectators lag behind the game
+	noSpectators   bool                // set by rooms that keep their game private
+	frames         []spectatorFrame    // recent frames, when spectators are delayed
+	feed           chan spectatorFrame // delayed frames waiting to be shown
+	node           *Node               // node running this session
+	roomID         string              // room the game was started from, if any
+
+	variant     string          // board the game is played on, or "custom" for a room's own size
+	timeControl string          // empty for an untimed game
+	increment   time.Duration   // added to a player's clock after each of their moves
+	clocks      []time.Duration // time left to each player at the start of the turn
+	turnStart   time.Time       // when the player to move started thinking
+	flagTimer   *time.Timer     // ends the game when the player to move runs out of time
 }
 
 func NewGameSession(p1, p2 string) *GameSession {
 	id := fmt.Sprintf("g_%d", time.Now().UnixNano())
-	rows := 6
-	cols := 7
+	g := newGame(defaultRows, defaultCols)
+	return &GameSession{ID: id, Player1: p1, Player2: p2, Players: map[string]int{p1: 1, p2: 2}, Game: g, State: "playing", StartedAt: time.Now(), clients: map[string]Peer{}, variant: variantStandard}
+}
+
+// The standard board; rooms may choose another size
+const (
+	defaultRows = 6
+	defaultCols = 7
+)
+
+// variantStandard is the classic board, and the variant played by default
+const variantStandard = "standard"
+
+// variants are the boards queues and challenges can be played on
+var variants = map[string]struct{ Rows, Cols int }{
+	variantStandard: {defaultRows, defaultCols},
+	"small":         {5, 6},
+	"large":         {7, 8},
+	"huge":          {8, 10},
+}
+
+// variantOf names the variant played on a board of the given size, or
+// "custom" if none is
+func variantOf(rows, cols int) string {
+	for name, v := range variants {
+		if v.Rows == rows && v.Cols == cols {
+			return name
+		}
+	}
+	return "custom"
+}
+
+// applySettings sets the session up to be played on settings. Call before
+// the game begins.
+func (s *GameSession) applySettings(settings GameSettings) {
+	if v, ok := variants[settings.Variant]; ok {
+		s.Game = newGame(v.Rows, v.Cols)
+		s.variant = settings.Variant
+	}
+	s.setTimeControl(settings.TimeControl)
+	s.Rated = settings.Rated
+}
+
+// newGame returns an empty board of the given size, player 1 to move
+func newGame(rows, cols int) *Game {
 	board := make([][]int, rows)
 	for r := 0; r < rows; r++ {
 		board[r] = make([]int, cols)
 	}
-	g := &Game{Rows: rows, Cols: cols, Board: board, Turn: 1, Started: time.Now()}
-	return &GameSession{ID: id, Player1: p1, Player2: p2, Players: map[string]int{p1: 1, p2: 2}, Game: g, State: "playing", StartedAt: time.Now(), clients: map[string]*Client{}}
+	return &Game{Rows: rows, Cols: cols, Board: board, Turn: 1, Started: time.Now()}
 }
 
 func (s *GameSession) run() {
-	// If bot and bot moves first when it's player 2, process it
-	for s.State == "playing" {
+	for {
+		s.TurnMu.Lock()
+		if s.State != "playing" {
+			s.TurnMu.Unlock()
+			return
+		}
 		// if bot present and it's bot's turn, make a bot move
+		botCol := -1
 		if s.IsBot && s.Game.Turn == s.getBotPlayer() {
-			col := BotNextMove(s.Game, s.getBotPlayer())
-			s.applyMove(col)
+			botCol = BotMoveForRating(s.Game, s.getBotPlayer(), s.Ratings["Bot"])
+		}
+		s.TurnMu.Unlock()
+
+		if botCol >= 0 {
+			s.applyMove(MoveRequest{Username: "Bot", Ply: -1, Col: botCol})
 		} else {
 			// wait for moves via WebSocket (client readPump will call applyMove)
 			time.Sleep(200 * time.Millisecond)
@@ -59,18 +137,139 @@ func (s *GameSession) getBotPlayer() int {
 	return 1
 }
 
-func (s *GameSession) reconnect(username string, client *Client) {
-	s.clients[username] = client
-	client.SendJSON(map[string]interface{}{"type": "reconnected", "gameId": s.ID, "state": s.Game})
+var (
+	errGameOver    = errors.New("game is not in progress")
+	errNotAPlayer  = errors.New("not a player in this game")
+	errBadRecToken = errors.New("invalid reconnect token")
+)
+
+// reconnect gives username their seat back if token matches it. Every
+// attempt is audited; addr is the remote address of the new connection.
+func (s *GameSession) reconnect(username, token, addr string, peer Peer) error {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+
+	var err error
+	if s.State != "playing" {
+		err = errGameOver
+	} else if _, ok := s.Players[username]; !ok || (s.IsBot && username == "Bot") {
+		err = errNotAPlayer
+	} else if !verifyReconnectToken(token, s.ID, username) {
+		err = errBadRecToken
+	}
+
+	entry := map[string]interface{}{
+		"type":     "reconnect",
+		"gameId":   s.ID,
+		"username": username,
+		"addr":     addr,
+		"accepted": err == nil,
+	}
+	if err != nil {
+		entry["reason"] = err.Error()
+		auditEvent(entry)
+		return err
+	}
+	emitAudit(entry)
+
+	s.clients[username] = peer
+	peer.SendJSON(ReconnectedMessage{Type: MsgReconnected, GameID: s.ID, State: s.Game.clone(), Ply: len(s.Moves), Seq: s.Seq, Clocks: s.clocksLeft()})
+	sendHistory(peer, ChatGame, s.ID, s.Chat)
+	return nil
+}
+
+// resync sends username a full snapshot, after their client noticed a gap
+// in the update sequence
+func (s *GameSession) resync(username string) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	if peer, ok := s.clients[username]; ok {
+		peer.SendState(s.snapshotFor(username, s.Game.clone()))
+	}
 }
 
-func (s *GameSession) applyMove(col int) {
+// playerLeft marks username as disconnected, unless they have already
+// reconnected through a different peer, and starts the forfeit timer
+func (s *GameSession) playerLeft(username string, peer Peer) {
 	s.TurnMu.Lock()
 	defer s.TurnMu.Unlock()
+	if s.State != "playing" || s.clients[username] != peer {
+		return
+	}
+	delete(s.clients, username)
+	go s.awaitReconnect(username)
+}
+
+// MoveRequest is a move submitted by a player. Clients tag moves with their
+// own id and the ply they expect it to be, so a move resent after a
+// reconnect is recognised instead of being played twice.
+type MoveRequest struct {
+	Username string
+	MoveID   string // client-chosen id; empty for clients that do not retry
+	Ply      int    // expected index of this move in the game; -1 if not given
+	Col      int
+}
+
+// playerAt returns the player (1 or 2) who makes the move at ply
+func playerAt(ply int) int { return ply%2 + 1 }
+
+// ack tells the mover what happened to their move. Caller must hold TurnMu.
+func (s *GameSession) ack(req MoveRequest, ply int, accepted, duplicate bool, reason string) {
+	peer, ok := s.clients[req.Username]
+	if !ok {
+		return
+	}
+	peer.SendJSON(MoveAckMessage{
+		Type:      MsgMoveAck,
+		GameID:    s.ID,
+		MoveID:    req.MoveID,
+		Ply:       ply,
+		Accepted:  accepted,
+		Duplicate: duplicate,
+		Reason:    reason,
+	})
+}
+
+// applyMove drops a disc for the requesting player if it is their turn and
+// acknowledges the request
+func (s *GameSession) applyMove(req MoveRequest) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	p, isPlayer := s.Players[req.Username]
+	if !isPlayer {
+		return
+	}
+	// a retry of a move that was already played is acknowledged again
+	if req.MoveID != "" {
+		for i, id := range s.MoveIDs {
+			if id == req.MoveID && playerAt(i) == p {
+				s.ack(req, i, true, true, "")
+				return
+			}
+		}
+	}
+	ply := len(s.Moves)
 	if s.State != "playing" {
+		s.ack(req, ply, false, false, "game_over")
 		return
 	}
+	if p != s.Game.Turn {
+		s.ack(req, ply, false, false, "not_your_turn")
+		return
+	}
+	if req.Ply >= 0 && req.Ply != ply {
+		s.ack(req, ply, false, false, "stale_ply")
+		return
+	}
+	if s.outOfTime() {
+		s.ack(req, ply, false, false, "timeout")
+		s.clocks[s.Game.Turn-1] = 0
+		s.loseOnTime()
+		return
+	}
+	col := req.Col
 	if col < 0 || col >= s.Game.Cols {
+		s.ack(req, ply, false, false, "invalid_column")
 		return
 	}
 	// drop
@@ -78,11 +277,15 @@ func (s *GameSession) applyMove(col int) {
 		if s.Game.Board[r][col] == 0 {
 			s.Game.Board[r][col] = s.Game.Turn
 			fmt.Printf("Placed piece at row=%d, col=%d, player=%d\n", r, col, s.Game.Turn)
+			s.Moves = append(s.Moves, col)
+			s.MoveIDs = append(s.MoveIDs, req.MoveID)
+			s.stopClock()
+			s.ack(req, ply, true, false, "")
+			move := &MoveDelta{Col: col, Row: r, Player: s.Game.Turn, Clock: time.Since(s.StartedAt).Milliseconds()}
 			// check win
 			winDetected := checkWin(s.Game.Board, r, col, s.Game.Turn)
 			fmt.Printf("checkWin returned: %v\n", winDetected)
 			if winDetected {
-				// finish
 				winner := ""
 				if s.Game.Turn == 1 {
 					winner = s.Player1
@@ -90,36 +293,7 @@ func (s *GameSession) applyMove(col int) {
 					winner = s.Player2
 				}
 				fmt.Printf("WIN DETECTED! Winner: %s (Player %d)\n", winner, s.Game.Turn)
-				s.State = "finished"
-				s.Result = winner
-				fmt.Printf("Set s.Result to: '%s'\n", s.Result)
-				s.FinishedAt = time.Now()
-				// persist
-				rec := GameRecord{
-					ID:        s.ID,
-					Player1:   s.Player1,
-					Player2:   s.Player2,
-					Winner:    winner,
-					StartedAt: s.StartedAt,
-					EndedAt:   s.FinishedAt,
-					Duration:  int64(s.FinishedAt.Sub(s.StartedAt).Seconds()),
-				}
-
-				// Save to database if enabled, otherwise use file store
-				if database.enabled {
-					database.SaveGame(rec)
-					database.IncrementWinner(winner)
-				} else {
-					store.AppendGame(rec)
-					store.IncrementWinner(winner)
-				}
-
-				// emit event to Kafka and file
-				emitEvent(map[string]interface{}{
-					"type": "game_finished",
-					"game": rec,
-				})
-				broadcastState(s)
+				s.finish(winner, "win", move)
 				return
 			}
 			// check draw: board is full AND no winning condition exists
@@ -128,37 +302,12 @@ func (s *GameSession) applyMove(col int) {
 			fmt.Printf("Draw check: boardFull=%v, hasAnyWin=%v\n", isBoardFull, hasAnyWin)
 			if isBoardFull && !hasAnyWin {
 				fmt.Println("DRAW DETECTED!")
-				s.State = "finished"
-				s.Result = "draw"
-				fmt.Printf("Set s.Result to: '%s'\n", s.Result)
-				s.FinishedAt = time.Now()
-				rec := GameRecord{
-					ID:        s.ID,
-					Player1:   s.Player1,
-					Player2:   s.Player2,
-					Winner:    "draw",
-					StartedAt: s.StartedAt,
-					EndedAt:   s.FinishedAt,
-					Duration:  int64(s.FinishedAt.Sub(s.StartedAt).Seconds()),
-				}
-
-				// Save to database if enabled, otherwise use file store
-				if database.enabled {
-					database.SaveGame(rec)
-				} else {
-					store.AppendGame(rec)
-				}
-
-				// emit event to Kafka and file
-				emitEvent(map[string]interface{}{
-					"type": "game_finished",
-					"game": rec,
-				})
-				broadcastState(s)
+				s.finish("draw", "draw", move)
 				return
 			}
 			// switch turn
 			s.Game.Turn = 3 - s.Game.Turn
+			s.startClock()
 			// broadcast
 			emitEvent(map[string]interface{}{
 				"type":   "move",
@@ -166,21 +315,147 @@ func (s *GameSession) applyMove(col int) {
 				"col":    col,
 				"player": s.Game.Board[r][col],
 			})
-			broadcastState(s)
+			s.broadcast(move)
+			saveSnapshot(s)
 			return
 		}
 	}
+	s.ack(req, ply, false, false, "column_full")
+}
+
+// finish ends the game with the given winner ("draw" for a draw), records
+// the result and notifies the players. move is the move that ended the game,
+// or nil for a forfeit. Caller must hold TurnMu.
+func (s *GameSession) finish(winner, reason string, move *MoveDelta) {
+	s.State = "finished"
+	s.Result = winner
+	s.FinishedAt = time.Now()
+	if s.flagTimer != nil {
+		s.flagTimer.Stop()
+	}
+	rec := GameRecord{
+		ID:        s.ID,
+		Player1:   s.Player1,
+		Player2:   s.Player2,
+		Winner:    winner,
+		StartedAt: s.StartedAt,
+		EndedAt:   s.FinishedAt,
+		Duration:  int64(s.FinishedAt.Sub(s.StartedAt).Seconds()),
+	}
+
+	// the chat is stored with the game for moderation but kept out of
+	// the analytics event below
+	stored := rec
+	stored.Chat = s.Chat
+
+	// Save to database if enabled, otherwise use file store
+	if database.enabled {
+		database.SaveGame(stored)
+		database.IncrementWinner(winner)
+	} else {
+		store.AppendGame(stored)
+		store.IncrementWinner(winner)
+	}
+	if s.Rated && !s.IsBot {
+		s.NewRatings = rateGame(s.Player1, s.Player2, winner)
+	}
+	deleteSnapshot(s.ID)
+	if s.node != nil {
+		s.node.cluster.ReleaseSession(s.ID)
+	}
+
+	// emit event to Kafka and file
+	emitEvent(map[string]interface{}{
+		"type":    "game_finished",
+		"reason":  reason,
+		"game":    rec,
+		"latency": s.latencyMillis(),
+		"emotes":  s.emoteCounts(),
+		"rated":   s.Rated,
+		"ratings": map[string]interface{}{"before": s.Ratings, "after": s.NewRatings},
+	})
+	s.broadcast(move)
+	if s.roomID != "" && s.node != nil {
+		go s.node.finishRoom(s.roomID)
+	}
+}
+
+// awaitReconnect forfeits the game for username if they have not
+// reconnected once the reconnect timeout has passed.
+func (s *GameSession) awaitReconnect(username string) {
+	time.Sleep(time.Duration(config.ReconnectTimeout) * time.Second)
+
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+
+	if s.State != "playing" {
+		return // Game already finished
+	}
+	if _, ok := s.clients[username]; ok {
+		return
+	}
+
+	// Player didn't reconnect, the other player wins
+	log.Printf("Player %s forfeited due to disconnect", username)
+	winner := s.Player1
+	if username == s.Player1 {
+		winner = s.Player2
+	}
+	s.finish(winner, "forfeit", nil)
 }
 
-func broadcastState(s *GameSession) {
-	fmt.Printf("Broadcasting state: status=%s, result=%s\n", s.State, s.Result)
-	for uname, cl := range s.clients {
-		msg := map[string]interface{}{"type": "state", "gameId": s.ID, "state": s.Game, "you": s.Players[uname], "status": s.State, "result": s.Result}
-		fmt.Printf("Sending to %s: %+v\n", uname, msg)
+// snapshotInterval makes every nth update a full snapshot, so a client that
+// missed a delta without noticing still converges
+const snapshotInterval = 16
+
+// broadcast sends the update following move (nil if the game ended without
+// one) to the players under the next sequence number, and the new position
+// to the spectators. Caller must hold TurnMu.
+func (s *GameSession) broadcast(move *MoveDelta) {
+	s.Seq++
+	fmt.Printf("Broadcasting update %d: status=%s, result=%s\n", s.Seq, s.State, s.Result)
+	s.showSpectators()
+	if s.Seq%snapshotInterval == 0 {
+		// frames are written asynchronously, so they get their own copy of the board
+		game := s.Game.clone()
+		for uname, cl := range s.clients {
+			_ = cl.SendState(s.snapshotFor(uname, game))
+		}
+		return
+	}
+	msg := DeltaMessage{
+		Type:    MsgDelta,
+		GameID:  s.ID,
+		Seq:     s.Seq,
+		Ply:     len(s.Moves),
+		Move:    move,
+		Turn:    s.Game.Turn,
+		Status:  s.State,
+		Result:  s.Result,
+		Ratings: s.NewRatings,
+		Clocks:  s.clocksLeft(),
+	}
+	for _, cl := range s.clients {
 		_ = cl.SendJSON(msg)
 	}
 }
 
+// snapshotFor builds the full state message for username
+func (s *GameSession) snapshotFor(username string, game *Game) StateMessage {
+	return StateMessage{
+		Type:    MsgState,
+		GameID:  s.ID,
+		Seq:     s.Seq,
+		State:   game,
+		Ply:     len(s.Moves),
+		You:     s.Players[username],
+		Status:  s.State,
+		Result:  s.Result,
+		Ratings: s.NewRatings,
+		Clocks:  s.clocksLeft(),
+	}
+}
+
 func boardFull(b [][]int) bool {
 	for r := 0; r < len(b); r++ {
 		for c := 0; c < len(b[0]); c++ {
@@ -241,6 +516,13 @@ func checkWin(b [][]int, r, c, p int) bool {
 	return false
 }
 
+// clone copies the game so it can be handed to another goroutine
+func (g *Game) clone() *Game {
+	cp := *g
+	cp.Board = cloneBoard(g.Board)
+	return &cp
+}
+
 // small helper to copy board
 func cloneBoard(b [][]int) [][]int {
 	rows := len(b)
@@ -253,16 +535,48 @@ func cloneBoard(b [][]int) [][]int {
 	return n
 }
 
-// emitEvent writes to disk and sends to Kafka if enabled
-func emitEvent(e map[string]interface{}) {
+// jsonlLog is an append-only JSON lines file in the data dir, kept open for
+// the life of the process
+type jsonlLog struct {
+	name string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+var (
+	eventLog = &jsonlLog{name: "events.jsonl"}
+	auditLog = &jsonlLog{name: "audit.jsonl"}
+)
+
+func (l *jsonlLog) write(e map[string]interface{}) {
 	b, _ := json.Marshal(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		l.f, _ = openAppend(config.DataDir + "/" + l.name)
+	}
+	if l.f != nil {
+		l.f.Write(append(b, '\n'))
+	}
+}
 
-	// append to events file
-	f, _ := openAppend(config.DataDir + "/events.jsonl")
-	if f != nil {
-		defer f.Close()
-		f.Write(append(b, '\n'))
+// close flushes the file to disk and closes it
+func (l *jsonlLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
 	}
+	l.f.Sync()
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// emitEvent writes to disk and sends to Kafka if enabled
+func emitEvent(e map[string]interface{}) {
+	// append to events file
+	eventLog.write(e)
 
 	// Send to Kafka if enabled
 	if kafkaProducer != nil {
@@ -270,6 +584,21 @@ func emitEvent(e map[string]interface{}) {
 	}
 }
 
+// emitAudit appends to the audit log only; audit entries are not analytics
+func emitAudit(e map[string]interface{}) {
+	if _, ok := e["timestamp"]; !ok {
+		e["timestamp"] = time.Now().Format(time.RFC3339)
+	}
+	auditLog.write(e)
+}
+
+// closeEventLog flushes events.jsonl, audit.jsonl and chat.jsonl to disk and closes them
+func closeEventLog() error {
+	auditLog.close()
+	chatLog.close()
+	return eventLog.close()
+}
+
 func openAppend(path string) (*os.File, error) {
 	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// recordingPeer keeps everything a session sends it
+type recordingPeer struct {
+	mu   sync.Mutex
+	msgs []any
+}
+
+func (p *recordingPeer) SendJSON(v any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, v)
+	return nil
+}
+
+func (p *recordingPeer) SendState(v any) error { return p.SendJSON(v) }
+
+func (p *recordingPeer) SendChat(e ChatEvent) error { return p.SendJSON(e) }
+
+// take returns the messages received since the last call
+func (p *recordingPeer) take() []any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msgs := p.msgs
+	p.msgs = nil
+	return msgs
+}
+
+// lastAck returns the last move_ack among msgs
+func lastAck(msgs []any) (MoveAckMessage, bool) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if ack, ok := msgs[i].(MoveAckMessage); ok {
+			return ack, true
+		}
+	}
+	return MoveAckMessage{}, false
+}
+
+// testSession returns a session between alice (player 1) and bob with
+// recording peers
+func testSession() (*GameSession, map[string]*recordingPeer) {
+	s := NewGameSession("alice", "bob")
+	peers := map[string]*recordingPeer{"alice": {}, "bob": {}}
+	for name, p := range peers {
+		s.clients[name] = p
+	}
+	return s, peers
+}
+
+func TestApplyMove(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []MoveRequest // moves played first
+		finished bool          // end the game before the move
+		move     MoveRequest
+		want     *MoveAckMessage // nil when no ack is expected
+		moves    int             // moves in the game afterwards
+	}{
+		{
+			name:  "first move",
+			move:  MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+			want:  &MoveAckMessage{MoveID: "a1", Ply: 0, Accepted: true},
+			moves: 1,
+		},
+		{
+			name:  "no ply given",
+			move:  MoveRequest{Username: "alice", MoveID: "a1", Ply: -1, Col: 3},
+			want:  &MoveAckMessage{MoveID: "a1", Ply: 0, Accepted: true},
+			moves: 1,
+		},
+		{
+			name: "retried move is acknowledged again",
+			before: []MoveRequest{
+				{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+				{Username: "bob", MoveID: "b1", Ply: 1, Col: 4},
+			},
+			move:  MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+			want:  &MoveAckMessage{MoveID: "a1", Ply: 0, Accepted: true, Duplicate: true},
+			moves: 2,
+		},
+		{
+			name:   "retry arriving before the turn comes back",
+			before: []MoveRequest{{Username: "alice", MoveID: "a1", Ply: 0, Col: 3}},
+			move:   MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+			want:   &MoveAckMessage{MoveID: "a1", Ply: 0, Accepted: true, Duplicate: true},
+			moves:  1,
+		},
+		{
+			name:   "same id from the other player is a new move",
+			before: []MoveRequest{{Username: "alice", MoveID: "m1", Ply: 0, Col: 3}},
+			move:   MoveRequest{Username: "bob", MoveID: "m1", Ply: 1, Col: 3},
+			want:   &MoveAckMessage{MoveID: "m1", Ply: 1, Accepted: true},
+			moves:  2,
+		},
+		{
+			name: "stale ply",
+			before: []MoveRequest{
+				{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+				{Username: "bob", MoveID: "b1", Ply: 1, Col: 4},
+			},
+			move:  MoveRequest{Username: "alice", MoveID: "a2", Ply: 0, Col: 2},
+			want:  &MoveAckMessage{MoveID: "a2", Ply: 2, Reason: "stale_ply"},
+			moves: 2,
+		},
+		{
+			name:  "ply from the future",
+			move:  MoveRequest{Username: "alice", MoveID: "a1", Ply: 5, Col: 3},
+			want:  &MoveAckMessage{MoveID: "a1", Ply: 0, Reason: "stale_ply"},
+			moves: 0,
+		},
+		{
+			name:  "not your turn",
+			move:  MoveRequest{Username: "bob", MoveID: "b1", Ply: 0, Col: 3},
+			want:  &MoveAckMessage{MoveID: "b1", Ply: 0, Reason: "not_your_turn"},
+			moves: 0,
+		},
+		{
+			name:  "column off the board",
+			move:  MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: defaultCols},
+			want:  &MoveAckMessage{MoveID: "a1", Ply: 0, Reason: "invalid_column"},
+			moves: 0,
+		},
+		{
+			name: "full column",
+			before: []MoveRequest{
+				{Username: "alice", Ply: -1, Col: 0},
+				{Username: "bob", Ply: -1, Col: 0},
+				{Username: "alice", Ply: -1, Col: 0},
+				{Username: "bob", Ply: -1, Col: 0},
+				{Username: "alice", Ply: -1, Col: 0},
+				{Username: "bob", Ply: -1, Col: 0},
+			},
+			move:  MoveRequest{Username: "alice", MoveID: "a4", Ply: 6, Col: 0},
+			want:  &MoveAckMessage{MoveID: "a4", Ply: 6, Reason: "column_full"},
+			moves: 6,
+		},
+		{
+			name:     "game over",
+			finished: true,
+			move:     MoveRequest{Username: "alice", MoveID: "a1", Ply: 0, Col: 3},
+			want:     &MoveAckMessage{MoveID: "a1", Ply: 0, Reason: "game_over"},
+			moves:    0,
+		},
+		{
+			name:  "not a player",
+			move:  MoveRequest{Username: "mallory", MoveID: "x", Ply: 0, Col: 3},
+			moves: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, peers := testSession()
+			for _, m := range tt.before {
+				s.applyMove(m)
+			}
+			if tt.finished {
+				s.State = "finished"
+			}
+			for _, p := range peers {
+				p.take()
+			}
+
+			s.applyMove(tt.move)
+			if len(s.Moves) != tt.moves {
+				t.Errorf("game has %d moves, want %d", len(s.Moves), tt.moves)
+			}
+			peer, ok := peers[tt.move.Username]
+			if !ok {
+				for name, p := range peers {
+					if _, acked := lastAck(p.take()); acked {
+						t.Errorf("%s got an ack for a move by %s", name, tt.move.Username)
+					}
+				}
+				return
+			}
+			ack, acked := lastAck(peer.take())
+			if !acked {
+				t.Fatalf("no move_ack sent")
+			}
+			want := *tt.want
+			want.Type, want.GameID = MsgMoveAck, s.ID
+			if ack != want {
+				t.Errorf("ack = %+v, want %+v", ack, want)
+			}
+		})
+	}
+}
+
+func TestResyncAfterGap(t *testing.T) {
+	s, peers := testSession()
+	s.applyMove(MoveRequest{Username: "alice", Ply: 0, Col: 3})
+	// bob's first delta is lost on the way
+	peers["bob"].take()
+	s.applyMove(MoveRequest{Username: "bob", Ply: 1, Col: 4})
+	s.applyMove(MoveRequest{Username: "alice", Ply: 2, Col: 3})
+
+	// the next delta bob sees skips a sequence number
+	var next *DeltaMessage
+	for _, m := range peers["bob"].take() {
+		if d, ok := m.(DeltaMessage); ok {
+			next = &d
+			break
+		}
+	}
+	if next == nil || next.Seq != 2 {
+		t.Fatalf("bob's next delta is %+v, want seq 2", next)
+	}
+
+	s.resync("bob")
+	msgs := peers["bob"].take()
+	if len(msgs) != 1 {
+		t.Fatalf("resync sent %d messages, want 1", len(msgs))
+	}
+	state, ok := msgs[0].(StateMessage)
+	if !ok {
+		t.Fatalf("resync sent %T, want a state", msgs[0])
+	}
+	if state.Seq != s.Seq || state.Seq != 3 || state.Ply != 3 || state.You != 2 {
+		t.Errorf("state has seq %d, ply %d, you %d; want seq 3, ply 3, you 2", state.Seq, state.Ply, state.You)
+	}
+	board := state.State.Board
+	if board[defaultRows-1][3] != 1 || board[defaultRows-1][4] != 2 || board[defaultRows-2][3] != 1 {
+		t.Errorf("resynced board is missing moves: %v", board)
+	}
+}
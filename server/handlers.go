@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// errRejected is returned by the message handlers once they have sent the
+// client an error
+var errRejected = errors.New("request rejected")
+
+// dispatch routes a message from a connected client to the lobby, a room or
+// the game it belongs to
+func (n *Node) dispatch(c *Client, env Envelope, msg interface{}) error {
+	switch m := msg.(type) {
+	case *ListRoomsMessage:
+		c.SendJSON(RoomListMessage{Type: MsgRooms, Rooms: n.listRooms()})
+	case *JoinMessage:
+		return n.handleJoin(c, m)
+	case *CreateRoomMessage:
+		return n.handleCreateRoom(c, m)
+	case *JoinRoomMessage:
+		return n.handleJoinRoom(c, m)
+	case *RoomInviteMessage:
+		return n.handleRoomInvite(c, m)
+	case *RoomReadyMessage:
+		return n.handleRoomReady(c, m)
+	case *RoomPlayerMessage:
+		if env.Type == MsgKick {
+			return n.handleKick(c, m)
+		}
+		return n.handleTransfer(c, m)
+	case *RoomSettingsMessage:
+		return n.handleRoomSettings(c, m)
+	case *MoveMessage:
+		// only the game this connection was seated in by the server
+		if m.GameID == "" || m.GameID != c.currentGame() {
+			return nil
+		}
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.applyMove(m.request(c.Username))
+		} else {
+			// it may be owned by another node
+			n.forwardToOwner("move", c.Username, m.GameID, m)
+		}
+	case *ResyncMessage:
+		if m.GameID == "" || m.GameID != c.currentGame() {
+			return nil
+		}
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.resync(c.Username)
+		} else {
+			n.forwardToOwner("resync", c.Username, m.GameID, m)
+		}
+	case *PongMessage:
+		c.pong(m.ID)
+	case *ChatMessage:
+		return n.handleChat(c, m)
+	case *ListGamesMessage:
+		n.handleListGames(c, m)
+	case *ListOnlineMessage:
+		n.handleListOnline(c, m)
+	case *ListQueuesMessage:
+		n.handleListQueues(c, m)
+	case *LeaveQueueMessage:
+		return n.handleLeaveQueue(c)
+	case *ChallengeMessage:
+		return n.handleChallenge(c, m)
+	case *ChallengeReplyMessage:
+		return n.handleChallengeReply(c, env, m)
+	case *SpectateMessage:
+		return n.handleSpectate(c, m)
+	case *StopSpectatingMessage:
+		n.stopSpectating(c)
+	case *EmoteMessage:
+		return n.handleEmote(c, m)
+	case *MuteMessage:
+		if m.Username != "" && m.Username != c.Username {
+			n.chatOf(c.Username).setMuted(m.Username, m.Muted)
+		}
+	case *HelloMessage:
+		return c.reject(ErrBadMessage, "connection is already open as "+c.Username)
+	default:
+		return c.reject(ErrUnknownType, fmt.Sprintf("unknown message type %q", env.Type))
+	}
+	return nil
+}
+
+// reject sends the client an error and returns errRejected
+func (c *Client) reject(code, text string) error {
+	c.SendJSON(newError(code, text))
+	return errRejected
+}
+
+// canStartGame checks that c may queue, take a seat in a room or play a
+// challenge: its user must not be playing, queued or seated in a room
+func (n *Node) canStartGame(c *Client) error {
+	if draining.Load() {
+		return c.reject(ErrShuttingDown, "server is shutting down")
+	}
+	if n.playing(c.Username) {
+		return c.reject(ErrAlreadyPlaying, "finish your current game first")
+	}
+	if n.isQueued(c.Username) {
+		return c.reject(ErrAlreadyQueued, "already in the queue")
+	}
+	if room, ok := n.seatedRoom(c.Username); ok {
+		return c.reject(ErrAlreadyInRoom, "already in room "+room.Name)
+	}
+	return nil
+}
+
+// playing reports whether username is in a game on any node. Connections
+// to other nodes are judged by their published presence, which may be a
+// couple of seconds old.
+func (n *Node) playing(username string) bool {
+	for _, c := range n.clientsOf(username) {
+		if n.inGame(c) {
+			return true
+		}
+	}
+	byNode, err := n.cluster.Presence()
+	if err != nil {
+		return false
+	}
+	for node, users := range byNode {
+		if node == n.cluster.NodeID() {
+			continue
+		}
+		for _, p := range users {
+			if p.Username == username && p.Status == StatusPlaying {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inGame reports whether c is seated in a game that is still being played
+func (n *Node) inGame(c *Client) bool {
+	gameID := c.currentGame()
+	if gameID == "" {
+		return false
+	}
+	if sess, ok := n.localGame(gameID); ok {
+		sess.TurnMu.Lock()
+		defer sess.TurnMu.Unlock()
+		return sess.State == "playing"
+	}
+	_, err := n.cluster.SessionOwner(gameID)
+	return err == nil
+}
+
+// handleJoin resumes a game when GameID is set, otherwise queues the player
+func (n *Node) handleJoin(c *Client, m *JoinMessage) error {
+	if m.GameID != "" {
+		if sess, ok := n.localGame(m.GameID); ok {
+			if err := sess.reconnect(c.Username, m.ReconnectToken, c.addr, c); err != nil {
+				return c.reject(ErrReconnectRejected, "reconnect rejected: "+err.Error())
+			}
+			c.setGame(sess.ID)
+			return nil
+		}
+		// the game may be running on another node, which checks the token
+		// and binds this client to the game on success
+		if owner, err := n.cluster.SessionOwner(m.GameID); err == nil {
+			payload, _ := json.Marshal(rejoinRequest{Token: m.ReconnectToken, Addr: c.addr})
+			n.cluster.Send(owner, ClusterMessage{Kind: "rejoin", Username: c.Username, GameID: m.GameID, Payload: payload})
+			return nil
+		}
+	}
+
+	// otherwise join matchmaking
+	if err := n.canStartGame(c); err != nil {
+		return err
+	}
+	return n.joinQueue(c, m.Queue)
+}
+
+func (n *Node) handleCreateRoom(c *Client, m *CreateRoomMessage) error {
+	if err := n.canStartGame(c); err != nil {
+		return err
+	}
+	room, err := n.createRoom(c.Username, m)
+	if err != nil {
+		return c.reject(ErrInvalidSettings, err.Error())
+	}
+	c.setSeeking(true)
+	c.SendJSON(RoomMessage{Type: MsgRoomCreated, RoomID: room.ID, Room: room.forClient(c.Username)})
+	log.Printf("Player %s created room %s (%s)", c.Username, room.Name, room.ID)
+	return nil
+}
+
+// handleJoinRoom adds the player to a room, whose game starts once both
+// players are ready. A private room can only be found by its invite code.
+func (n *Node) handleJoinRoom(c *Client, m *JoinRoomMessage) error {
+	if err := n.canStartGame(c); err != nil {
+		return err
+	}
+	roomID, code := m.RoomID, normalizeInviteCode(m.InviteCode)
+	if code != "" {
+		invited := n.roomByInvite(code)
+		if invited == nil {
+			return c.reject(ErrRoomNotFound, "invite code is not valid")
+		}
+		roomID = invited.ID
+	}
+	username := c.Username
+	room, err := n.cluster.UpdateRoom(roomID, func(room *Room) error {
+		// the invite may have been revoked since it was looked up
+		if (code != "" && room.InviteCode != code) || (code == "" && room.Private) {
+			return errNotFound
+		}
+		switch room.Status {
+		case RoomWaiting:
+		case RoomReady:
+			return errRoomFull
+		default:
+			return errRoomNotAvailable
+		}
+		if room.Locked && !checkPassword(room.PasswordHash, m.Password) {
+			return errWrongPassword
+		}
+		if room.has(username) {
+			return errRoomNotAvailable
+		}
+		for _, k := range room.Kicked {
+			if k == username {
+				return errKicked
+			}
+		}
+		if room.Player1 == "" {
+			room.Player1 = username
+		} else if room.Player2 == "" {
+			room.Player2 = username
+		} else {
+			return errRoomFull
+		}
+		return room.seated()
+	})
+	if err != nil {
+		return rejectRoom(c, err)
+	}
+
+	c.setSeeking(true)
+	log.Printf("Player %s joined room %s", username, room.ID)
+	c.SendJSON(RoomMessage{Type: MsgRoomJoined, RoomID: room.ID, Room: room.forClient(c.Username)})
+	sendHistory(c, ChatRoom, room.ID, room.Chat)
+	n.pushRoom(room, username)
+	return nil
+}
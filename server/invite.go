@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Every room has an invite code that can be shared as a link to
+// /invite/{code}; private rooms can only be joined with it. A room may also
+// have a password, kept as a salted hash in the room itself.
+
+const inviteCodeLength = 6
+
+// inviteAlphabet leaves out letters and digits that are easily confused
+// when read aloud or copied by hand (0/O, 1/I/L)
+const inviteAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+var (
+	errWrongPassword = errors.New("wrong password")
+	errNotRoomOwner  = errors.New("only the creator of the room can do that")
+)
+
+// newInviteCode returns a code no other room is using
+func (n *Node) newInviteCode() string {
+	for {
+		buf := make([]byte, inviteCodeLength)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("Failed to generate invite code: %v", err)
+		}
+		for i, b := range buf {
+			buf[i] = inviteAlphabet[int(b)%len(inviteAlphabet)]
+		}
+		code := string(buf)
+		if n.roomByInvite(code) == nil {
+			return code
+		}
+	}
+}
+
+// normalizeInviteCode forgives the ways people retype a code: lower case,
+// spaces and dashes
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// roomByInvite returns the room with the given invite code, or nil
+func (n *Node) roomByInvite(code string) *Room {
+	if code == "" {
+		return nil
+	}
+	rooms, err := n.cluster.Rooms()
+	if err != nil {
+		log.Printf("Failed to list rooms: %v", err)
+	}
+	for _, room := range rooms {
+		if room.InviteCode == code {
+			return room
+		}
+	}
+	return nil
+}
+
+// hashPassword returns a salted hash of password to keep in a room
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		log.Fatalf("Failed to generate password salt: %v", err)
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum[:])
+}
+
+// checkPassword reports whether password matches a hash from hashPassword
+func checkPassword(hash, password string) bool {
+	parts := strings.SplitN(hash, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(parts[1])) == 1
+}
+
+// forClient returns the copy of a room to send to username: without the
+// password hash, and without the invite code unless they created it. The
+// chat is left out too; it is replayed once on joining, and would soon make
+// room updates too big to relay between nodes.
+func (r *Room) forClient(username string) *Room {
+	cp := *r
+	cp.PasswordHash = ""
+	cp.Chat = nil
+	if username != r.Creator {
+		cp.InviteCode = ""
+		cp.Kicked = nil
+	}
+	return &cp
+}
+
+// handleRoomInvite replaces or revokes the invite code of c's room
+func (n *Node) handleRoomInvite(c *Client, m *RoomInviteMessage) error {
+	code := ""
+	if !m.Revoke {
+		code = n.newInviteCode()
+	}
+	room, err := n.cluster.UpdateRoom(m.RoomID, func(room *Room) error {
+		if room.Creator != c.Username {
+			return errNotRoomOwner
+		}
+		if !room.open() {
+			return errRoomNotAvailable
+		}
+		room.InviteCode = code
+		return nil
+	})
+	if err != nil {
+		return rejectRoom(c, err)
+	}
+
+	if m.Revoke {
+		log.Printf("Player %s revoked the invite to room %s", c.Username, room.ID)
+	} else {
+		log.Printf("Player %s made a new invite to room %s", c.Username, room.ID)
+	}
+	c.SendJSON(RoomInviteEvent{Type: MsgRoomInvite, RoomID: room.ID, InviteCode: room.InviteCode})
+	return nil
+}
+
+// inviteHandler serves invite links, sending the browser to the client
+// with the code for it to join the room
+func inviteHandler(w http.ResponseWriter, r *http.Request) {
+	code := normalizeInviteCode(strings.TrimPrefix(r.URL.Path, "/invite/"))
+	if code == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/?invite="+url.QueryEscape(code), http.StatusFound)
+}
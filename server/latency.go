@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Round-trip times are measured with the keepalive pings: WebSocket clients
+// answer ping control frames automatically, SSE clients answer a "ping"
+// message with a "pong". Each ping carries a random id so a client cannot
+// answer one it has not received.
+
+// Connection quality thresholds shown to players
+const (
+	goodRTT = 100 * time.Millisecond
+	fairRTT = 250 * time.Millisecond
+)
+
+func quality(rtt time.Duration) string {
+	switch {
+	case rtt < goodRTT:
+		return "good"
+	case rtt < fairRTT:
+		return "fair"
+	}
+	return "poor"
+}
+
+// nextPing returns the payload for a new ping and remembers when it was sent
+func (c *Client) nextPing() []byte {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	c.pingMu.Lock()
+	c.pingID, c.pingAt = id, time.Now()
+	c.pingMu.Unlock()
+	return []byte(id)
+}
+
+// pong records the answer to the ping with the given id. The estimate is
+// smoothed like TCP's, so one slow answer does not flip the indicator.
+func (c *Client) pong(id string) {
+	c.pingMu.Lock()
+	if id == "" || id != c.pingID {
+		c.pingMu.Unlock()
+		return
+	}
+	sample := time.Since(c.pingAt)
+	c.pingID = ""
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (7*c.rtt + sample) / 8
+	}
+	rtt := c.rtt
+	c.pingMu.Unlock()
+
+	if gameID := c.currentGame(); gameID != "" {
+		c.node.reportLatency(c.Username, gameID, rtt)
+	}
+}
+
+// RTT returns the smoothed round-trip time, or 0 before the first pong
+func (c *Client) RTT() time.Duration {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	return c.rtt
+}
+
+// latencyReport is the payload of a "latency" cluster message
+type latencyReport struct {
+	RTT int64 `json:"rtt_ms"`
+}
+
+// reportLatency passes a player's round-trip time to their game
+func (n *Node) reportLatency(username, gameID string, rtt time.Duration) {
+	if sess, ok := n.localGame(gameID); ok {
+		sess.updateLatency(username, rtt)
+		return
+	}
+	n.forwardToOwner("latency", username, gameID, latencyReport{RTT: rtt.Milliseconds()})
+}
+
+// updateLatency stores a player's round-trip time and shows both players'
+// connection quality to everyone in the game
+func (s *GameSession) updateLatency(username string, rtt time.Duration) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	if _, ok := s.Players[username]; !ok || s.State != "playing" {
+		return
+	}
+	if s.latency == nil {
+		s.latency = map[string]time.Duration{}
+	}
+	s.latency[username] = rtt
+
+	msg := LatencyMessage{Type: MsgLatency, GameID: s.ID, Players: map[string]LatencyInfo{}}
+	for name, d := range s.latency {
+		msg.Players[name] = LatencyInfo{RTT: d.Milliseconds(), Quality: quality(d)}
+	}
+	for _, cl := range s.clients {
+		cl.SendJSON(msg)
+	}
+}
+
+// latencyMillis returns each player's last known round-trip time in
+// milliseconds, for analytics. Caller must hold TurnMu.
+func (s *GameSession) latencyMillis() map[string]int64 {
+	out := map[string]int64{}
+	for name, d := range s.latency {
+		out[name] = d.Milliseconds()
+	}
+	return out
+}
+
+// handleLatency processes a "latency" message forwarded by another node
+func (n *Node) handleLatency(m ClusterMessage) {
+	sess, ok := n.localGame(m.GameID)
+	if !ok {
+		return
+	}
+	var r latencyReport
+	if err := json.Unmarshal(m.Payload, &r); err != nil {
+		return
+	}
+	sess.updateLatency(m.Username, time.Duration(r.RTT)*time.Millisecond)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The live games directory lists the games being played on every node. Each
+// node publishes a summary of its own sessions to the cluster every
+// liveInterval, and pushes the combined list to lobby clients that asked to
+// follow it whenever it changes.
+
+const (
+	liveInterval     = 2 * time.Second
+	defaultLiveLimit = 50
+	maxLiveLimit     = 200
+)
+
+// LiveFilter selects and orders live games. The zero value lists every game,
+// most watched first.
+type LiveFilter struct {
+	Player   string `json:"player,omitempty"`   // part of either player's name
+	Variant  string `json:"variant,omitempty"`  // only games of this variant ("custom" for a room's own board size)
+	Bots     *bool  `json:"bots,omitempty"`     // false hides games against the bot
+	MinMoves int    `json:"minMoves,omitempty"` // only games with at least this many moves
+	Sort     string `json:"sort,omitempty"`     // spectators (default), moves, newest or rating
+	Limit    int    `json:"limit,omitempty"`    // at most this many games (default 50, max 200)
+}
+
+// liveSummary describes the session for the directory. Caller must hold TurnMu.
+func (s *GameSession) liveSummary() LiveGame {
+	return LiveGame{
+		ID:         s.ID,
+		Player1:    s.Player1,
+		Player2:    s.Player2,
+		Ratings:    s.Ratings,
+		Moves:      len(s.Moves),
+		Variant:    s.variant,
+		Spectators: len(s.spectators),
+		IsBot:      s.IsBot,
+		StartedAt:  s.StartedAt,
+
+		Rows:        s.Game.Rows,
+		Cols:        s.Game.Cols,
+		TimeControl: s.timeControl,
+	}
+}
+
+// localLiveGames summarises the games in progress on this node, leaving
+// out those closed to spectators
+func (n *Node) localLiveGames() []LiveGame {
+	n.gamesMu.Lock()
+	sessions := make([]*GameSession, 0, len(n.games))
+	for _, s := range n.games {
+		sessions = append(sessions, s)
+	}
+	n.gamesMu.Unlock()
+
+	list := []LiveGame{}
+	for _, s := range sessions {
+		s.TurnMu.Lock()
+		if s.State == "playing" && !s.noSpectators {
+			list = append(list, s.liveSummary())
+		}
+		s.TurnMu.Unlock()
+	}
+	return list
+}
+
+// liveGames returns the games in progress across the cluster, with this
+// node's own games taken fresh rather than from its last publication
+func (n *Node) liveGames() []LiveGame {
+	list := n.localLiveGames()
+	byNode, err := n.cluster.LiveGames()
+	if err != nil {
+		log.Printf("Failed to list live games: %v", err)
+	}
+	for node, games := range byNode {
+		if node != n.cluster.NodeID() {
+			list = append(list, games...)
+		}
+	}
+	return list
+}
+
+// apply filters and sorts list in place
+func (f LiveFilter) apply(list []LiveGame) []LiveGame {
+	player := strings.ToLower(f.Player)
+	out := list[:0]
+	for _, g := range list {
+		if player != "" && !strings.Contains(strings.ToLower(g.Player1), player) &&
+			!strings.Contains(strings.ToLower(g.Player2), player) {
+			continue
+		}
+		if f.Variant != "" && g.Variant != f.Variant {
+			continue
+		}
+		if f.Bots != nil && !*f.Bots && g.IsBot {
+			continue
+		}
+		if g.Moves < f.MinMoves {
+			continue
+		}
+		out = append(out, g)
+	}
+
+	var less func(a, b LiveGame) bool
+	switch f.Sort {
+	case "moves":
+		less = func(a, b LiveGame) bool { return a.Moves > b.Moves }
+	case "newest":
+		less = func(a, b LiveGame) bool { return a.StartedAt.After(b.StartedAt) }
+	case "rating":
+		less = func(a, b LiveGame) bool { return a.averageRating() > b.averageRating() }
+	default:
+		less = func(a, b LiveGame) bool { return a.Spectators > b.Spectators }
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if less(out[i], out[j]) {
+			return true
+		}
+		if less(out[j], out[i]) {
+			return false
+		}
+		return out[i].ID < out[j].ID
+	})
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultLiveLimit
+	} else if limit > maxLiveLimit {
+		limit = maxLiveLimit
+	}
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (g LiveGame) averageRating() int {
+	if len(g.Ratings) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, r := range g.Ratings {
+		sum += r
+	}
+	return sum / len(g.Ratings)
+}
+
+// liveGamesHandler serves GET /games/live?player=&variant=&bots=&min_moves=&sort=&limit=
+func (n *Node) liveGamesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := LiveFilter{
+		Player:  q.Get("player"),
+		Variant: q.Get("variant"),
+		Sort:    q.Get("sort"),
+	}
+	if v, err := strconv.ParseBool(q.Get("bots")); err == nil {
+		f.Bots = &v
+	}
+	f.MinMoves, _ = strconv.Atoi(q.Get("min_moves"))
+	f.Limit, _ = strconv.Atoi(q.Get("limit"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.apply(n.liveGames()))
+}
+
+// handleListGames answers a list_games message and starts or stops
+// following the directory
+func (n *Node) handleListGames(c *Client, m *ListGamesMessage) {
+	f := m.filter()
+	c.liveMu.Lock()
+	if m.Subscribe {
+		c.live = &f
+	} else {
+		c.live = nil
+	}
+	c.liveMu.Unlock()
+	c.SendJSON(LiveGamesMessage{Type: MsgLiveGames, Games: f.apply(n.liveGames())})
+}
+
+// liveLoop publishes this node's games and pushes changes in the directory
+// to the clients following it
+func (n *Node) liveLoop() {
+	var last []byte
+	for range time.NewTicker(liveInterval).C {
+		if err := n.cluster.PublishLiveGames(n.localLiveGames()); err != nil {
+			log.Printf("Failed to publish live games: %v", err)
+		}
+		list := n.liveGames()
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		data, _ := json.Marshal(list)
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		for _, c := range n.allClients() {
+			c.liveMu.Lock()
+			f := c.live
+			c.liveMu.Unlock()
+			if f != nil {
+				games := f.apply(append([]LiveGame(nil), list...))
+				c.SendJSON(LiveGamesMessage{Type: MsgLiveGames, Games: games})
+			}
+		}
+	}
+}
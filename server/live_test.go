@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestLiveSummaryShowsTheBoard(t *testing.T) {
+	queued, _ := testSession()
+	queued.applySettings(GameSettings{Variant: "large", TimeControl: "5+0"})
+	room, _ := testSession()
+	room.Game = newGame(4, 9)
+	room.variant = variantOf(4, 9)
+	plain, _ := testSession()
+
+	tests := []struct {
+		s          *GameSession
+		variant    string
+		rows, cols int
+		tc         string
+	}{
+		{plain, variantStandard, defaultRows, defaultCols, ""},
+		{queued, "large", 7, 8, "5+0"},
+		{room, "custom", 4, 9, ""},
+	}
+	for _, tt := range tests {
+		g := tt.s.liveSummary()
+		if g.Variant != tt.variant || g.Rows != tt.rows || g.Cols != tt.cols || g.TimeControl != tt.tc {
+			t.Errorf("summary is %s %dx%d %q, want %s %dx%d %q", g.Variant, g.Rows, g.Cols, g.TimeControl, tt.variant, tt.rows, tt.cols, tt.tc)
+		}
+	}
+
+	list := []LiveGame{plain.liveSummary(), queued.liveSummary(), room.liveSummary()}
+	if got := (LiveFilter{Variant: "large"}).apply(list); len(got) != 1 || got[0].ID != queued.ID {
+		t.Errorf("filtering on large gave %+v", got)
+	}
+}
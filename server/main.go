@@ -1,37 +1,91 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-
 // Global configuration and services
 var (
 	config        *Config
 	kafkaProducer *KafkaProducer
 	database      *Database
+	store         *FileStore
 )
 
-// in-memory state
-var (
+// Node is one server instance. It holds the connections and game sessions
+// living in this process; state shared with other instances (queue, rooms,
+// session and user locations) goes through the cluster.
+type Node struct {
+	cluster Cluster
+
 	gamesMu sync.Mutex
-	games   = map[string]*GameSession{} // gameId -> session
-	waitMu  sync.Mutex
-	waiting = []string{}           // usernames waiting
-	clients = map[string]*Client{} // username -> client
-	store   *FileStore
-	roomsMu sync.Mutex
-	rooms   = map[string]*Room{} // roomId -> room
-)
+	games   map[string]*GameSession // gameId -> session owned by this node
+
+	clientsMu sync.Mutex
+	clients   map[string][]*Client // username -> connections to this node, oldest first
+
+	sseStreams sseStreams // open SSE connections by stream id
+
+	lobbyMu sync.Mutex
+	lobby   []ChatEntry // recent lobby chat seen by this node
+
+	chatMu    sync.Mutex
+	chatUsers map[string]*chatLimiter // chat rate limit and mutes by username, shared by their connections
+
+	challengesMu sync.Mutex
+	challenges   map[string]*Challenge // sent by or to users on this node
+
+	matchWait   time.Duration         // time a queued player waits for an opponent
+	botFallback bool                  // whether players who wait that long get a bot game
+	queues      []QueueInfo           // matchmaking queues from config, the default first
+	waits       map[string]*waitStats // recent time to match per queue, for estimated waits
+}
+
+func NewNode(cluster Cluster) *Node {
+	n := &Node{
+		cluster:     cluster,
+		games:       map[string]*GameSession{},
+		clients:     map[string][]*Client{},
+		challenges:  map[string]*Challenge{},
+		chatUsers:   map[string]*chatLimiter{},
+		matchWait:   time.Duration(config.MatchTimeout) * time.Second,
+		botFallback: config.MatchBotFallback,
+		waits:       map[string]*waitStats{},
+	}
+	n.queues = parseQueues(config.Queues)
+	for _, q := range n.queues {
+		n.waits[q.Name] = &waitStats{}
+	}
+	cluster.Receive(n.handleCluster)
+	return n
+}
+
+// routes registers the node's HTTP handlers on mux
+func (n *Node) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/ws", n.wsHandler)
+	mux.HandleFunc("/leaderboard", leaderboardHandler)
+	mux.HandleFunc("/ratings", ratingsHandler)
+	mux.HandleFunc("/rooms", n.roomsHandler)
+	mux.HandleFunc("/rooms/", n.roomHandler)
+	mux.HandleFunc("/invite/", inviteHandler)
+	mux.HandleFunc("/games/live", n.liveGamesHandler)
+	mux.HandleFunc("/users/online", n.onlineHandler)
+	mux.HandleFunc("/queues", n.queuesHandler)
+	mux.HandleFunc("/protocol/schema.json", schemaHandler)
+	mux.HandleFunc("/sse", n.sseHandler)
+	mux.HandleFunc("/sse/send", n.sseSendHandler)
+}
 
 func main() {
 	// Load configuration
@@ -45,32 +99,64 @@ func main() {
 
 	// Initialize Kafka producer
 	kafkaProducer = NewKafkaProducer(config)
-	defer kafkaProducer.Close()
 
 	// Initialize database
 	database = NewDatabase(config)
-	defer database.Close()
 
 	// Initialize file store (fallback or primary storage)
 	store = NewFileStore(
 		config.DataDir+"/games.json",
 		config.DataDir+"/leaderboard.json",
+		config.DataDir+"/sessions",
 	)
 
-	// Setup HTTP handlers
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
+	loadTokenKey(config)
+	loadChatFilter(config)
+	node := NewNode(newCluster(config))
 
-	http.HandleFunc("/ws", wsHandler)
-	http.HandleFunc("/leaderboard", leaderboardHandler)
-	http.HandleFunc("/rooms", roomsHandler)
+	// Pick up games that were in progress when the server last stopped
+	node.restoreSessions()
+
+	// Setup HTTP handlers
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("./static")))
+	node.routes(mux)
 
 	addr := ":" + config.ServerPort
-	log.Printf("Server starting on %s", addr)
-	go reaper()
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Server starting on %s (node %s)", addr, config.NodeID)
+	go node.reaper()
+	go node.liveLoop()
+	go node.presenceLoop()
+	go node.queuesLoop()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	node.shutdown(srv)
+}
+
+// newCluster picks the cluster backend. Sharing state between instances
+// needs Postgres; otherwise the node keeps everything in memory.
+func newCluster(config *Config) Cluster {
+	if config.ClusterBackend == "postgres" {
+		if !database.enabled {
+			log.Println("CLUSTER_BACKEND=postgres requires DB_ENABLED, running as a single instance")
+		} else if pc, err := NewPostgresCluster(config, database.db, config.NodeID); err != nil {
+			log.Printf("Failed to join cluster: %v. Running as a single instance.", err)
+		} else {
+			log.Printf("Joined cluster as node %s", config.NodeID)
+			return pc
+		}
 	}
+	return NewMemoryBackend().Join(config.NodeID)
 }
 
 func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -91,15 +177,28 @@ func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(lb)
 }
 
-func roomsHandler(w http.ResponseWriter, r *http.Request) {
-	roomsMu.Lock()
-	defer roomsMu.Unlock()
+// roomsHandler serves GET /rooms, and POST /rooms to create one
+func (n *Node) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		n.createRoomHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.listRooms())
+}
+
+// listRooms returns the public rooms waiting for players
+func (n *Node) listRooms() []RoomInfo {
+	rooms, err := n.cluster.Rooms()
+	if err != nil {
+		log.Printf("Failed to list rooms: %v", err)
+	}
 
 	// Build list of available rooms
 	roomList := []RoomInfo{}
 	for _, room := range rooms {
 		// Only show rooms that are waiting for players
-		if room.Status == "waiting" {
+		if room.Status == RoomWaiting && !room.Private {
 			playerCount := 0
 			if room.Player1 != "" {
 				playerCount++
@@ -114,309 +213,344 @@ func roomsHandler(w http.ResponseWriter, r *http.Request) {
 				Players:    playerCount,
 				MaxPlayers: 2,
 				Status:     room.Status,
+				Locked:     room.Locked,
 			})
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(roomList)
+	return roomList
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
+var (
+	errRoomNotAvailable = errors.New("room is not available")
+	errRoomFull         = errors.New("room is full")
+)
+
+func (n *Node) wsHandler(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("upgrade:", err)
 		return
 	}
-	defer c.Close()
+	codec := codecFor(c.Subprotocol())
+	t := &wsTransport{conn: c, frameType: codec.FrameType()}
 
-	// expect first message to be join, create_room, or join_room
-	var msg map[string]interface{}
+	// expect first message to be hello, or join, create_room, or join_room
+	// from older clients
 	c.SetReadDeadline(time.Now().Add(30 * time.Second))
-	if err := c.ReadJSON(&msg); err != nil {
+	_, data, err := c.ReadMessage()
+	if err != nil {
 		log.Println("read join err:", err)
+		c.Close()
 		return
 	}
-
-	type JoinMsg struct {
-		Type     string `json:"type"`
-		Username string `json:"username"`
-		GameID   string `json:"gameId,omitempty"`
-		RoomID   string `json:"roomId,omitempty"`
-		RoomName string `json:"roomName,omitempty"`
-	}
-
-	msgType, _ := msg["type"].(string)
-	if msgType != "join" && msgType != "create_room" && msgType != "join_room" {
-		c.WriteJSON(map[string]string{"error": "first message must be join, create_room, or join_room"})
+	env, first, err := decodeMessage(codec, data)
+	if err != nil {
+		writeFrame(t, codec, newError(ErrBadMessage, "malformed message: "+err.Error()))
+		c.Close()
 		return
 	}
 
-	join := JoinMsg{}
-	b, _ := json.Marshal(msg)
-	json.Unmarshal(b, &join)
-	username := join.Username
-
-	client := &Client{Username: username, Conn: c}
-	clients[username] = client
-	defer func() { delete(clients, username) }()
-
-	// Handle different message types
-	switch msgType {
-	case "create_room":
-		// Create a new room
-		room := createRoom(username, join.RoomName)
-		c.WriteJSON(map[string]interface{}{
-			"type":   "room_created",
-			"roomId": room.ID,
-			"room":   room,
-		})
-		log.Printf("Player %s created room %s (%s)", username, room.Name, room.ID)
-		client.readPump(nil)
+	client := n.open(t, codec, r.RemoteAddr, env, first)
+	if client == nil {
 		return
+	}
+	defer n.release(client)
+	client.readPump(c)
+}
 
-	case "join_room":
-		// Join an existing room
-		roomsMu.Lock()
-		room, ok := rooms[join.RoomID]
-		roomsMu.Unlock()
-
-		if !ok {
-			c.WriteJSON(map[string]string{"error": "room not found"})
-			return
-		}
-
-		if room.Status != "waiting" {
-			c.WriteJSON(map[string]string{"error": "room is not available"})
-			return
-		}
+// open identifies the user of a new connection from its first message and
+// returns their client, or nil after sending the refusal and closing t.
+// Callers must release the client once the connection ends.
+func (n *Node) open(t Transport, codec Codec, addr string, env Envelope, first interface{}) *Client {
+	// reject closes the connection after sending an error
+	reject := func(code, text string) *Client {
+		t.SetWriteDeadline(time.Now().Add(writeWait))
+		writeFrame(t, codec, newError(code, text))
+		t.Close()
+		return nil
+	}
 
-		// Add player to room
-		roomsMu.Lock()
-		if room.Player1 == "" {
-			room.Player1 = username
-		} else if room.Player2 == "" {
-			room.Player2 = username
-		} else {
-			roomsMu.Unlock()
-			c.WriteJSON(map[string]string{"error": "room is full"})
-			return
-		}
+	version, ok := negotiateVersion(env.V)
+	if !ok {
+		return reject(ErrUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported (server speaks %d to %d)", env.V, MinProtocolVersion, ProtocolVersion))
+	}
 
-		// If room now has 2 players, start the game
-		if room.Player1 != "" && room.Player2 != "" {
-			room.Status = "playing"
-			p1 := room.Player1
-			p2 := room.Player2
-			roomsMu.Unlock()
+	var username, token string
+	reconnect, trusted := false, false
+	switch m := first.(type) {
+	case *HelloMessage:
+		username, token = m.Username, m.Token
+	case *JoinMessage:
+		username = m.Username
+		reconnect = m.GameID != ""
+		// a player resuming a game proves who they are with its token
+		trusted = reconnect && verifyReconnectToken(m.ReconnectToken, m.GameID, m.Username)
+	case *CreateRoomMessage:
+		username = m.Username
+	case *JoinRoomMessage:
+		username = m.Username
+	default:
+		return reject(ErrInvalidFirst, "first message must be hello, join, create_room, or join_room")
+	}
+	if username == "" {
+		return reject(ErrBadMessage, "username is required")
+	}
 
-			log.Printf("Room %s is full, starting game: %s vs %s", room.ID, p1, p2)
-			go startGameFromRoom(room.ID, p1, p2)
-		} else {
-			roomsMu.Unlock()
-			c.WriteJSON(map[string]interface{}{
-				"type":   "room_joined",
-				"roomId": room.ID,
-				"room":   room,
-			})
-		}
+	// While draining only reconnects to existing games are allowed
+	if _, hello := first.(*HelloMessage); draining.Load() && !hello && !reconnect {
+		return reject(ErrShuttingDown, "server is shutting down")
+	}
 
-		client.readPump(nil)
-		return
+	// A name in use elsewhere can only be shared by presenting its token
+	_, err := n.cluster.UserNode(username)
+	connected := err == nil
+	if connected && !trusted && !n.verifySessionToken(token, username) {
+		return reject(ErrUsernameTaken, "username "+username+" is already connected")
+	}
 
-	case "join":
-		// if GameID provided, try to reconnect
-		if join.GameID != "" {
-			gamesMu.Lock()
-			sess, ok := games[join.GameID]
-			gamesMu.Unlock()
-			if ok {
-				sess.reconnect(username, client)
-				// keep reading messages
-				client.readPump(sess)
-				return
-			}
+	client := NewClient(username, t, codec)
+	client.node = n
+	client.version = version
+	client.addr = addr
+	n.addClient(client)
+	client.SendJSON(WelcomeMessage{Type: MsgWelcome, V: version, Username: username, Token: n.sessionToken(username, !connected), Rating: lookupRating(username)})
+
+	// Older clients name their one action in the first message and the
+	// connection is closed if it fails
+	if _, hello := first.(*HelloMessage); !hello {
+		if err := n.dispatch(client, env, first); err != nil {
+			n.release(client)
+			return nil
 		}
+		return client
+	}
+	sendHistory(client, ChatLobby, "", n.lobbyHistory())
+	return client
+}
 
-		// otherwise join matchmaking
-		enqueueWaiting(username)
-		// notify client that they're waiting (always 15 seconds)
-		c.WriteJSON(map[string]interface{}{"type": "waiting", "timeout": 15})
-
-		// keep reading messages until connection closed
-		client.readPump(nil)
+// release unregisters a client whose connection has ended and stops it
+// once its queued messages are written
+func (n *Node) release(c *Client) {
+	n.removeClient(c)
+	n.dropQueued(c)
+	n.dropChallenges(c.Username)
+	n.leaveRooms(c.Username)
+	if len(n.clientsOf(c.Username)) == 0 {
+		n.chatLeft(c.Username)
 	}
+	c.Close()
 }
 
-// reaper cleans up timed-out games and old rooms
-func reaper() {
+// reaper cleans up timed-out games, old rooms and the chat limits of
+// users who have left
+func (n *Node) reaper() {
 	for range time.NewTicker(5 * time.Second).C {
-		gamesMu.Lock()
-		for id, g := range games {
+		n.gamesMu.Lock()
+		for id, g := range n.games {
 			if g.State == "finished" {
 				// remove after some time
 				if time.Since(g.FinishedAt) > 10*time.Minute {
-					delete(games, id)
-				}
-			}
-		}
-		gamesMu.Unlock()
-
-		// Clean up old rooms
-		roomsMu.Lock()
-		for id, room := range rooms {
-			// Remove rooms that have been waiting for more than 10 minutes
-			if room.Status == "waiting" && time.Since(room.CreatedAt) > 10*time.Minute {
-				log.Printf("Removing stale room %s (%s)", room.Name, room.ID)
-				delete(rooms, id)
-			}
-			// Remove finished rooms after 5 minutes
-			if room.Status == "finished" {
-				// Check if associated game is also cleaned up
-				gamesMu.Lock()
-				if _, exists := games[room.GameID]; !exists {
-					delete(rooms, id)
+					delete(n.games, id)
 				}
-				gamesMu.Unlock()
 			}
 		}
-		roomsMu.Unlock()
+		n.gamesMu.Unlock()
+		n.reapRooms()
+		n.reapChat()
 	}
 }
 
-func enqueueWaiting(username string) {
-	waitMu.Lock()
-	waiting = append(waiting, username)
-	waitMu.Unlock()
-
-	log.Printf("Player %s joined matchmaking queue, waiting 15 seconds...", username)
-
-	// Always wait 15 seconds before starting a game
-	// This ensures players have enough time to find human opponents
-	go func() {
-		// Wait for exactly 15 seconds
-		time.Sleep(15 * time.Second)
-
-		// After 15 seconds, check if another player is available
-		waitMu.Lock()
-		defer waitMu.Unlock()
-
-		// Find this player in the waiting queue
-		playerIndex := -1
-		for i, name := range waiting {
-			if name == username {
-				playerIndex = i
-				break
+// reapRooms closes rooms left waiting too long and removes those that are
+// closed or whose game is over
+func (n *Node) reapRooms() {
+	rooms, _ := n.cluster.Rooms()
+	for _, room := range rooms {
+		// Close rooms that have been waiting for more than 10 minutes
+		if room.open() && time.Since(room.CreatedAt) > 10*time.Minute {
+			if _, err := n.closeRoom(room.ID, "expired", nil); err == nil {
+				log.Printf("Closed stale room %s (%s)", room.Name, room.ID)
 			}
 		}
-
-		// If player is no longer in queue (already matched), return
-		if playerIndex == -1 {
-			log.Printf("Player %s already matched, skipping", username)
-			return
+		// Remove closed rooms another node failed to delete
+		if room.Status == RoomClosed {
+			n.cluster.DeleteRoom(room.ID)
 		}
-
-		// Check if there's another player waiting
-		if len(waiting) >= 2 {
-			// Match with another player
-			p1 := waiting[0]
-			p2 := waiting[1]
-			waiting = waiting[2:]
-			log.Printf("Matching %s with %s after 15 second wait", p1, p2)
-			go startGame(p1, p2)
-		} else {
-			// No other player available, start game with bot
-			waiting = waiting[1:]
-			log.Printf("No opponent found for %s after 15 seconds, starting bot game", username)
-			go startGameWithBot(username)
+		// Remove finished rooms once the associated game is gone everywhere
+		if room.Status == RoomFinished {
+			if _, err := n.cluster.SessionOwner(room.GameID); err == errNotFound {
+				n.cluster.DeleteRoom(room.ID)
+			}
 		}
-	}()
+	}
 }
 
-func startGame(p1, p2 string) {
-	log.Printf("Starting game: %s vs %s", p1, p2)
+// newSession creates a session owned by this node and registers it
+func (n *Node) newSession(p1, p2 string) *GameSession {
 	g := NewGameSession(p1, p2)
-	gamesMu.Lock()
-	games[g.ID] = g
-	gamesMu.Unlock()
-	// register connected clients in the session and send initial state
-	if c1, ok := clients[p1]; ok {
-		g.clients[p1] = c1
-		c1.SendJSON(map[string]interface{}{"type": "start", "gameId": g.ID, "you": 1, "opponent": p2, "state": g.Game})
-	}
-	if c2, ok := clients[p2]; ok {
-		g.clients[p2] = c2
-		c2.SendJSON(map[string]interface{}{"type": "start", "gameId": g.ID, "you": 2, "opponent": p1, "state": g.Game})
+	g.node = n
+	g.spectatorDelay = time.Duration(config.SpectatorDelay) * time.Second
+	g.Ratings = map[string]int{}
+	for _, p := range []string{p1, p2} {
+		if p != "Bot" {
+			g.Ratings[p] = lookupRating(p)
+		}
+	}
+	if err := n.cluster.ClaimSession(g.ID); err != nil {
+		log.Printf("Failed to claim game %s: %v", g.ID, err)
+	}
+	n.gamesMu.Lock()
+	n.games[g.ID] = g
+	n.gamesMu.Unlock()
+	return g
+}
+
+// begin registers the players' connections with the session, sends each the
+// start message and starts the game loop
+func (n *Node) begin(g *GameSession) {
+	g.TurnMu.Lock()
+	g.startClock()
+	for _, p := range []string{g.Player1, g.Player2} {
+		if g.IsBot && p == "Bot" {
+			continue
+		}
+		peer := n.peerFor(p, g.ID)
+		if peer == nil {
+			// gone before the game started: forfeit unless they come back
+			go g.awaitReconnect(p)
+			continue
+		}
+		opponent := g.Player2
+		if p == g.Player2 {
+			opponent = g.Player1
+		}
+		g.clients[p] = peer
+		peer.SendJSON(StartMessage{
+			Type:           MsgStart,
+			GameID:         g.ID,
+			You:            g.Players[p],
+			Opponent:       opponent,
+			State:          g.Game.clone(),
+			Seq:            g.Seq,
+			ReconnectToken: issueReconnectToken(g.ID, p),
+			Rated:          g.Rated,
+			Ratings:        g.Ratings,
+			Variant:        g.variant,
+			TimeControl:    g.timeControl,
+			Clocks:         g.clocksLeft(),
+		})
 	}
+	saveSnapshot(g)
+	g.TurnMu.Unlock()
 	// start goroutine to process game moves
 	go g.run()
 }
 
-func startGameWithBot(player string) {
+// startGame starts a game between two people, p1 moving first
+func (n *Node) startGame(p1, p2 string, settings GameSettings) {
+	log.Printf("Starting %s game: %s vs %s", settings.Variant, p1, p2)
+	g := n.newSession(p1, p2)
+	g.applySettings(settings)
+	n.begin(g)
+}
+
+// startGameWithBot starts an unrated game on settings against a bot
+// playing at the given rating
+func (n *Node) startGameWithBot(player string, rating int, settings GameSettings) {
 	botName := "Bot"
-	log.Printf("Starting game: %s vs BOT", player)
-	g := NewGameSession(player, botName)
+	log.Printf("Starting %s game: %s vs BOT (%d)", settings.Variant, player, rating)
+	g := n.newSession(player, botName)
+	settings.Rated = false
+	g.applySettings(settings)
 	g.IsBot = true
-	gamesMu.Lock()
-	games[g.ID] = g
-	gamesMu.Unlock()
-	// register player client and send initial state
-	if c1, ok := clients[player]; ok {
-		g.clients[player] = c1
-		c1.SendJSON(map[string]interface{}{"type": "start", "gameId": g.ID, "you": 1, "opponent": botName, "state": g.Game})
-	}
-	go g.run()
+	g.Ratings[botName] = rating
+	n.begin(g)
 }
 
-// createRoom creates a new game room
-func createRoom(creator, roomName string) *Room {
-	roomsMu.Lock()
-	defer roomsMu.Unlock()
-
+// createRoom creates a new game room as asked for by m. A room against the
+// bot starts its game straight away.
+func (n *Node) createRoom(creator string, m *CreateRoomMessage) (*Room, error) {
+	settings := m.settings()
+	if err := validRoomSettings(&settings); err != nil {
+		return nil, err
+	}
+	roomName, spectatorDelay := m.RoomName, m.SpectatorDelay
 	if roomName == "" {
 		roomName = creator + "'s room"
 	}
+	if max := int(maxSpectatorDelay / time.Second); spectatorDelay > max {
+		spectatorDelay = max
+	} else if spectatorDelay < 0 {
+		spectatorDelay = 0
+	}
 
 	room := &Room{
 		ID:        fmt.Sprintf("r_%d", time.Now().UnixNano()),
 		Name:      roomName,
 		Creator:   creator,
 		Player1:   creator,
-		Status:    "waiting",
+		Status:    RoomWaiting,
 		CreatedAt: time.Now(),
+
+		SpectatorDelay: spectatorDelay,
+
+		Private:    m.Private,
+		InviteCode: n.newInviteCode(),
+
+		Settings: settings,
+	}
+	if settings.Bot {
+		room.Player2 = "Bot"
+		room.Status = RoomPlaying
+	}
+	if m.Password != "" {
+		room.Locked = true
+		room.PasswordHash = hashPassword(m.Password)
 	}
 
-	rooms[room.ID] = room
-	return room
+	if err := n.cluster.PutRoom(room); err != nil {
+		log.Printf("Failed to store room %s: %v", room.ID, err)
+	}
+	if settings.Bot {
+		go n.startGameFromRoom(room)
+	}
+	return room, nil
 }
 
-// startGameFromRoom starts a game from a room
-func startGameFromRoom(roomID, p1, p2 string) {
-	log.Printf("Starting game from room %s: %s vs %s", roomID, p1, p2)
-	g := NewGameSession(p1, p2)
-
-	gamesMu.Lock()
-	games[g.ID] = g
-	gamesMu.Unlock()
+// startGameFromRoom starts the game of a room whose seats are taken, on
+// the room's settings
+func (n *Node) startGameFromRoom(room *Room) {
+	s := room.Settings
+	p1, p2 := room.Player1, room.Player2
+	if p2 == room.Creator {
+		p1, p2 = p2, p1
+	}
+	if s.FirstMove == "joiner" || (s.FirstMove == "random" && rand.Intn(2) == 0) {
+		p1, p2 = p2, p1
+	}
+	log.Printf("Starting game from room %s: %s vs %s", room.ID, p1, p2)
+	g := n.newSession(p1, p2)
+	g.applySettings(GameSettings{TimeControl: s.TimeControl, Rated: s.Rated})
+	g.Game = newGame(s.Rows, s.Cols)
+	g.variant = variantOf(s.Rows, s.Cols)
+	g.noSpectators = !s.Spectators
+	g.roomID = room.ID
+	if s.Bot {
+		g.IsBot = true
+		g.Ratings["Bot"] = g.Ratings[room.Creator]
+	}
+	if room.SpectatorDelay > 0 {
+		g.spectatorDelay = time.Duration(room.SpectatorDelay) * time.Second
+	}
 
 	// Update room with game ID
-	roomsMu.Lock()
-	if room, ok := rooms[roomID]; ok {
+	if _, err := n.cluster.UpdateRoom(room.ID, func(room *Room) error {
 		room.GameID = g.ID
+		return nil
+	}); err != nil {
+		log.Printf("Failed to update room %s: %v", room.ID, err)
 	}
-	roomsMu.Unlock()
 
-	// register connected clients in the session and send initial state
-	if c1, ok := clients[p1]; ok {
-		g.clients[p1] = c1
-		c1.SendJSON(map[string]interface{}{"type": "start", "gameId": g.ID, "you": 1, "opponent": p2, "state": g.Game})
-	}
-	if c2, ok := clients[p2]; ok {
-		g.clients[p2] = c2
-		c2.SendJSON(map[string]interface{}{"type": "start", "gameId": g.ID, "you": 2, "opponent": p1, "state": g.Game})
-	}
-	// start goroutine to process game moves
-	go g.run()
+	n.begin(g)
 }
 
 // After scaffolding we will add additional files implementing GameSession, Client, store, bot, etc.
@@ -15,35 +15,145 @@ type Game struct {
 }
 
 type GameRecord struct {
-	ID        string    `json:"id"`
-	Player1   string    `json:"player1"`
-	Player2   string    `json:"player2"`
-	Winner    string    `json:"winner"` // "draw" or username
-	Duration  int64     `json:"duration_seconds"`
-	StartedAt time.Time `json:"started_at"`
-	EndedAt   time.Time `json:"ended_at"`
+	ID        string      `json:"id"`
+	Player1   string      `json:"player1"`
+	Player2   string      `json:"player2"`
+	Winner    string      `json:"winner"` // "draw" or username
+	Duration  int64       `json:"duration_seconds"`
+	StartedAt time.Time   `json:"started_at"`
+	EndedAt   time.Time   `json:"ended_at"`
+	Chat      []ChatEntry `json:"chat,omitempty"` // kept for moderation
 }
 
 type Leaderboard map[string]int
 
+// Ratings maps usernames to Elo ratings. Players who have not finished a
+// rated game are absent and count as defaultRating.
+type Ratings map[string]int
+
+// SessionSnapshot is the persisted form of an in-progress game
+type SessionSnapshot struct {
+	ID        string      `json:"id"`
+	Player1   string      `json:"player1"`
+	Player2   string      `json:"player2"`
+	IsBot     bool        `json:"is_bot"`
+	State     string      `json:"state"`
+	Game      *Game       `json:"game"`
+	Moves     []int       `json:"moves"`    // columns played, in order
+	MoveIDs   []string    `json:"move_ids"` // client move id per move, for deduplication
+	Seq       int         `json:"seq"`      // last update sequence number sent to players
+	Chat      []ChatEntry `json:"chat,omitempty"`
+	StartedAt time.Time   `json:"started_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+
+	SpectatorDelay int  `json:"spectator_delay,omitempty"` // seconds
+	NoSpectators   bool `json:"no_spectators,omitempty"`
+
+	RoomID string `json:"room_id,omitempty"` // room the game was started from
+
+	Rated   bool           `json:"rated,omitempty"`
+	Ratings map[string]int `json:"ratings,omitempty"` // at the start of the game
+
+	Variant     string  `json:"variant,omitempty"`
+	TimeControl string  `json:"time_control,omitempty"`
+	Clocks      []int64 `json:"clocks,omitempty"` // milliseconds left to each player
+}
+
 // Room represents a game room that players can create or join
 type Room struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Creator   string    `json:"creator"`
-	Player1   string    `json:"player1,omitempty"`
-	Player2   string    `json:"player2,omitempty"`
-	Status    string    `json:"status"` // "waiting", "playing", "finished"
-	CreatedAt time.Time `json:"created_at"`
-	GameID    string    `json:"game_id,omitempty"`
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Creator   string      `json:"creator"`
+	Player1   string      `json:"player1,omitempty"`
+	Player2   string      `json:"player2,omitempty"`
+	Status    string      `json:"status"` // "waiting", "ready", "playing", "finished" or "closed"
+	CreatedAt time.Time   `json:"created_at"`
+	GameID    string      `json:"game_id,omitempty"`
+	Chat      []ChatEntry `json:"chat,omitempty"` // recent room chat
+
+	SpectatorDelay int `json:"spectator_delay,omitempty"` // seconds spectators lag behind the game
+
+	Private      bool   `json:"private,omitempty"`       // hidden from /rooms, joined with the invite code
+	InviteCode   string `json:"invite_code,omitempty"`   // empty once revoked; only sent to the creator
+	Locked       bool   `json:"locked,omitempty"`        // joining needs the password
+	PasswordHash string `json:"password_hash,omitempty"` // never sent to clients
+
+	Settings RoomSettings `json:"settings"`
+	Ready    []string     `json:"ready,omitempty"` // players who have pressed ready
+
+	Kicked []string `json:"kicked,omitempty"` // players the host removed, who may not join again; only sent to the host
+}
+
+// RoomSettings are the terms a room's game is played on
+type RoomSettings struct {
+	Rows        int    `json:"rows"`
+	Cols        int    `json:"cols"`
+	TimeControl string `json:"timeControl,omitempty"` // "M+S", or empty for untimed
+	Rated       bool   `json:"rated"`
+	FirstMove   string `json:"firstMove"`     // who moves first: "creator", "joiner" or "random"
+	Spectators  bool   `json:"spectators"`    // whether the game may be watched
+	Bot         bool   `json:"bot,omitempty"` // the creator plays the bot instead of waiting for someone
 }
 
 // RoomInfo is a simplified view of a room for listing
 type RoomInfo struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Creator   string `json:"creator"`
-	Players   int    `json:"players"`
-	MaxPlayers int   `json:"max_players"`
-	Status    string `json:"status"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Creator    string `json:"creator"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	Status     string `json:"status"`
+	Locked     bool   `json:"locked,omitempty"` // joining needs the password
+}
+
+// LiveGame is a game in progress, as listed by /games/live
+type LiveGame struct {
+	ID         string         `json:"id"`
+	Player1    string         `json:"player1"`
+	Player2    string         `json:"player2"`
+	Ratings    map[string]int `json:"ratings,omitempty"` // by username
+	Moves      int            `json:"moves"`
+	Variant    string         `json:"variant"`
+	Spectators int            `json:"spectators"`
+	IsBot      bool           `json:"is_bot"`
+	StartedAt  time.Time      `json:"started_at"`
+
+	Rows        int    `json:"rows"`
+	Cols        int    `json:"cols"`
+	TimeControl string `json:"time_control,omitempty"`
+}
+
+// Presence is an online user, as listed by /users/online
+type Presence struct {
+	Username    string `json:"username"`
+	Status      string `json:"status"`      // idle, spectating, queueing, in_room or playing
+	Connections int    `json:"connections"` // open tabs or devices
+}
+
+// GameSettings are the terms a game is played on
+type GameSettings struct {
+	Variant     string `json:"variant,omitempty"`     // "standard" (the default), "small", "large" or "huge"
+	TimeControl string `json:"timeControl,omitempty"` // "M+S", or empty for untimed
+	Colour      string `json:"colour,omitempty"`      // challenger plays "first", "second" or "random" (default)
+	Rated       bool   `json:"rated"`
+}
+
+// Challenge is an invitation from one online user to another to play
+type Challenge struct {
+	ID        string       `json:"id"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Settings  GameSettings `json:"settings"`
+	Node      string       `json:"node"` // node of the challenger, which holds the challenge
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// QueueInfo is a matchmaking queue, as listed by /queues
+type QueueInfo struct {
+	Name        string `json:"name"`
+	Variant     string `json:"variant"`
+	TimeControl string `json:"timeControl,omitempty"`
+	Waiting     int    `json:"waiting"`       // players in the queue across the cluster
+	ETA         int    `json:"eta,omitempty"` // average recent seconds to a human match
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Presence tracks who is online and what they are doing. Like the live
+// games directory, each node publishes its own users to the cluster every
+// presenceInterval and pushes the combined list to clients following it.
+
+const presenceInterval = 2 * time.Second
+
+// User statuses, from least to most busy. A user with several connections
+// shows the busiest.
+const (
+	StatusIdle       = "idle" // in the lobby
+	StatusSpectating = "spectating"
+	StatusQueueing   = "queueing"
+	StatusInRoom     = "in_room"
+	StatusPlaying    = "playing"
+)
+
+var statusRank = map[string]int{
+	StatusIdle:       0,
+	StatusSpectating: 1,
+	StatusQueueing:   2,
+	StatusInRoom:     3,
+	StatusPlaying:    4,
+}
+
+// localPresence lists the users connected to this node
+func (n *Node) localPresence() []Presence {
+	queued := map[string]bool{}
+	if entries, err := n.cluster.QueueEntries(); err == nil {
+		for _, e := range entries {
+			queued[e.Username] = true
+		}
+	}
+	inRoom := map[string]bool{}
+	if rooms, err := n.cluster.Rooms(); err == nil {
+		for _, room := range rooms {
+			if room.open() {
+				inRoom[room.Player1] = true
+				inRoom[room.Player2] = true
+			}
+		}
+	}
+
+	byUser := map[string]*Presence{}
+	for _, c := range n.allClients() {
+		status := StatusIdle
+		switch {
+		case n.inGame(c):
+			status = StatusPlaying
+		case inRoom[c.Username]:
+			status = StatusInRoom
+		case queued[c.Username]:
+			status = StatusQueueing
+		case c.watchingGame() != "":
+			status = StatusSpectating
+		}
+		p, ok := byUser[c.Username]
+		if !ok {
+			p = &Presence{Username: c.Username, Status: status}
+			byUser[c.Username] = p
+		}
+		p.Connections++
+		if statusRank[status] > statusRank[p.Status] {
+			p.Status = status
+		}
+	}
+
+	list := make([]Presence, 0, len(byUser))
+	for _, p := range byUser {
+		list = append(list, *p)
+	}
+	return list
+}
+
+// onlineUsers returns everyone online across the cluster, by username
+func (n *Node) onlineUsers() []Presence {
+	byNode, err := n.cluster.Presence()
+	if err != nil {
+		log.Printf("Failed to list online users: %v", err)
+		byNode = map[string][]Presence{}
+	}
+	byNode[n.cluster.NodeID()] = n.localPresence()
+
+	// a user can be connected to more than one node
+	merged := map[string]Presence{}
+	for _, list := range byNode {
+		for _, p := range list {
+			if cur, ok := merged[p.Username]; ok {
+				p.Connections += cur.Connections
+				if statusRank[cur.Status] > statusRank[p.Status] {
+					p.Status = cur.Status
+				}
+			}
+			merged[p.Username] = p
+		}
+	}
+	out := make([]Presence, 0, len(merged))
+	for _, p := range merged {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+// filterStatus keeps the users with the given status, or all if it is empty
+func filterStatus(list []Presence, status string) []Presence {
+	if status == "" {
+		return list
+	}
+	out := []Presence{}
+	for _, p := range list {
+		if p.Status == status {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// onlineHandler serves GET /users/online?status=
+func (n *Node) onlineHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filterStatus(n.onlineUsers(), r.URL.Query().Get("status")))
+}
+
+// handleListOnline answers a list_online message and starts or stops
+// following presence
+func (n *Node) handleListOnline(c *Client, m *ListOnlineMessage) {
+	c.liveMu.Lock()
+	c.presence = m.Subscribe
+	c.liveMu.Unlock()
+	c.SendJSON(OnlineUsersMessage{Type: MsgOnlineUsers, Users: n.onlineUsers()})
+}
+
+// presenceLoop publishes this node's users and pushes changes to the
+// clients following presence
+func (n *Node) presenceLoop() {
+	var last []byte
+	for range time.NewTicker(presenceInterval).C {
+		if err := n.cluster.PublishPresence(n.localPresence()); err != nil {
+			log.Printf("Failed to publish presence: %v", err)
+		}
+		users := n.onlineUsers()
+		data, _ := json.Marshal(users)
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		msg := OnlineUsersMessage{Type: MsgOnlineUsers, Users: users}
+		for _, c := range n.allClients() {
+			c.liveMu.Lock()
+			following := c.presence
+			c.liveMu.Unlock()
+			if following {
+				c.SendJSON(msg)
+			}
+		}
+	}
+}
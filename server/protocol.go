@@ -0,0 +1,715 @@
+package main
+
+import "time"
+
+// Wire protocol. Every message is a JSON object with a "type" field; the
+// structs below are the complete set exchanged over /ws and are also the
+// source for the JSON Schema served at /protocol/schema.json.
+//
+// A connection is opened with a "hello" naming the user, then carries any
+// mix of lobby, room and game messages for as long as the user stays. Older
+// clients may instead open with join, create_room or join_room, which both
+// identifies them and performs that action.
+//
+// The client states the protocol version it speaks in the "v" field of its
+// first message (missing means 1). The server answers with the version it
+// will use in a "welcome" message, or an "unsupported_version" error.
+
+const (
+	ProtocolVersion    = 1 // newest version this server speaks
+	MinProtocolVersion = 1 // oldest version still accepted
+)
+
+// Client -> server message types
+const (
+	MsgHello      = "hello"
+	MsgListRooms  = "list_rooms"
+	MsgJoin       = "join"
+	MsgCreateRoom = "create_room"
+	MsgJoinRoom   = "join_room"
+	MsgMove       = "move"
+	MsgResync     = "resync"
+	MsgPong       = "pong"
+	MsgChat       = "chat"
+	MsgMute       = "mute"
+	MsgEmote      = "emote"
+	MsgSpectate   = "spectate"
+	MsgStopWatch  = "stop_spectating"
+	MsgListGames  = "list_games"
+	MsgListOnline = "list_online"
+	MsgLeaveQueue = "leave_queue"
+	MsgChallenge  = "challenge"
+	MsgAccept     = "accept_challenge"
+	MsgDecline    = "decline_challenge"
+	MsgCancel     = "cancel_challenge"
+	MsgRoomInvite = "room_invite"
+	MsgListQueues = "list_queues"
+	MsgRoomReady  = "room_ready"
+	MsgKick       = "kick_player"
+	MsgTransfer   = "transfer_room"
+	MsgRoomConfig = "room_settings"
+)
+
+// Server -> client message types
+const (
+	MsgWelcome         = "welcome"
+	MsgError           = "error"
+	MsgWaiting         = "waiting"
+	MsgRoomCreated     = "room_created"
+	MsgRoomJoined      = "room_joined"
+	MsgRooms           = "rooms"
+	MsgStart           = "start"
+	MsgState           = "state"
+	MsgDelta           = "delta"
+	MsgReconnected     = "reconnected"
+	MsgMoveAck         = "move_ack"
+	MsgShutdown        = "shutdown"
+	MsgPing            = "ping"
+	MsgLatency         = "latency"
+	MsgChatHistory     = "chat_history"
+	MsgSpectating      = "spectating"
+	MsgSpectators      = "spectators"
+	MsgLiveGames       = "live_games"
+	MsgOnlineUsers     = "online_users"
+	MsgQueueStatus     = "queue_status"
+	MsgQueueLeft       = "queue_left"
+	MsgChallengeClosed = "challenge_closed"
+	MsgQueues          = "queues"
+	MsgRoomClosed      = "room_closed"
+	MsgRoomUpdate      = "room_update"
+)
+
+// Error codes carried in ErrorMessage.Code
+const (
+	ErrBadMessage         = "bad_message"
+	ErrUnknownType        = "unknown_type"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrInvalidFirst       = "invalid_first_message"
+	ErrUsernameTaken      = "username_taken"
+	ErrAlreadyPlaying     = "already_playing"
+	ErrShuttingDown       = "shutting_down"
+	ErrRoomNotFound       = "room_not_found"
+	ErrRoomNotAvailable   = "room_not_available"
+	ErrRoomFull           = "room_full"
+	ErrReconnectRejected  = "reconnect_rejected"
+	ErrChatTooLong        = "chat_too_long"
+	ErrRateLimited        = "rate_limited"
+	ErrChatNotAllowed     = "chat_not_allowed"
+	ErrUnknownEmote       = "unknown_emote"
+	ErrGameNotFound       = "game_not_found"
+	ErrAlreadyQueued      = "already_queued"
+	ErrNotQueued          = "not_queued"
+	ErrUserOffline        = "user_offline"
+	ErrInvalidSettings    = "invalid_settings"
+	ErrChallengeNotFound  = "challenge_not_found"
+	ErrWrongPassword      = "wrong_password"
+	ErrNotRoomOwner       = "not_room_owner"
+	ErrUnknownQueue       = "unknown_queue"
+	ErrNoSpectators       = "spectating_not_allowed"
+	ErrNotInRoom          = "not_in_room"
+	ErrKicked             = "kicked"
+	ErrAlreadyInRoom      = "already_in_room"
+	ErrPlayerBusy         = "player_busy"
+)
+
+// Envelope holds the fields common to every client message
+type Envelope struct {
+	Type string `json:"type"`
+	V    int    `json:"v,omitempty"` // protocol version, first message only
+}
+
+// HelloMessage opens a connection for Username. Token is the session token
+// from an earlier welcome; it is needed to use a name that is connected
+// elsewhere, such as from a second tab.
+type HelloMessage struct {
+	Type     string `json:"type"`
+	V        int    `json:"v,omitempty"`
+	Username string `json:"username"`
+	Token    string `json:"token,omitempty"`
+}
+
+// ListRoomsMessage asks for the rooms waiting for players
+type ListRoomsMessage struct {
+	Type string `json:"type"`
+}
+
+// The username in join, create_room and join_room is only read when the
+// message opens the connection; afterwards the connection's user is used.
+
+// JoinMessage enters the named matchmaking queue, or the default one, or
+// resumes a game when GameID is set
+type JoinMessage struct {
+	Type           string `json:"type"`
+	V              int    `json:"v,omitempty"`
+	Username       string `json:"username,omitempty"`
+	Queue          string `json:"queue,omitempty"`
+	GameID         string `json:"gameId,omitempty"`
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+}
+
+// CreateRoomMessage opens a new room with the sender as first player
+type CreateRoomMessage struct {
+	Type     string `json:"type"`
+	V        int    `json:"v,omitempty"`
+	Username string `json:"username,omitempty"`
+	RoomName string `json:"roomName,omitempty"`
+
+	// SpectatorDelay makes spectators of the room's game see each move
+	// this many seconds late, for tournament games
+	SpectatorDelay int `json:"spectatorDelay,omitempty"`
+
+	// Private rooms are left out of the room list and can only be joined
+	// with their invite code. Password, if set, is needed to join either way.
+	Private  bool   `json:"private,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Game settings, all optional: a 6x7 board, untimed, rated, the
+	// creator moving first, open to spectators and against a person
+	Rows        int    `json:"rows,omitempty"`
+	Cols        int    `json:"cols,omitempty"`
+	TimeControl string `json:"timeControl,omitempty"`
+	Rated       *bool  `json:"rated,omitempty"`
+	FirstMove   string `json:"firstMove,omitempty"` // creator, joiner or random
+	Spectators  *bool  `json:"spectators,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
+}
+
+// settings returns the game settings asked for, before defaults are filled in
+func (m CreateRoomMessage) settings() RoomSettings {
+	return roomSettings(m.Rows, m.Cols, m.TimeControl, m.Rated, m.FirstMove, m.Spectators, m.Bot)
+}
+
+// roomSettings builds room settings from those asked for, with rated and
+// spectators true unless set otherwise (rated false for bot games)
+func roomSettings(rows, cols int, timeControl string, rated *bool, firstMove string, spectators *bool, bot bool) RoomSettings {
+	s := RoomSettings{Rows: rows, Cols: cols, TimeControl: timeControl, FirstMove: firstMove, Bot: bot, Rated: !bot, Spectators: true}
+	if rated != nil {
+		s.Rated = *rated
+	}
+	if spectators != nil {
+		s.Spectators = *spectators
+	}
+	return s
+}
+
+// JoinRoomMessage takes the free seat in a room, named by its id or by its
+// invite code
+type JoinRoomMessage struct {
+	Type       string `json:"type"`
+	V          int    `json:"v,omitempty"`
+	Username   string `json:"username,omitempty"`
+	RoomID     string `json:"roomId,omitempty"`
+	InviteCode string `json:"inviteCode,omitempty"`
+	Password   string `json:"password,omitempty"`
+}
+
+// RoomReadyMessage tells a room the sender is ready to play, or with Ready
+// false no longer is. The game starts once both players are ready.
+type RoomReadyMessage struct {
+	Type   string `json:"type"`
+	RoomID string `json:"roomId"`
+	Ready  bool   `json:"ready"`
+}
+
+// RoomPlayerMessage names a player in a room for its creator to remove
+// (kick_player) or to hand the room over to (transfer_room)
+type RoomPlayerMessage struct {
+	Type     string `json:"type"`
+	RoomID   string `json:"roomId"`
+	Username string `json:"username"`
+}
+
+// RoomSettingsMessage replaces the settings of a room waiting for players,
+// as they would be given to create_room. Only its creator may send it, and
+// both players have to press ready again.
+type RoomSettingsMessage struct {
+	Type        string `json:"type"`
+	RoomID      string `json:"roomId"`
+	Rows        int    `json:"rows,omitempty"`
+	Cols        int    `json:"cols,omitempty"`
+	TimeControl string `json:"timeControl,omitempty"`
+	Rated       *bool  `json:"rated,omitempty"`
+	FirstMove   string `json:"firstMove,omitempty"`
+	Spectators  *bool  `json:"spectators,omitempty"`
+}
+
+// settings returns the game settings asked for, before defaults are filled in
+func (m RoomSettingsMessage) settings() RoomSettings {
+	return roomSettings(m.Rows, m.Cols, m.TimeControl, m.Rated, m.FirstMove, m.Spectators, false)
+}
+
+// RoomInviteMessage asks for a new invite code for a room, replacing the
+// old one, or with Revoke for the room to have none. Only the creator of a
+// room waiting for players may ask.
+type RoomInviteMessage struct {
+	Type   string `json:"type"`
+	RoomID string `json:"roomId"`
+	Revoke bool   `json:"revoke,omitempty"`
+}
+
+// MoveMessage drops a disc in Col
+type MoveMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	Col    int    `json:"col"`
+	MoveID string `json:"moveId,omitempty"` // client-chosen id used to deduplicate retries
+	Ply    *int   `json:"ply,omitempty"`    // number of moves the client believes were played
+}
+
+// request converts the message into a MoveRequest for username
+func (m MoveMessage) request(username string) MoveRequest {
+	req := MoveRequest{Username: username, MoveID: m.MoveID, Ply: -1, Col: m.Col}
+	if m.Ply != nil {
+		req.Ply = *m.Ply
+	}
+	return req
+}
+
+// ResyncMessage asks for a full snapshot of a game, sent when the client
+// sees a gap in the delta sequence
+type ResyncMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+}
+
+// PongMessage answers a ping message. WebSocket clients never need it, as
+// pings there are control frames answered by the browser.
+type PongMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// ChatMessage posts a line of chat. Scope is "game", "room" or "lobby";
+// Target is the game or room id and is empty for the lobby.
+type ChatMessage struct {
+	Type   string `json:"type"`
+	Scope  string `json:"scope"`
+	Target string `json:"target,omitempty"`
+	Text   string `json:"text"`
+}
+
+// MuteMessage hides (or shows again) another player's chat on all of the
+// user's connections
+type MuteMessage struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Muted    bool   `json:"muted"`
+}
+
+// EmoteMessage sends a quick reaction during a game. Emote is one of
+// good_game, good_luck, nice_move, oops, thanks and well_played.
+type EmoteMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	Emote  string `json:"emote"`
+}
+
+// ListGamesMessage asks for the games in progress, filtered and sorted as
+// for GET /games/live. With Subscribe set the list is sent again whenever
+// it changes, until a list_games without it.
+type ListGamesMessage struct {
+	Type      string `json:"type"`
+	Player    string `json:"player,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+	Bots      *bool  `json:"bots,omitempty"`
+	MinMoves  int    `json:"minMoves,omitempty"`
+	Sort      string `json:"sort,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Subscribe bool   `json:"subscribe,omitempty"`
+}
+
+func (m ListGamesMessage) filter() LiveFilter {
+	return LiveFilter{Player: m.Player, Variant: m.Variant, Bots: m.Bots, MinMoves: m.MinMoves, Sort: m.Sort, Limit: m.Limit}
+}
+
+// ListOnlineMessage asks for the users online, as for GET /users/online.
+// With Subscribe set the list is sent again whenever it changes, until a
+// list_online without it.
+type ListOnlineMessage struct {
+	Type      string `json:"type"`
+	Subscribe bool   `json:"subscribe,omitempty"`
+}
+
+// ListQueuesMessage asks for the matchmaking queues, as for GET /queues.
+// With Subscribe set the list is sent again whenever it changes, until a
+// list_queues without it.
+type ListQueuesMessage struct {
+	Type      string `json:"type"`
+	Subscribe bool   `json:"subscribe,omitempty"`
+}
+
+// ChallengeMessage invites an online user to a game on the given settings
+type ChallengeMessage struct {
+	Type        string `json:"type"`
+	To          string `json:"to"`
+	Variant     string `json:"variant,omitempty"`
+	TimeControl string `json:"timeControl,omitempty"`
+	Colour      string `json:"colour,omitempty"` // first, second or random (default)
+	Rated       bool   `json:"rated,omitempty"`
+}
+
+func (m ChallengeMessage) settings() GameSettings {
+	return GameSettings{Variant: m.Variant, TimeControl: m.TimeControl, Colour: m.Colour, Rated: m.Rated}
+}
+
+// ChallengeReplyMessage accepts, declines or (for the challenger) cancels a
+// challenge
+type ChallengeReplyMessage struct {
+	Type        string `json:"type"` // accept_challenge, decline_challenge or cancel_challenge
+	ChallengeID string `json:"challengeId"`
+}
+
+// LeaveQueueMessage cancels a join, taking the player out of the queue
+type LeaveQueueMessage struct {
+	Type string `json:"type"`
+}
+
+// SpectateMessage starts watching a game, replacing any game watched before
+type SpectateMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+}
+
+// StopSpectatingMessage stops watching
+type StopSpectatingMessage struct {
+	Type string `json:"type"`
+}
+
+// WelcomeMessage confirms the user and protocol version for the connection
+type WelcomeMessage struct {
+	Type     string `json:"type"`
+	V        int    `json:"v"`
+	Username string `json:"username"`
+	Token    string `json:"token"` // session token to present in later hellos
+	Rating   int    `json:"rating"`
+}
+
+// ErrorMessage is the uniform error envelope
+type ErrorMessage struct {
+	Type  string `json:"type"`
+	Code  string `json:"code"`
+	Error string `json:"error"` // human readable description
+}
+
+func newError(code, text string) ErrorMessage {
+	return ErrorMessage{Type: MsgError, Code: code, Error: text}
+}
+
+// WaitingMessage confirms the player is in the matchmaking queue
+type WaitingMessage struct {
+	Type    string `json:"type"`
+	Queue   string `json:"queue"`
+	Timeout int    `json:"timeout"` // seconds to wait for an opponent
+	Bot     bool   `json:"bot"`     // whether a bot game starts then; otherwise the player leaves the queue
+}
+
+// QueueStatusMessage tells a queued player where they stand. It is sent
+// whenever it changes.
+type QueueStatusMessage struct {
+	Type     string `json:"type"`
+	Queue    string `json:"queue"`
+	Position int    `json:"position"` // 1 for the longest waiting player
+	Size     int    `json:"size"`     // players in the queue
+	ETA      int    `json:"eta"`      // estimated seconds until a game starts
+}
+
+// ChallengeEvent shows a challenge to both players: to the challenger once
+// it has been sent, and to the user challenged
+type ChallengeEvent struct {
+	Type      string     `json:"type"`
+	Challenge *Challenge `json:"challenge"`
+}
+
+// ChallengeClosedMessage tells both players a challenge is over. Reason is
+// accepted (a start message follows), declined, cancelled, expired or
+// unavailable (one of them disconnected or is playing another game).
+type ChallengeClosedMessage struct {
+	Type        string `json:"type"`
+	ChallengeID string `json:"challengeId"`
+	Reason      string `json:"reason"`
+}
+
+// QueueLeftMessage tells a player they are no longer queued, either because
+// they asked (cancelled) or because nobody was found in time (timeout)
+type QueueLeftMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// RoomMessage answers create_room and join_room, and as room_update is
+// sent to the players in a room whenever it changes
+type RoomMessage struct {
+	Type   string `json:"type"` // room_created, room_joined or room_update
+	RoomID string `json:"roomId"`
+	Room   *Room  `json:"room"`
+}
+
+// RoomClosedMessage tells a player a room is gone for them. Reason is
+// deleted (by its creator) or kicked.
+type RoomClosedMessage struct {
+	Type   string `json:"type"`
+	RoomID string `json:"roomId"`
+	Reason string `json:"reason"`
+}
+
+// RoomInviteEvent answers room_invite with the room's invite code, empty
+// once revoked
+type RoomInviteEvent struct {
+	Type       string `json:"type"`
+	RoomID     string `json:"roomId"`
+	InviteCode string `json:"inviteCode,omitempty"`
+}
+
+// RoomListMessage answers list_rooms
+type RoomListMessage struct {
+	Type  string     `json:"type"`
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+// StartMessage is sent to each player when their game begins
+type StartMessage struct {
+	Type           string `json:"type"`
+	GameID         string `json:"gameId"`
+	You            int    `json:"you"` // 1 or 2
+	Opponent       string `json:"opponent"`
+	State          *Game  `json:"state"`
+	Seq            int    `json:"seq"`
+	ReconnectToken string `json:"reconnectToken"`
+
+	Rated   bool           `json:"rated"`
+	Ratings map[string]int `json:"ratings"` // both players' ratings, the bot's being its strength
+
+	Variant     string  `json:"variant"`
+	TimeControl string  `json:"timeControl,omitempty"`
+	Clocks      []int64 `json:"clocks,omitempty"` // milliseconds left to each player in a timed game
+}
+
+// StateMessage is a full snapshot of a game. It is sent in answer to a
+// resync and in place of every 16th delta.
+type StateMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	Seq    int    `json:"seq"` // sequence number of the last update it includes
+	State  *Game  `json:"state"`
+	Ply    int    `json:"ply"` // moves played so far
+	You    int    `json:"you"`
+	Status string `json:"status"` // playing or finished
+	Result string `json:"result"` // winner's username or "draw" once finished
+
+	Ratings map[string]int `json:"ratings,omitempty"` // players' new ratings once a rated game ends
+	Clocks  []int64        `json:"clocks,omitempty"`  // milliseconds left to each player in a timed game
+}
+
+// DeltaMessage is sent to the players after every move, and when a game
+// ends without one. Seq increases by one with each update; a client that
+// sees a gap should send a resync.
+type DeltaMessage struct {
+	Type   string     `json:"type"`
+	GameID string     `json:"gameId"`
+	Seq    int        `json:"seq"`
+	Ply    int        `json:"ply"`            // moves played, including this one
+	Move   *MoveDelta `json:"move,omitempty"` // absent when the game was forfeited
+	Turn   int        `json:"turn"`           // player to move next
+	Status string     `json:"status"`
+	Result string     `json:"result"`
+
+	Ratings map[string]int `json:"ratings,omitempty"` // players' new ratings once a rated game ends
+	Clocks  []int64        `json:"clocks,omitempty"`  // milliseconds left to each player in a timed game
+}
+
+// MoveDelta describes a single disc drop
+type MoveDelta struct {
+	Col    int   `json:"col"`
+	Row    int   `json:"row"`
+	Player int   `json:"player"`
+	Clock  int64 `json:"clock"` // milliseconds since the game started
+}
+
+// ReconnectedMessage confirms a resumed game
+type ReconnectedMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	State  *Game  `json:"state"`
+	Ply    int    `json:"ply"`
+	Seq    int    `json:"seq"`
+
+	Clocks []int64 `json:"clocks,omitempty"` // milliseconds left to each player in a timed game
+}
+
+// MoveAckMessage tells the mover what happened to a move
+type MoveAckMessage struct {
+	Type      string `json:"type"`
+	GameID    string `json:"gameId"`
+	MoveID    string `json:"moveId,omitempty"`
+	Ply       int    `json:"ply"`
+	Accepted  bool   `json:"accepted"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Reason    string `json:"reason,omitempty"` // game_over, not_your_turn, stale_ply, invalid_column, column_full, timeout
+}
+
+// PingMessage measures round-trip time on transports without control
+// frames (SSE). The client answers with a pong carrying the same id.
+type PingMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// LatencyMessage shows the players' connection quality during a game
+type LatencyMessage struct {
+	Type    string                 `json:"type"`
+	GameID  string                 `json:"gameId"`
+	Players map[string]LatencyInfo `json:"players"` // by username
+}
+
+// LatencyInfo is one player's round-trip time
+type LatencyInfo struct {
+	RTT     int64  `json:"rtt"`     // smoothed round-trip time in milliseconds
+	Quality string `json:"quality"` // good, fair or poor
+}
+
+// ChatEvent is a line of chat, after the word filter
+type ChatEvent struct {
+	Type   string    `json:"type"`
+	Scope  string    `json:"scope"`
+	Target string    `json:"target,omitempty"`
+	From   string    `json:"from"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+}
+
+// ChatHistoryMessage replays recent chat on joining a room, the lobby or
+// reconnecting to a game
+type ChatHistoryMessage struct {
+	Type     string      `json:"type"`
+	Scope    string      `json:"scope"`
+	Target   string      `json:"target,omitempty"`
+	Messages []ChatEntry `json:"messages"`
+}
+
+// EmoteEvent shows a player's emote to everyone in the game
+type EmoteEvent struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	From   string `json:"from"`
+	Emote  string `json:"emote"`
+}
+
+// LiveGamesMessage lists games in progress
+type LiveGamesMessage struct {
+	Type  string     `json:"type"`
+	Games []LiveGame `json:"games"`
+}
+
+// OnlineUsersMessage lists the users online and what they are doing
+type OnlineUsersMessage struct {
+	Type  string     `json:"type"`
+	Users []Presence `json:"users"`
+}
+
+// QueuesMessage lists the matchmaking queues and how busy they are
+type QueuesMessage struct {
+	Type   string      `json:"type"`
+	Queues []QueueInfo `json:"queues"`
+}
+
+// SpectatingMessage confirms a spectator's game. A state message with the
+// position follows, and another after every update.
+type SpectatingMessage struct {
+	Type       string    `json:"type"`
+	GameID     string    `json:"gameId"`
+	Player1    string    `json:"player1"`
+	Player2    string    `json:"player2"`
+	StartedAt  time.Time `json:"startedAt"`
+	Delay      int       `json:"delay"` // seconds the spectator view lags behind the game
+	Spectators int       `json:"spectators"`
+}
+
+// SpectatorsMessage updates the number of spectators of a game, for players
+// and spectators alike
+type SpectatorsMessage struct {
+	Type   string `json:"type"`
+	GameID string `json:"gameId"`
+	Count  int    `json:"count"`
+}
+
+// ShutdownMessage warns that the server is about to stop
+type ShutdownMessage struct {
+	Type  string `json:"type"`
+	Grace int    `json:"grace"` // seconds until the server stops
+}
+
+// negotiateVersion picks the version to speak with a client that asked for v
+func negotiateVersion(v int) (int, bool) {
+	if v == 0 {
+		v = 1
+	}
+	if v < MinProtocolVersion {
+		return 0, false
+	}
+	if v > ProtocolVersion {
+		v = ProtocolVersion
+	}
+	return v, true
+}
+
+// decodeMessage unmarshals data into the struct for its type. msg is nil
+// for types that are not client messages.
+func decodeMessage(codec Codec, data []byte) (env Envelope, msg interface{}, err error) {
+	if err = codec.Unmarshal(data, &env); err != nil {
+		return env, nil, err
+	}
+	switch env.Type {
+	case MsgHello:
+		msg = &HelloMessage{}
+	case MsgListRooms:
+		msg = &ListRoomsMessage{}
+	case MsgJoin:
+		msg = &JoinMessage{}
+	case MsgCreateRoom:
+		msg = &CreateRoomMessage{}
+	case MsgJoinRoom:
+		msg = &JoinRoomMessage{}
+	case MsgMove:
+		msg = &MoveMessage{}
+	case MsgResync:
+		msg = &ResyncMessage{}
+	case MsgPong:
+		msg = &PongMessage{}
+	case MsgChat:
+		msg = &ChatMessage{}
+	case MsgMute:
+		msg = &MuteMessage{}
+	case MsgEmote:
+		msg = &EmoteMessage{}
+	case MsgSpectate:
+		msg = &SpectateMessage{}
+	case MsgStopWatch:
+		msg = &StopSpectatingMessage{}
+	case MsgListGames:
+		msg = &ListGamesMessage{}
+	case MsgListOnline:
+		msg = &ListOnlineMessage{}
+	case MsgListQueues:
+		msg = &ListQueuesMessage{}
+	case MsgLeaveQueue:
+		msg = &LeaveQueueMessage{}
+	case MsgChallenge:
+		msg = &ChallengeMessage{}
+	case MsgAccept, MsgDecline, MsgCancel:
+		msg = &ChallengeReplyMessage{}
+	case MsgRoomInvite:
+		msg = &RoomInviteMessage{}
+	case MsgRoomReady:
+		msg = &RoomReadyMessage{}
+	case MsgKick, MsgTransfer:
+		msg = &RoomPlayerMessage{}
+	case MsgRoomConfig:
+		msg = &RoomSettingsMessage{}
+	default:
+		return env, nil, nil
+	}
+	if err = codec.Unmarshal(data, msg); err != nil {
+		return env, nil, err
+	}
+	return env, msg, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The matchmaking queues are shared by the cluster. There is one per
+// variant and time control configured in QUEUES, and players are only
+// paired with others in the same queue. Every player in a queue has a
+// matcher running on the node they joined through, which pairs them with
+// the closest rated player within both players' windows, keeps them told of
+// their place in the queue, and once the timeout passes starts a bot game or
+// takes them out of the queue.
+
+const (
+	matchPoll      = 500 * time.Millisecond // how often a queued player looks for an opponent
+	waitSamples    = 20                     // human matches the estimated wait is averaged over
+	queuesInterval = 2 * time.Second        // how often queue stats are pushed to lobby clients
+)
+
+// parseQueues reads the QUEUES setting, name[:variant[:time_control]] per
+// queue. Queues the server cannot play are left out; with none left there
+// is a single standard queue.
+func parseQueues(specs []string) []QueueInfo {
+	var queues []QueueInfo
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+		q := QueueInfo{Name: parts[0]}
+		if len(parts) > 1 {
+			q.Variant = parts[1]
+		}
+		if len(parts) > 2 {
+			q.TimeControl = parts[2]
+		}
+		settings := GameSettings{Variant: q.Variant, TimeControl: q.TimeControl}
+		if err := validSettings(&settings); err != nil {
+			log.Printf("Ignoring queue %q: %v", spec, err)
+			continue
+		}
+		if q.Name == "" || seen[q.Name] {
+			log.Printf("Ignoring queue %q: missing or repeated name", spec)
+			continue
+		}
+		seen[q.Name] = true
+		q.Variant = settings.Variant
+		queues = append(queues, q)
+	}
+	if len(queues) == 0 {
+		queues = []QueueInfo{{Name: variantStandard, Variant: variantStandard}}
+	}
+	return queues
+}
+
+// queueNamed returns the queue with the given name, or the default queue
+// for an empty name
+func (n *Node) queueNamed(name string) (QueueInfo, bool) {
+	if name == "" {
+		return n.queues[0], true
+	}
+	for _, q := range n.queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return QueueInfo{}, false
+}
+
+// matchWindow is how far apart two players' ratings may be for them to be
+// paired, once the one who joined at joined has waited this long
+func matchWindow(joined time.Time) int {
+	return config.MatchWindow + int(time.Since(joined).Seconds()*float64(config.MatchWindowGrowth))
+}
+
+// waitStats remembers how long the recent human matches on a node took
+type waitStats struct {
+	mu     sync.Mutex
+	recent []time.Duration
+}
+
+func (w *waitStats) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recent = append(w.recent, d)
+	if len(w.recent) > waitSamples {
+		w.recent = w.recent[1:]
+	}
+}
+
+func (w *waitStats) average() (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.recent) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, d := range w.recent {
+		sum += d
+	}
+	return sum / time.Duration(len(w.recent)), true
+}
+
+// estimateWait guesses the seconds left before a player who has waited
+// this long in queue gets a game: the average recent match time there, but
+// no more than the time left before the timeout
+func (n *Node) estimateWait(queue string, waited time.Duration) int {
+	eta := n.matchWait - waited
+	if avg, ok := n.waits[queue].average(); ok && avg-waited < eta {
+		eta = avg - waited
+	}
+	if eta < 0 {
+		return 0
+	}
+	return int(math.Ceil(eta.Seconds()))
+}
+
+// joinQueue puts c's user in the named matchmaking queue
+func (n *Node) joinQueue(c *Client, name string) error {
+	q, ok := n.queueNamed(name)
+	if !ok {
+		return c.reject(ErrUnknownQueue, "no queue named "+name)
+	}
+	entry := QueueEntry{Username: c.Username, Node: n.cluster.NodeID(), JoinedAt: time.Now(), Rating: lookupRating(c.Username), Queue: q.Name}
+	if err := n.cluster.QueueAdd(entry); err == errQueued {
+		return c.reject(ErrAlreadyQueued, "already in the queue")
+	} else if err != nil {
+		log.Printf("Failed to add %s to the matchmaking queue: %v", c.Username, err)
+		return c.reject(ErrBadMessage, "could not join the queue")
+	}
+	c.setSeeking(true)
+	c.SendJSON(WaitingMessage{Type: MsgWaiting, Queue: q.Name, Timeout: int(n.matchWait / time.Second), Bot: n.botFallback})
+
+	log.Printf("Player %s (%d) joined matchmaking queue %s, waiting up to %s...", entry.Username, entry.Rating, q.Name, n.matchWait)
+	go n.match(entry)
+	return nil
+}
+
+// isQueued reports whether username is waiting in any matchmaking queue
+func (n *Node) isQueued(username string) bool {
+	entries, err := n.cluster.QueueEntries()
+	if err != nil {
+		log.Printf("Failed to read matchmaking queue: %v", err)
+		return false
+	}
+	for _, e := range entries {
+		if e.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// handleLeaveQueue takes c's user out of the queue at their request
+func (n *Node) handleLeaveQueue(c *Client) error {
+	if ok, _ := n.cluster.QueueRemove(c.Username); !ok {
+		return c.reject(ErrNotQueued, "not in the queue")
+	}
+	log.Printf("Player %s left the matchmaking queue", c.Username)
+	n.queueLeft(c.Username, "cancelled")
+	return nil
+}
+
+// dropQueued takes a disconnected client's user out of the queue, unless
+// another of their connections to this node is still looking for a game.
+// c must already be removed from the node's clients.
+func (n *Node) dropQueued(c *Client) {
+	if !c.isSeeking() {
+		return
+	}
+	for _, other := range n.clientsOf(c.Username) {
+		if other.isSeeking() {
+			return
+		}
+	}
+	if ok, _ := n.cluster.QueueRemove(c.Username); ok {
+		log.Printf("Player %s disconnected, removed from matchmaking queue", c.Username)
+	}
+}
+
+// queueLeft tells username's waiting connections why they are no longer
+// queued
+func (n *Node) queueLeft(username, reason string) {
+	for _, c := range n.clientsOf(username) {
+		if c.isSeeking() {
+			c.setSeeking(false)
+			c.SendJSON(QueueLeftMessage{Type: MsgQueueLeft, Reason: reason})
+		}
+	}
+}
+
+// match runs for as long as me is queued
+func (n *Node) match(me QueueEntry) {
+	username := me.Username
+	q, _ := n.queueNamed(me.Queue)
+	var last QueueStatusMessage
+
+	// The queue is shared with other nodes, so pairing retries until it
+	// wins the race for both entries or finds username already taken
+	for {
+		time.Sleep(matchPoll)
+		all, err := n.cluster.QueueEntries()
+		if err != nil {
+			// the entry is still there, so try again on the next poll
+			log.Printf("Failed to read matchmaking queue: %v", err)
+			continue
+		}
+		var entries []QueueEntry
+		for _, e := range all {
+			if e.Queue == q.Name {
+				entries = append(entries, e)
+			}
+		}
+
+		// Find this player in the waiting queue
+		position := -1
+		for i, e := range entries {
+			if e.Username == username {
+				me, position = e, i
+			}
+		}
+
+		// Matched by another player's matcher, or left the queue
+		if position < 0 {
+			return
+		}
+
+		// No new games once shutdown has started
+		if draining.Load() {
+			if ok, _ := n.cluster.QueueRemove(username); ok {
+				log.Printf("Player %s removed from matchmaking queue, server is shutting down", username)
+				n.queueLeft(username, "shutting_down")
+			}
+			return
+		}
+
+		var opponent *QueueEntry
+		best := 0
+		for i, e := range entries {
+			if e.Username == username {
+				continue
+			}
+			diff := e.Rating - me.Rating
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > matchWindow(me.JoinedAt) || diff > matchWindow(e.JoinedAt) {
+				continue
+			}
+			if opponent == nil || diff < best {
+				opponent, best = &entries[i], diff
+			}
+		}
+
+		if opponent != nil {
+			// the player who waited longer moves first
+			p1, p2 := opponent.Username, username
+			if me.JoinedAt.Before(opponent.JoinedAt) {
+				p1, p2 = p2, p1
+			}
+			if ok, _ := n.cluster.QueueTake(p1, p2); ok {
+				log.Printf("Matching %s with %s in %s (ratings %d and %d)", username, opponent.Username, q.Name, me.Rating, opponent.Rating)
+				n.waits[q.Name].add(time.Since(me.JoinedAt))
+				n.waits[q.Name].add(time.Since(opponent.JoinedAt))
+				go n.startGame(p1, p2, GameSettings{Variant: q.Variant, TimeControl: q.TimeControl, Rated: true})
+				return
+			}
+			continue
+		}
+
+		waited := time.Since(me.JoinedAt)
+		if waited >= n.matchWait {
+			if ok, _ := n.cluster.QueueTake(username); ok {
+				if n.botFallback {
+					log.Printf("No opponent found for %s after %s, starting bot game", username, n.matchWait)
+					go n.startGameWithBot(username, me.Rating, GameSettings{Variant: q.Variant, TimeControl: q.TimeControl})
+				} else {
+					log.Printf("No opponent found for %s after %s, leaving queue", username, n.matchWait)
+					n.queueLeft(username, "timeout")
+				}
+				return
+			}
+			continue
+		}
+
+		status := QueueStatusMessage{Type: MsgQueueStatus, Queue: q.Name, Position: position + 1, Size: len(entries), ETA: n.estimateWait(q.Name, waited)}
+		if status != last {
+			last = status
+			for _, c := range n.clientsOf(username) {
+				if c.isSeeking() {
+					c.SendJSON(status)
+				}
+			}
+		}
+	}
+}
+
+// queueStats returns the queues with the players waiting in each
+func (n *Node) queueStats() []QueueInfo {
+	entries, err := n.cluster.QueueEntries()
+	if err != nil {
+		log.Printf("Failed to read matchmaking queue: %v", err)
+	}
+	waiting := map[string]int{}
+	for _, e := range entries {
+		waiting[e.Queue]++
+	}
+	out := make([]QueueInfo, len(n.queues))
+	for i, q := range n.queues {
+		q.Waiting = waiting[q.Name]
+		if avg, ok := n.waits[q.Name].average(); ok {
+			q.ETA = int(math.Ceil(avg.Seconds()))
+		}
+		out[i] = q
+	}
+	return out
+}
+
+// queuesHandler serves GET /queues
+func (n *Node) queuesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.queueStats())
+}
+
+// handleListQueues answers a list_queues message and starts or stops
+// following the queues
+func (n *Node) handleListQueues(c *Client, m *ListQueuesMessage) {
+	c.liveMu.Lock()
+	c.queues = m.Subscribe
+	c.liveMu.Unlock()
+	c.SendJSON(QueuesMessage{Type: MsgQueues, Queues: n.queueStats()})
+}
+
+// queuesLoop pushes changes in the queues to the clients following them
+func (n *Node) queuesLoop() {
+	var last []byte
+	for range time.NewTicker(queuesInterval).C {
+		queues := n.queueStats()
+		data, _ := json.Marshal(queues)
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		msg := QueuesMessage{Type: MsgQueues, Queues: queues}
+		for _, c := range n.allClients() {
+			c.liveMu.Lock()
+			following := c.queues
+			c.liveMu.Unlock()
+			if following {
+				c.SendJSON(msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queued lists the users in the shared queue
+func queued(t *testing.T, n *Node) []string {
+	t.Helper()
+	entries, err := n.cluster.QueueEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Username)
+	}
+	return names
+}
+
+// eventually fails the test if cond is still false after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	alice.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, alice, "waiting")
+
+	alice.WriteJSON(map[string]any{"type": "leave_queue"})
+	if m := readUntil(t, alice, "queue_left"); m["reason"] != "cancelled" {
+		t.Fatalf("left the queue with reason %v, want cancelled", m["reason"])
+	}
+	if q := queued(t, n); len(q) != 0 {
+		t.Fatalf("queue is %v after cancelling", q)
+	}
+
+	alice.WriteJSON(map[string]any{"type": "leave_queue"})
+	if m := readUntil(t, alice, "error"); m["code"] != ErrNotQueued {
+		t.Fatalf("leaving twice got %v, want not_queued", m)
+	}
+
+	// a cancelled player can queue again
+	alice.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, alice, "waiting")
+	if q := queued(t, n); len(q) != 1 {
+		t.Fatalf("queue is %v after joining again", q)
+	}
+}
+
+func TestQueueDuplicateJoin(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"]
+	alice.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, alice, "waiting")
+
+	alice.WriteJSON(map[string]any{"type": "join"})
+	if m := readUntil(t, alice, "error"); m["code"] != ErrAlreadyQueued {
+		t.Fatalf("joining twice got %v, want already_queued", m)
+	}
+
+	// nor can another tab queue the same user
+	tab := dial(t, srv, map[string]any{"type": "hello", "username": "alice", "token": token})
+	readUntil(t, tab, "welcome")
+	tab.WriteJSON(map[string]any{"type": "join"})
+	if m := readUntil(t, tab, "error"); m["code"] != ErrAlreadyQueued {
+		t.Fatalf("joining from another tab got %v, want already_queued", m)
+	}
+	if q := queued(t, n); len(q) != 1 {
+		t.Fatalf("queue is %v, want alice once", q)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"]
+	tab := dial(t, srv, map[string]any{"type": "hello", "username": "alice", "token": token})
+	readUntil(t, tab, "welcome")
+	alice.WriteJSON(map[string]any{"type": "join"})
+	readUntil(t, alice, "waiting")
+
+	// closing a tab that is not queueing keeps the player queued
+	tab.Close()
+	time.Sleep(100 * time.Millisecond)
+	if q := queued(t, n); len(q) != 1 {
+		t.Fatalf("queue is %v after closing an idle tab", q)
+	}
+
+	// closing the queueing one takes them out, and nobody is matched with them
+	alice.Close()
+	eventually(t, "alice leaves the queue", func() bool { return len(queued(t, n)) == 0 })
+	bob := dial(t, srv, map[string]any{"type": "join", "username": "bob"})
+	readUntil(t, bob, "waiting")
+	time.Sleep(3 * matchPoll)
+	if q := queued(t, n); len(q) != 1 || q[0] != "bob" {
+		t.Fatalf("queue is %v, want bob still waiting", q)
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	alice := dial(t, srv, map[string]any{"type": "join", "username": "alice"})
+	readUntil(t, alice, "waiting")
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+
+	if m := readUntil(t, alice, "queue_left"); m["reason"] != "shutting_down" {
+		t.Fatalf("queue_left reason = %v, want shutting_down", m["reason"])
+	}
+	if q := queued(t, n); len(q) != 0 {
+		t.Fatalf("queue is %v while draining", q)
+	}
+}
+
+// flakyQueue fails the next few reads of the matchmaking queue
+type flakyQueue struct {
+	Cluster
+	failures atomic.Int32
+}
+
+func (f *flakyQueue) QueueEntries() ([]QueueEntry, error) {
+	if f.failures.Add(-1) >= 0 {
+		return nil, errors.New("database unavailable")
+	}
+	return f.Cluster.QueueEntries()
+}
+
+func TestMatchSurvivesQueueErrors(t *testing.T) {
+	flaky := &flakyQueue{Cluster: NewMemoryBackend().Join("a")}
+	n := NewNode(flaky)
+	n.matchWait = time.Minute
+	mux := http.NewServeMux()
+	n.routes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	alice := dial(t, srv, map[string]any{"type": "join", "username": "alice"})
+	readUntil(t, alice, "waiting")
+	bob := dial(t, srv, map[string]any{"type": "join", "username": "bob"})
+	readUntil(t, bob, "waiting")
+
+	// both matchers hit an error, and pair the players once reads work again
+	flaky.failures.Store(4)
+	readUntil(t, alice, "start")
+	readUntil(t, bob, "start")
+}
+
+func TestMatchedPlayerGoneForfeits(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+
+	// bob disconnected between being matched and the game starting
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	readUntil(t, alice, "welcome")
+	n.startGame("alice", "bob", GameSettings{Variant: variantStandard})
+	start := readUntil(t, alice, "start")
+
+	sess, ok := n.localGame(start["gameId"].(string))
+	if !ok {
+		t.Fatal("game not found")
+	}
+	time.Sleep(time.Duration(config.ReconnectTimeout) * time.Second)
+	eventually(t, "bob forfeits", func() bool {
+		sess.TurnMu.Lock()
+		defer sess.TurnMu.Unlock()
+		return sess.State == "finished" && sess.Result == "alice"
+	})
+}
+
+func TestParseQueues(t *testing.T) {
+	queues := parseQueues([]string{"standard", "blitz::3+2", "big:large:10+5", "odd:hexagonal", "slow::5", "blitz:small", ""})
+	want := []QueueInfo{
+		{Name: "standard", Variant: variantStandard},
+		{Name: "blitz", Variant: variantStandard, TimeControl: "3+2"},
+		{Name: "big", Variant: "large", TimeControl: "10+5"},
+	}
+	if len(queues) != len(want) {
+		t.Fatalf("parsed %+v, want %+v", queues, want)
+	}
+	for i := range want {
+		if queues[i] != want[i] {
+			t.Errorf("queue %d = %+v, want %+v", i, queues[i], want[i])
+		}
+	}
+}
+
+func TestQueuesPlayTheirSettings(t *testing.T) {
+	saved := config.Queues
+	config.Queues = []string{"standard", "big:huge:3+2"}
+	defer func() { config.Queues = saved }()
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	n.matchWait = time.Minute
+
+	// start queues the players and returns their start messages
+	start := func(queue string, players ...string) []map[string]any {
+		var conns []*websocket.Conn
+		for _, name := range players {
+			conn := dial(t, srv, map[string]any{"type": "hello", "username": name})
+			readUntil(t, conn, "welcome")
+			conn.WriteJSON(map[string]any{"type": "join", "queue": queue})
+			readUntil(t, conn, "waiting")
+			conns = append(conns, conn)
+		}
+		var starts []map[string]any
+		for _, conn := range conns {
+			starts = append(starts, readUntil(t, conn, "start"))
+		}
+		return starts
+	}
+	standard := start("standard", "alice", "bob")
+	big := start("big", "carol", "dave")
+
+	for _, m := range standard {
+		state := m["state"].(map[string]any)
+		if m["variant"] != variantStandard || state["rows"] != float64(defaultRows) || state["cols"] != float64(defaultCols) || m["clocks"] != nil {
+			t.Errorf("standard queue started %v on %vx%v with clocks %v", m["variant"], state["rows"], state["cols"], m["clocks"])
+		}
+	}
+	for _, m := range big {
+		state := m["state"].(map[string]any)
+		clocks, _ := m["clocks"].([]any)
+		if m["variant"] != "huge" || state["rows"] != float64(8) || state["cols"] != float64(10) || m["timeControl"] != "3+2" || len(clocks) != 2 {
+			t.Errorf("big queue started %v on %vx%v, time control %v, clocks %v", m["variant"], state["rows"], state["cols"], m["timeControl"], m["clocks"])
+		}
+	}
+}
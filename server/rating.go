@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Players have an Elo rating, updated after every rated game: human games
+// from the queue or a room. Games against the bot are never rated.
+
+const (
+	defaultRating = 1200
+	eloK          = 32 // most a rating can move in one game
+)
+
+func (r Ratings) get(username string) int {
+	if rating, ok := r[username]; ok {
+		return rating
+	}
+	return defaultRating
+}
+
+// expectedScore is the score a player rated r is expected to make against
+// one rated opp, from 0 (certain loss) to 1 (certain win)
+func expectedScore(r, opp int) float64 {
+	return 1 / (1 + math.Pow(10, float64(opp-r)/400))
+}
+
+// eloUpdate returns the new ratings of two players after a game in which
+// the first scored score: 1 for a win, 0.5 for a draw and 0 for a loss
+func eloUpdate(r1, r2 int, score float64) (int, int) {
+	delta := int(math.Round(eloK * (score - expectedScore(r1, r2))))
+	return r1 + delta, r2 - delta
+}
+
+// lookupRating returns username's current rating
+func lookupRating(username string) int {
+	if database.enabled {
+		if rating, err := database.GetRating(username); err == nil {
+			return rating
+		}
+	}
+	return store.LoadRatings().get(username)
+}
+
+// rateGame updates the players' ratings for a finished game, winner being
+// one of them or "draw", and returns their new ratings
+func rateGame(p1, p2, winner string) map[string]int {
+	score := 0.5
+	switch winner {
+	case p1:
+		score = 1
+	case p2:
+		score = 0
+	}
+	update := func(r1, r2 int) (int, int) { return eloUpdate(r1, r2, score) }
+
+	var r1, r2 int
+	var err error
+	if database.enabled {
+		r1, r2, err = database.UpdateRatings(p1, p2, update)
+	} else {
+		r1, r2, err = store.UpdateRatings(p1, p2, update)
+	}
+	if err != nil {
+		log.Printf("Failed to update ratings for %s and %s: %v", p1, p2, err)
+		return nil
+	}
+	return map[string]int{p1: r1, p2: r2}
+}
+
+func ratingsHandler(w http.ResponseWriter, r *http.Request) {
+	var ratings Ratings
+
+	// Try database first, fallback to file store
+	if database.enabled {
+		var err error
+		ratings, err = database.GetRatings()
+		if err != nil {
+			ratings = store.LoadRatings()
+		}
+	} else {
+		ratings = store.LoadRatings()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ratings)
+}
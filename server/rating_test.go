@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExpectedScore(t *testing.T) {
+	tests := []struct {
+		r, opp int
+		want   float64
+	}{
+		{1200, 1200, 0.5},
+		{1600, 1200, 10.0 / 11},
+		{1200, 1600, 1.0 / 11},
+		{1400, 1200, 0.7597},
+		{2000, 1200, 0.9901},
+	}
+	for _, tt := range tests {
+		if got := expectedScore(tt.r, tt.opp); math.Abs(got-tt.want) > 0.0001 {
+			t.Errorf("expectedScore(%d, %d) = %.4f, want %.4f", tt.r, tt.opp, got, tt.want)
+		}
+	}
+}
+
+func TestEloUpdate(t *testing.T) {
+	tests := []struct {
+		r1, r2 int
+		score  float64
+		n1, n2 int
+	}{
+		{1200, 1200, 1, 1216, 1184},
+		{1200, 1200, 0.5, 1200, 1200},
+		{1200, 1200, 0, 1184, 1216},
+		{1400, 1200, 1, 1408, 1192},   // the favourite gains little
+		{1400, 1200, 0.5, 1392, 1208}, // and loses points on a draw
+		{1400, 1200, 0, 1376, 1224},
+		{1200, 1600, 1, 1229, 1571}, // an upset moves almost the whole K
+		{2400, 1000, 1, 2400, 1000}, // a certain result moves nothing
+	}
+	for _, tt := range tests {
+		n1, n2 := eloUpdate(tt.r1, tt.r2, tt.score)
+		if n1 != tt.n1 || n2 != tt.n2 {
+			t.Errorf("eloUpdate(%d, %d, %v) = %d, %d; want %d, %d", tt.r1, tt.r2, tt.score, n1, n2, tt.n1, tt.n2)
+		}
+		if n1+n2 != tt.r1+tt.r2 {
+			t.Errorf("eloUpdate(%d, %d, %v) changed the rating total", tt.r1, tt.r2, tt.score)
+		}
+	}
+}
+
+func TestRateGame(t *testing.T) {
+	// new players start at the default rating
+	p1 := fmt.Sprintf("rated_%d", time.Now().UnixNano())
+	p2 := p1 + "_b"
+	got := rateGame(p1, p2, p1)
+	if got[p1] != 1216 || got[p2] != 1184 {
+		t.Fatalf("after a win ratings are %v, want 1216 and 1184", got)
+	}
+	got = rateGame(p1, p2, "draw")
+	if got[p1] != 1215 || got[p2] != 1185 {
+		t.Fatalf("after a draw ratings are %v, want 1215 and 1185", got)
+	}
+	if r := lookupRating(p2); r != 1185 {
+		t.Fatalf("stored rating is %d, want 1185", r)
+	}
+}
+
+func TestMatchWindow(t *testing.T) {
+	window, growth := config.MatchWindow, config.MatchWindowGrowth
+	config.MatchWindow, config.MatchWindowGrowth = 100, 10
+	t.Cleanup(func() { config.MatchWindow, config.MatchWindowGrowth = window, growth })
+
+	tests := []struct {
+		waited time.Duration
+		want   int
+	}{
+		{0, 100},
+		{500 * time.Millisecond, 105},
+		{5 * time.Second, 150},
+		{30 * time.Second, 400},
+		{2 * time.Minute, 1300},
+	}
+	for _, tt := range tests {
+		if got := matchWindow(time.Now().Add(-tt.waited)); got != tt.want {
+			t.Errorf("window after %s = %d, want %d", tt.waited, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Rooms can also be managed over HTTP. Requests that act for a user carry
+// their name in X-Username and the session token from their welcome
+// message as "Authorization: Bearer <token>".
+
+// A room waits while a seat is open and is ready once both are taken and
+// the players are doing the ready check. It then plays its game and is
+// finished when the game ends. Rooms that are deleted, left by their host or
+// kept waiting too long are closed. The reaper removes closed rooms, and
+// finished ones once their game is gone.
+const (
+	RoomWaiting  = "waiting"
+	RoomReady    = "ready"
+	RoomPlaying  = "playing"
+	RoomFinished = "finished"
+	RoomClosed   = "closed"
+)
+
+// roomTransitions lists the statuses a room may move to from each status.
+// Rooms against the bot start out playing.
+var roomTransitions = map[string][]string{
+	RoomWaiting:  {RoomReady, RoomClosed},
+	RoomReady:    {RoomWaiting, RoomPlaying, RoomClosed},
+	RoomPlaying:  {RoomFinished},
+	RoomFinished: {RoomClosed},
+}
+
+// transition moves the room to status to, if it may go there
+func (r *Room) transition(to string) error {
+	if r.Status == to {
+		return nil
+	}
+	for _, next := range roomTransitions[r.Status] {
+		if next == to {
+			r.Status = to
+			return nil
+		}
+	}
+	return errRoomNotAvailable
+}
+
+// open reports whether the room has not started its game yet
+func (r *Room) open() bool {
+	return r.Status == RoomWaiting || r.Status == RoomReady
+}
+
+// seated moves an open room between waiting and ready as its seats fill
+// and empty
+func (r *Room) seated() error {
+	if r.Player1 != "" && r.Player2 != "" {
+		return r.transition(RoomReady)
+	}
+	return r.transition(RoomWaiting)
+}
+
+// Board sizes a room may choose
+const (
+	minBoardSize = 4
+	maxBoardSize = 10
+)
+
+// validRoomSettings checks a room's settings and fills in the defaults
+func validRoomSettings(s *RoomSettings) error {
+	if s.Rows == 0 {
+		s.Rows = defaultRows
+	}
+	if s.Cols == 0 {
+		s.Cols = defaultCols
+	}
+	if s.Rows < minBoardSize || s.Rows > maxBoardSize || s.Cols < minBoardSize || s.Cols > maxBoardSize {
+		return fmt.Errorf("board must be between %d and %d rows and columns", minBoardSize, maxBoardSize)
+	}
+	game := GameSettings{TimeControl: s.TimeControl}
+	if err := validSettings(&game); err != nil {
+		return err
+	}
+	switch s.FirstMove {
+	case "":
+		s.FirstMove = "creator"
+	case "creator", "joiner", "random":
+	default:
+		return fmt.Errorf("firstMove must be creator, joiner or random")
+	}
+	if s.Bot && s.Rated {
+		return fmt.Errorf("games against the bot are never rated")
+	}
+	return nil
+}
+
+// tellUser sends msg to the connection username is using for rooms and
+// games, wherever it is
+func (n *Node) tellUser(username string, msg any) {
+	if c, ok := n.clientFor(username, ""); ok {
+		c.SendJSON(msg)
+		return
+	}
+	if node, err := n.cluster.UserNode(username); err == nil {
+		payload, _ := json.Marshal(msg)
+		if err := n.cluster.Send(node, ClusterMessage{Kind: "deliver", Username: username, Payload: payload}); err != nil {
+			log.Printf("Failed to send to %s on node %s: %v", username, node, err)
+		}
+	}
+}
+
+// httpUser returns the user a request acts for, if its token is good
+func (n *Node) httpUser(r *http.Request) (string, bool) {
+	username := r.Header.Get("X-Username")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return username, n.verifySessionToken(token, username)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, code, text string) {
+	writeJSON(w, status, newError(code, text))
+}
+
+// createRoomHandler serves POST /rooms, with a create_room message as the
+// body. The creator must be connected, as the game starts on their
+// connection.
+func (n *Node) createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := n.httpUser(r)
+	if !ok {
+		httpError(w, http.StatusUnauthorized, ErrBadMessage, "a valid X-Username and session token are required")
+		return
+	}
+	var m CreateRoomMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostSize)).Decode(&m); err != nil {
+		httpError(w, http.StatusBadRequest, ErrBadMessage, "malformed room: "+err.Error())
+		return
+	}
+	if draining.Load() {
+		httpError(w, http.StatusServiceUnavailable, ErrShuttingDown, "server is shutting down")
+		return
+	}
+	if _, err := n.cluster.UserNode(username); err != nil {
+		httpError(w, http.StatusConflict, ErrUserOffline, "connect before creating a room")
+		return
+	}
+	room, err := n.createRoom(username, &m)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrInvalidSettings, err.Error())
+		return
+	}
+	log.Printf("Player %s created room %s (%s) over HTTP", username, room.Name, room.ID)
+	writeJSON(w, http.StatusCreated, room.forClient(username))
+}
+
+// roomHandler serves GET and DELETE /rooms/{id}. Private rooms are only
+// shown to the players in them.
+func (n *Node) roomHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/rooms/")
+	username, authed := n.httpUser(r)
+	if !authed {
+		username = ""
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		room, err := n.cluster.GetRoom(id)
+		if err == nil && room.Private && !room.has(username) {
+			err = errNotFound
+		}
+		if err != nil {
+			httpError(w, http.StatusNotFound, ErrRoomNotFound, "room not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, room.forClient(username))
+
+	case http.MethodDelete:
+		if !authed {
+			httpError(w, http.StatusUnauthorized, ErrBadMessage, "a valid X-Username and session token are required")
+			return
+		}
+		switch err := n.deleteRoom(id, username); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errNotFound:
+			httpError(w, http.StatusNotFound, ErrRoomNotFound, "room not found")
+		case errNotRoomOwner:
+			httpError(w, http.StatusForbidden, ErrNotRoomOwner, err.Error())
+		default:
+			httpError(w, http.StatusConflict, ErrRoomNotAvailable, err.Error())
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deleteRoom removes a room that is waiting for players at the request of
+// its creator, and tells whoever was in it
+func (n *Node) deleteRoom(id, username string) error {
+	room, err := n.closeRoom(id, "deleted", func(room *Room) error {
+		if room.Creator != username {
+			return errNotRoomOwner
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Player %s deleted room %s (%s)", username, room.Name, room.ID)
+	return nil
+}
+
+// closeRoom closes a room that has not started its game, if allow (when
+// set) agrees, removes it and tells its players why
+func (n *Node) closeRoom(id, reason string, allow func(room *Room) error) (*Room, error) {
+	room, err := n.cluster.UpdateRoom(id, func(room *Room) error {
+		if allow != nil {
+			if err := allow(room); err != nil {
+				return err
+			}
+		}
+		if !room.open() {
+			return errRoomNotAvailable
+		}
+		// claims the room so nobody can join it while it is removed
+		return room.transition(RoomClosed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := n.cluster.DeleteRoom(id); err != nil {
+		log.Printf("Failed to delete room %s: %v", id, err)
+	}
+
+	msg := RoomClosedMessage{Type: MsgRoomClosed, RoomID: id, Reason: reason}
+	for _, p := range []string{room.Player1, room.Player2} {
+		if p != "" {
+			n.tellUser(p, msg)
+		}
+	}
+	return room, nil
+}
+
+// finishRoom marks the room of a game that has ended as finished
+func (n *Node) finishRoom(id string) {
+	room, err := n.cluster.UpdateRoom(id, func(room *Room) error {
+		return room.transition(RoomFinished)
+	})
+	if err != nil {
+		log.Printf("Failed to finish room %s: %v", id, err)
+		return
+	}
+	n.pushRoom(room, "")
+}
+
+// leaveRooms takes a user who has gone offline out of the rooms they were
+// waiting in
+func (n *Node) leaveRooms(username string) {
+	if len(n.clientsOf(username)) > 0 {
+		return
+	}
+	n.vacateRooms(username)
+}
+
+// seatedRoom returns the room username has a seat in while it waits for
+// its game, if any
+func (n *Node) seatedRoom(username string) (*Room, bool) {
+	rooms, err := n.cluster.Rooms()
+	if err != nil {
+		log.Printf("Failed to list rooms: %v", err)
+		return nil, false
+	}
+	for _, room := range rooms {
+		if room.open() && room.has(username) {
+			return room, true
+		}
+	}
+	return nil, false
+}
+
+// vacateRooms takes username out of the rooms they are waiting in. A room
+// left by its host is closed; otherwise the seat opens up again.
+func (n *Node) vacateRooms(username string) {
+	rooms, err := n.cluster.Rooms()
+	if err != nil {
+		log.Printf("Failed to list rooms: %v", err)
+		return
+	}
+	for _, room := range rooms {
+		if !room.open() || !room.has(username) {
+			continue
+		}
+		if room.Creator == username {
+			if _, err := n.closeRoom(room.ID, "host_left", func(room *Room) error {
+				if room.Creator != username {
+					return errNotRoomOwner
+				}
+				return nil
+			}); err == nil {
+				log.Printf("Closed room %s as its host %s left", room.ID, username)
+			}
+			continue
+		}
+		left, err := n.cluster.UpdateRoom(room.ID, func(room *Room) error {
+			if !room.open() || !room.has(username) {
+				return errNotInRoom
+			}
+			room.vacate(username)
+			return room.seated()
+		})
+		if err != nil {
+			continue
+		}
+		log.Printf("Player %s left room %s", username, room.ID)
+		n.pushRoom(left, "")
+	}
+}
+
+// The creator of a room is its host: they may kick the other player, hand
+// the room over to them and change its settings while it waits. Once both
+// seats are taken the game starts when both players have pressed ready.
+// Every change is pushed to both players as room_update.
+
+var (
+	errNotInRoom = errors.New("not in the room")
+	errKicked    = errors.New("you were removed from this room")
+)
+
+// has reports whether username has a seat in the room
+func (r *Room) has(username string) bool {
+	return username != "" && (r.Player1 == username || r.Player2 == username)
+}
+
+func (r *Room) isReady(username string) bool {
+	for _, u := range r.Ready {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// vacate gives up username's seat
+func (r *Room) vacate(username string) {
+	if r.Player1 == username {
+		r.Player1 = ""
+	} else if r.Player2 == username {
+		r.Player2 = ""
+	}
+	r.setReady(username, false)
+}
+
+// setReady marks username ready or not
+func (r *Room) setReady(username string, ready bool) {
+	rest := []string{}
+	for _, u := range r.Ready {
+		if u != username {
+			rest = append(rest, u)
+		}
+	}
+	if ready {
+		rest = append(rest, username)
+	}
+	r.Ready = rest
+}
+
+// rejectRoom sends c the error for a failed room update
+func rejectRoom(c *Client, err error) error {
+	switch err {
+	case errNotFound:
+		return c.reject(ErrRoomNotFound, "room not found")
+	case errRoomFull:
+		return c.reject(ErrRoomFull, err.Error())
+	case errWrongPassword:
+		return c.reject(ErrWrongPassword, err.Error())
+	case errNotRoomOwner:
+		return c.reject(ErrNotRoomOwner, err.Error())
+	case errNotInRoom:
+		return c.reject(ErrNotInRoom, err.Error())
+	case errKicked:
+		return c.reject(ErrKicked, err.Error())
+	default:
+		return c.reject(ErrRoomNotAvailable, err.Error())
+	}
+}
+
+// pushRoom sends the room as it now is to its players, except the one
+// already told
+func (n *Node) pushRoom(room *Room, except string) {
+	for _, p := range []string{room.Player1, room.Player2} {
+		if p != "" && p != except {
+			n.tellUser(p, RoomMessage{Type: MsgRoomUpdate, RoomID: room.ID, Room: room.forClient(p)})
+		}
+	}
+}
+
+// updateWaitingRoom applies fn to a room waiting for players on behalf of
+// c's user, who must be in it, and be its host if host is set
+func (n *Node) updateWaitingRoom(c *Client, roomID string, host bool, fn func(room *Room) error) (*Room, error) {
+	room, err := n.cluster.UpdateRoom(roomID, func(room *Room) error {
+		if room.Private && !room.has(c.Username) {
+			return errNotFound
+		}
+		if !room.has(c.Username) {
+			return errNotInRoom
+		}
+		if host && room.Creator != c.Username {
+			return errNotRoomOwner
+		}
+		if !room.open() {
+			return errRoomNotAvailable
+		}
+		return fn(room)
+	})
+	if err != nil {
+		return nil, rejectRoom(c, err)
+	}
+	return room, nil
+}
+
+// handleRoomReady marks c's user ready or not, starting the game once both
+// players are
+func (n *Node) handleRoomReady(c *Client, m *RoomReadyMessage) error {
+	if m.Ready {
+		if err := n.canPlayRoom(c, m.RoomID); err != nil {
+			return err
+		}
+	}
+	room, err := n.updateWaitingRoom(c, m.RoomID, false, func(room *Room) error {
+		room.setReady(c.Username, m.Ready)
+		if room.Player1 != "" && room.Player2 != "" && room.isReady(room.Player1) && room.isReady(room.Player2) {
+			return room.transition(RoomPlaying)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.pushRoom(room, "")
+	if room.Status == RoomPlaying {
+		log.Printf("Both players in room %s are ready, starting game: %s vs %s", room.ID, room.Player1, room.Player2)
+		go n.startGameFromRoom(room)
+	}
+	return nil
+}
+
+// canPlayRoom checks that neither player seated in a room is playing or
+// queued before c's user declares themselves ready. Rooms c is not in are
+// left for updateWaitingRoom to refuse.
+func (n *Node) canPlayRoom(c *Client, roomID string) error {
+	if draining.Load() {
+		return c.reject(ErrShuttingDown, "server is shutting down")
+	}
+	if n.playing(c.Username) {
+		return c.reject(ErrAlreadyPlaying, "finish your current game first")
+	}
+	if n.isQueued(c.Username) {
+		return c.reject(ErrAlreadyQueued, "already in the queue")
+	}
+	room, err := n.cluster.GetRoom(roomID)
+	if err != nil || !room.has(c.Username) {
+		return nil
+	}
+	for _, p := range []string{room.Player1, room.Player2} {
+		if p != "" && p != c.Username && (n.playing(p) || n.isQueued(p)) {
+			return c.reject(ErrPlayerBusy, p+" is busy in another game")
+		}
+	}
+	return nil
+}
+
+// handleKick removes the other player from c's room
+func (n *Node) handleKick(c *Client, m *RoomPlayerMessage) error {
+	room, err := n.updateWaitingRoom(c, m.RoomID, true, func(room *Room) error {
+		if m.Username == c.Username || !room.has(m.Username) {
+			return errNotInRoom
+		}
+		room.vacate(m.Username)
+		room.Kicked = append(room.Kicked, m.Username)
+		return room.seated()
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Player %s kicked %s from room %s", c.Username, m.Username, room.ID)
+	n.tellUser(m.Username, RoomClosedMessage{Type: MsgRoomClosed, RoomID: room.ID, Reason: "kicked"})
+	n.pushRoom(room, "")
+	return nil
+}
+
+// handleTransfer makes the other player in c's room its host
+func (n *Node) handleTransfer(c *Client, m *RoomPlayerMessage) error {
+	room, err := n.updateWaitingRoom(c, m.RoomID, true, func(room *Room) error {
+		if m.Username == c.Username || !room.has(m.Username) {
+			return errNotInRoom
+		}
+		room.Creator = m.Username
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Player %s handed room %s to %s", c.Username, room.ID, m.Username)
+	n.pushRoom(room, "")
+	return nil
+}
+
+// handleRoomSettings replaces the settings of c's room. Both players have
+// to agree to the new terms by pressing ready again.
+func (n *Node) handleRoomSettings(c *Client, m *RoomSettingsMessage) error {
+	settings := m.settings()
+	if err := validRoomSettings(&settings); err != nil {
+		return c.reject(ErrInvalidSettings, err.Error())
+	}
+	room, err := n.updateWaitingRoom(c, m.RoomID, true, func(room *Room) error {
+		room.Settings = settings
+		room.Ready = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Player %s changed the settings of room %s", c.Username, room.ID)
+	n.pushRoom(room, "")
+	return nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{RoomWaiting, RoomReady, true},
+		{RoomWaiting, RoomClosed, true},
+		{RoomWaiting, RoomPlaying, false},
+		{RoomReady, RoomWaiting, true},
+		{RoomReady, RoomPlaying, true},
+		{RoomReady, RoomClosed, true},
+		{RoomPlaying, RoomFinished, true},
+		{RoomPlaying, RoomWaiting, false},
+		{RoomPlaying, RoomClosed, false},
+		{RoomFinished, RoomClosed, true},
+		{RoomFinished, RoomPlaying, false},
+		{RoomClosed, RoomWaiting, false},
+	}
+	for _, tt := range tests {
+		room := &Room{Status: tt.from}
+		err := room.transition(tt.to)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s -> %s: err = %v, want ok = %v", tt.from, tt.to, err, tt.ok)
+		}
+		if want := map[bool]string{true: tt.to, false: tt.from}[tt.ok]; room.Status != want {
+			t.Errorf("%s -> %s: status = %s, want %s", tt.from, tt.to, room.Status, want)
+		}
+	}
+}
+
+// readRoomStatus reads room updates until the room has the given status
+func readRoomStatus(t *testing.T, conn *websocket.Conn, status string) map[string]any {
+	t.Helper()
+	for {
+		room := readUntil(t, conn, "room_update")["room"].(map[string]any)
+		if room["status"] == status {
+			return room
+		}
+	}
+}
+
+// roomStatus fetches a room over HTTP, returning its status or "" if it is
+// gone
+func roomStatus(t *testing.T, url, id string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/rooms/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ""
+	}
+	var room Room
+	if err := json.NewDecoder(resp.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	return room.Status
+}
+
+func TestRoomLifecycle(t *testing.T) {
+	backend := NewMemoryBackend()
+	n, srv := startNode(t, backend, "a")
+
+	alice := dial(t, srv, map[string]any{"type": "create_room", "username": "alice", "roomName": "lifecycle"})
+	id := readUntil(t, alice, "room_created")["roomId"].(string)
+	if s := roomStatus(t, srv.URL, id); s != RoomWaiting {
+		t.Fatalf("new room is %q, want waiting", s)
+	}
+
+	bob := dial(t, srv, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	readUntil(t, bob, "room_joined")
+	readRoomStatus(t, alice, RoomReady)
+
+	// a third player finds the room full
+	carol := dial(t, srv, map[string]any{"type": "join_room", "username": "carol", "roomId": id})
+	if m := readUntil(t, carol, "error"); m["code"] != ErrRoomFull {
+		t.Fatalf("joining a full room got %v, want room_full", m)
+	}
+
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		conn.WriteJSON(map[string]any{"type": "room_ready", "roomId": id, "ready": true})
+	}
+	readRoomStatus(t, alice, RoomPlaying)
+	readRoomStatus(t, bob, RoomPlaying)
+	start := readUntil(t, alice, "start")
+	readUntil(t, bob, "start")
+
+	// alice moves first as the host; she stacks column 0 and wins
+	gameID := start["gameId"]
+	for i := 0; i < 3; i++ {
+		alice.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 0})
+		readTurn(t, bob, 2)
+		bob.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 1})
+		readTurn(t, alice, 1)
+	}
+	alice.WriteJSON(map[string]any{"type": "move", "gameId": gameID, "col": 0})
+	readRoomStatus(t, alice, RoomFinished)
+	readRoomStatus(t, bob, RoomFinished)
+
+	// the finished room is removed once its game is released
+	n.reapRooms()
+	if s := roomStatus(t, srv.URL, id); s != "" {
+		t.Fatalf("finished room is still %q after reaping", s)
+	}
+}
+
+func TestRoomPlayerLeaves(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "create_room", "username": "alice", "roomName": "leaving"})
+	id := readUntil(t, alice, "room_created")["roomId"].(string)
+	bob := dial(t, srvB, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	readUntil(t, bob, "room_joined")
+	readRoomStatus(t, alice, RoomReady)
+
+	// the seat opens up again when the joiner disconnects
+	bob.Close()
+	room := readRoomStatus(t, alice, RoomWaiting)
+	if room["player2"] != nil {
+		t.Fatalf("player2 = %v after leaving, want none", room["player2"])
+	}
+
+	carol := dial(t, srvB, map[string]any{"type": "join_room", "username": "carol", "roomId": id})
+	readUntil(t, carol, "room_joined")
+	readRoomStatus(t, alice, RoomReady)
+}
+
+func TestRoomHostLeaves(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "create_room", "username": "alice", "roomName": "abandoned"})
+	id := readUntil(t, alice, "room_created")["roomId"].(string)
+	bob := dial(t, srvB, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	readUntil(t, bob, "room_joined")
+
+	// the room closes when its host disconnects
+	alice.Close()
+	if m := readUntil(t, bob, "room_closed"); m["reason"] != "host_left" {
+		t.Fatalf("room closed with %v, want host_left", m["reason"])
+	}
+	if s := roomStatus(t, srvB.URL, id); s != "" {
+		t.Fatalf("abandoned room is still %q", s)
+	}
+}
+
+func TestKickedPlayerCannotRejoin(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, srvA := startNode(t, backend, "a")
+	_, srvB := startNode(t, backend, "b")
+
+	alice := dial(t, srvA, map[string]any{"type": "create_room", "username": "alice", "roomName": "kicking"})
+	id := readUntil(t, alice, "room_created")["roomId"].(string)
+	bob := dial(t, srvB, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	token := readUntil(t, bob, "welcome")["token"]
+	readUntil(t, bob, "room_joined")
+	readRoomStatus(t, alice, RoomReady)
+
+	alice.WriteJSON(map[string]any{"type": "kick_player", "roomId": id, "username": "bob"})
+	if m := readUntil(t, bob, "room_closed"); m["reason"] != "kicked" {
+		t.Fatalf("kicked player got room_closed with %v", m["reason"])
+	}
+	room := readRoomStatus(t, alice, RoomWaiting)
+	if kicked, _ := room["kicked"].([]any); len(kicked) != 1 || kicked[0] != "bob" {
+		t.Errorf("host sees kicked = %v, want [bob]", room["kicked"])
+	}
+
+	// bob is refused from either node, while the seat stays open for others
+	bob.WriteJSON(map[string]any{"type": "join_room", "roomId": id})
+	if m := readUntil(t, bob, "error"); m["code"] != ErrKicked {
+		t.Fatalf("rejoining after a kick got %v, want kicked", m)
+	}
+	again := dial(t, srvA, map[string]any{"type": "hello", "username": "bob", "token": token})
+	readUntil(t, again, "welcome")
+	again.WriteJSON(map[string]any{"type": "join_room", "roomId": id})
+	if m := readUntil(t, again, "error"); m["code"] != ErrKicked {
+		t.Fatalf("rejoining from another node got %v, want kicked", m)
+	}
+	carol := dial(t, srvB, map[string]any{"type": "join_room", "username": "carol", "roomId": id})
+	if room := readUntil(t, carol, "room_joined")["room"].(map[string]any); room["kicked"] != nil {
+		t.Errorf("joiner sees kicked = %v, want it left out", room["kicked"])
+	}
+	readRoomStatus(t, alice, RoomReady)
+}
+
+func TestRoomRefusesBusyPlayers(t *testing.T) {
+	backend := NewMemoryBackend()
+	n, srv := startNode(t, backend, "a")
+
+	alice := dial(t, srv, map[string]any{"type": "create_room", "username": "alice", "roomName": "busy"})
+	id := readUntil(t, alice, "room_created")["roomId"].(string)
+	bob := dial(t, srv, map[string]any{"type": "join_room", "username": "bob", "roomId": id})
+	readUntil(t, bob, "room_joined")
+	readRoomStatus(t, alice, RoomReady)
+
+	// a seated player cannot take a seat in a second room
+	alice.WriteJSON(map[string]any{"type": "create_room", "roomName": "second"})
+	if m := readUntil(t, alice, "error"); m["code"] != ErrAlreadyInRoom {
+		t.Fatalf("creating a second room got %v, want already_in_room", m)
+	}
+	carol := dial(t, srv, map[string]any{"type": "create_room", "username": "carol", "roomName": "other"})
+	other := readUntil(t, carol, "room_created")["roomId"].(string)
+	bob.WriteJSON(map[string]any{"type": "join_room", "roomId": other})
+	if m := readUntil(t, bob, "error"); m["code"] != ErrAlreadyInRoom {
+		t.Fatalf("joining a second room got %v, want already_in_room", m)
+	}
+
+	// bob waiting in the queue through another node holds up the game
+	if err := n.cluster.QueueAdd(QueueEntry{Username: "bob", Node: "b", JoinedAt: time.Now(), Queue: n.queues[0].Name}); err != nil {
+		t.Fatal(err)
+	}
+	alice.WriteJSON(map[string]any{"type": "room_ready", "roomId": id, "ready": true})
+	if m := readUntil(t, alice, "error"); m["code"] != ErrPlayerBusy {
+		t.Fatalf("ready beside a queued player got %v, want player_busy", m)
+	}
+	bob.WriteJSON(map[string]any{"type": "room_ready", "roomId": id, "ready": true})
+	if m := readUntil(t, bob, "error"); m["code"] != ErrAlreadyQueued {
+		t.Fatalf("ready while queued got %v, want already_queued", m)
+	}
+
+	n.cluster.QueueRemove("bob")
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		conn.WriteJSON(map[string]any{"type": "room_ready", "roomId": id, "ready": true})
+	}
+	readUntil(t, alice, "start")
+	readUntil(t, bob, "start")
+}
+
+// roomRequest sends an API request as username with their session token
+// (neither if empty) and returns the status and decoded body
+func roomRequest(t *testing.T, method, url, username, token, body string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" {
+		req.Header.Set("X-Username", username)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestCreateRoomAPI(t *testing.T) {
+	n, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"].(string)
+
+	// dave's token dies with his connection
+	dave := dial(t, srv, map[string]any{"type": "hello", "username": "dave"})
+	daveToken := readUntil(t, dave, "welcome")["token"].(string)
+	dave.Close()
+	eventually(t, "dave disconnects", func() bool { return len(n.clientsOf("dave")) == 0 })
+
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		body     string
+		status   int
+		code     string
+	}{
+		{"no token", "", "", `{"roomName":"x"}`, http.StatusUnauthorized, ErrBadMessage},
+		{"forged token", "alice", "forged", `{"roomName":"x"}`, http.StatusUnauthorized, ErrBadMessage},
+		{"another user's token", "bob", token, `{"roomName":"x"}`, http.StatusUnauthorized, ErrBadMessage},
+		{"revoked token", "dave", daveToken, `{"roomName":"x"}`, http.StatusUnauthorized, ErrBadMessage},
+		{"malformed body", "alice", token, `{"rows":`, http.StatusBadRequest, ErrBadMessage},
+		{"board too short", "alice", token, `{"rows":3}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"board too wide", "alice", token, `{"cols":11}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"board too tall", "alice", token, `{"rows":11,"cols":4}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"bad time control", "alice", token, `{"timeControl":"fast"}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"bad first move", "alice", token, `{"firstMove":"loser"}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"rated bot game", "alice", token, `{"bot":true,"rated":true}`, http.StatusBadRequest, ErrInvalidSettings},
+		{"smallest board", "alice", token, `{"rows":4,"cols":4}`, http.StatusCreated, ""},
+		{"largest board", "alice", token, `{"rows":10,"cols":10,"timeControl":"3+2"}`, http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		status, body := roomRequest(t, http.MethodPost, srv.URL+"/rooms", tt.username, tt.token, tt.body)
+		if status != tt.status || (tt.code != "" && body["code"] != tt.code) {
+			t.Errorf("%s: got %d %v, want %d %s", tt.name, status, body, tt.status, tt.code)
+		}
+		if status == http.StatusCreated && (body["creator"] != "alice" || body["status"] != RoomWaiting) {
+			t.Errorf("%s: created %v", tt.name, body)
+		}
+	}
+}
+
+func TestRoomAPIAuthorization(t *testing.T) {
+	_, srv := startNode(t, NewMemoryBackend(), "a")
+	alice := dial(t, srv, map[string]any{"type": "hello", "username": "alice"})
+	token := readUntil(t, alice, "welcome")["token"].(string)
+	bob := dial(t, srv, map[string]any{"type": "hello", "username": "bob"})
+	bobToken := readUntil(t, bob, "welcome")["token"].(string)
+	tokens := map[string]string{"alice": token, "bob": bobToken}
+
+	status, created := roomRequest(t, http.MethodPost, srv.URL+"/rooms", "alice", token, `{"roomName":"secret","private":true}`)
+	if status != http.StatusCreated || created["invite_code"] == nil {
+		t.Fatalf("creating a private room got %d %v", status, created)
+	}
+	url := srv.URL + "/rooms/" + created["id"].(string)
+
+	// only the players see a private room
+	for _, user := range []string{"", "bob"} {
+		if status, _ := roomRequest(t, http.MethodGet, url, user, tokens[user], ""); status != http.StatusNotFound {
+			t.Errorf("%q fetching a private room got %d, want 404", user, status)
+		}
+	}
+	if status, room := roomRequest(t, http.MethodGet, url, "alice", token, ""); status != http.StatusOK || room["name"] != "secret" || room["password_hash"] != nil {
+		t.Errorf("host fetching the room got %d %v", status, room)
+	}
+
+	// only the host deletes it
+	if status, _ := roomRequest(t, http.MethodDelete, url, "", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("anonymous delete got %d, want 401", status)
+	}
+	if status, body := roomRequest(t, http.MethodDelete, url, "bob", bobToken, ""); status != http.StatusForbidden || body["code"] != ErrNotRoomOwner {
+		t.Errorf("delete by another user got %d %v, want 403 not_room_owner", status, body)
+	}
+	if status, _ := roomRequest(t, http.MethodDelete, url, "alice", token, ""); status != http.StatusNoContent {
+		t.Errorf("delete by the host got %d, want 204", status)
+	}
+	if status, _ := roomRequest(t, http.MethodDelete, url, "alice", token, ""); status != http.StatusNotFound {
+		t.Errorf("deleting again got %d, want 404", status)
+	}
+	if status, _ := roomRequest(t, http.MethodPut, url, "alice", token, ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("PUT got %d, want 405", status)
+	}
+
+	// a room whose game has started cannot be deleted
+	status, playing := roomRequest(t, http.MethodPost, srv.URL+"/rooms", "alice", token, `{"roomName":"bot game","bot":true}`)
+	if status != http.StatusCreated || playing["status"] != RoomPlaying {
+		t.Fatalf("creating a bot room got %d %v", status, playing)
+	}
+	readUntil(t, alice, "start")
+	if status, body := roomRequest(t, http.MethodDelete, srv.URL+"/rooms/"+playing["id"].(string), "alice", token, ""); status != http.StatusConflict || body["code"] != ErrRoomNotAvailable {
+		t.Errorf("deleting a playing room got %d %v, want 409 room_not_available", status, body)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Peer is a player's connection as seen by a game session. It is either a
+// local *Client or a connection held by another node in the cluster.
+type Peer interface {
+	SendJSON(v any) error
+	SendState(v any) error
+	SendChat(e ChatEvent) error
+}
+
+// remotePeer forwards session output to the node holding the connection
+type remotePeer struct {
+	node     *Node
+	nodeID   string
+	username string
+	gameID   string
+}
+
+func (p *remotePeer) SendJSON(v any) error       { return p.send("deliver", v) }
+func (p *remotePeer) SendState(v any) error      { return p.send("state", v) }
+func (p *remotePeer) SendChat(e ChatEvent) error { return p.send("chat", e) }
+
+func (p *remotePeer) send(kind string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.node.cluster.Send(p.nodeID, ClusterMessage{Kind: kind, Username: p.username, GameID: p.gameID, Payload: payload})
+}
+
+// A user may have several connections open at once, for example one per
+// browser tab. All of them receive lobby traffic; game traffic goes to the
+// one seated in the game.
+
+func (n *Node) addClient(c *Client) {
+	n.clientsMu.Lock()
+	n.clients[c.Username] = append(n.clients[c.Username], c)
+	n.clientsMu.Unlock()
+	if err := n.cluster.RegisterUser(c.Username); err != nil {
+		log.Printf("Failed to register %s with cluster: %v", c.Username, err)
+	}
+}
+
+// removeClient forgets c, and unregisters its user and releases their
+// session token once their last connection to this node is gone
+func (n *Node) removeClient(c *Client) {
+	n.clientsMu.Lock()
+	conns := n.clients[c.Username]
+	for i, other := range conns {
+		if other == c {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	last := len(conns) == 0
+	if last {
+		delete(n.clients, c.Username)
+	} else {
+		n.clients[c.Username] = conns
+	}
+	n.clientsMu.Unlock()
+	if last {
+		n.cluster.UnregisterUser(c.Username)
+		if err := n.cluster.ReleaseSessionToken(c.Username); err != nil {
+			log.Printf("Failed to release session token for %s: %v", c.Username, err)
+		}
+	}
+}
+
+// lookupClient returns username's newest connection to this node, if any
+func (n *Node) lookupClient(username string) (*Client, bool) {
+	return n.clientFor(username, "")
+}
+
+// clientFor picks which of username's connections gets a message for
+// gameID: the one seated in the game, else one waiting for a game to
+// start, else the newest
+func (n *Node) clientFor(username, gameID string) (*Client, bool) {
+	n.clientsMu.Lock()
+	conns := append([]*Client(nil), n.clients[username]...)
+	n.clientsMu.Unlock()
+	if len(conns) == 0 {
+		return nil, false
+	}
+	if gameID != "" {
+		for _, c := range conns {
+			if c.currentGame() == gameID {
+				return c, true
+			}
+		}
+		for i := len(conns) - 1; i >= 0; i-- {
+			if conns[i].isSeeking() {
+				return conns[i], true
+			}
+		}
+	}
+	return conns[len(conns)-1], true
+}
+
+// clientsOf returns all of username's connections to this node
+func (n *Node) clientsOf(username string) []*Client {
+	n.clientsMu.Lock()
+	defer n.clientsMu.Unlock()
+	return append([]*Client(nil), n.clients[username]...)
+}
+
+// allClients returns every connection to this node
+func (n *Node) allClients() []*Client {
+	n.clientsMu.Lock()
+	defer n.clientsMu.Unlock()
+	var out []*Client
+	for _, conns := range n.clients {
+		out = append(out, conns...)
+	}
+	return out
+}
+
+func (n *Node) localGame(gameID string) (*GameSession, bool) {
+	n.gamesMu.Lock()
+	defer n.gamesMu.Unlock()
+	g, ok := n.games[gameID]
+	return g, ok
+}
+
+// peerFor returns username's connection wherever it lives in the cluster,
+// or nil if they are not connected
+func (n *Node) peerFor(username, gameID string) Peer {
+	if c, ok := n.clientFor(username, gameID); ok {
+		c.setGame(gameID)
+		return c
+	}
+	nodeID, err := n.cluster.UserNode(username)
+	if err != nil {
+		return nil
+	}
+	return &remotePeer{node: n, nodeID: nodeID, username: username, gameID: gameID}
+}
+
+// forwardToOwner sends a player's message for a game owned by another node
+// to its owner
+func (n *Node) forwardToOwner(kind, username, gameID string, m any) {
+	owner, err := n.cluster.SessionOwner(gameID)
+	if err != nil {
+		return
+	}
+	payload, _ := json.Marshal(m)
+	n.cluster.Send(owner, ClusterMessage{Kind: kind, Username: username, GameID: gameID, Payload: payload})
+}
+
+// playerLeft handles a client that disconnected while in a game or
+// watching one
+func (n *Node) playerLeft(c *Client) {
+	n.stopSpectating(c)
+	gameID := c.currentGame()
+	if gameID == "" {
+		return
+	}
+	sess, ok := n.localGame(gameID)
+	if !ok {
+		if owner, err := n.cluster.SessionOwner(gameID); err == nil {
+			n.cluster.Send(owner, ClusterMessage{Kind: "left", Username: c.Username, GameID: gameID})
+		}
+		return
+	}
+	sess.playerLeft(c.Username, c)
+}
+
+// rejoinRequest is the payload of a "rejoin" message
+type rejoinRequest struct {
+	Token string `json:"token"`
+	Addr  string `json:"addr"`
+}
+
+// handleCluster processes a message from another node
+func (n *Node) handleCluster(m ClusterMessage) {
+	switch m.Kind {
+	case "deliver", "state":
+		c, ok := n.clientFor(m.Username, m.GameID)
+		if !ok {
+			return
+		}
+		if m.GameID != "" {
+			c.setGame(m.GameID)
+		}
+		if m.Kind == "state" {
+			c.SendState(m.Payload)
+		} else {
+			c.SendJSON(m.Payload)
+		}
+
+	case "move":
+		sess, ok := n.localGame(m.GameID)
+		if !ok {
+			return
+		}
+		var msg MoveMessage
+		if err := json.Unmarshal(m.Payload, &msg); err != nil {
+			return
+		}
+		sess.applyMove(msg.request(m.Username))
+
+	case "latency":
+		n.handleLatency(m)
+
+	case "chat", "game_chat", "lobby_chat":
+		n.handleClusterChat(m)
+
+	case "challenge", "challenge_accept", "challenge_closed":
+		n.handleClusterChallenge(m)
+
+	case "spectate":
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.addSpectator(m.Username, &remotePeer{node: n, nodeID: m.From, username: m.Username})
+		}
+
+	case "unspectate":
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.removeSpectator(m.Username)
+		}
+
+	case "emote":
+		sess, ok := n.localGame(m.GameID)
+		if !ok {
+			return
+		}
+		var msg EmoteMessage
+		if err := json.Unmarshal(m.Payload, &msg); err != nil || !emotes[msg.Emote] {
+			return
+		}
+		sess.emote(m.Username, msg.Emote)
+
+	case "resync":
+		if sess, ok := n.localGame(m.GameID); ok {
+			sess.resync(m.Username)
+		}
+
+	case "left":
+		sess, ok := n.localGame(m.GameID)
+		if !ok {
+			return
+		}
+		// ignore if the player has already reconnected elsewhere
+		sess.TurnMu.Lock()
+		cur := sess.clients[m.Username]
+		sess.TurnMu.Unlock()
+		if rp, ok := cur.(*remotePeer); ok && rp.nodeID == m.From {
+			sess.playerLeft(m.Username, cur)
+		}
+
+	case "rejoin":
+		sess, ok := n.localGame(m.GameID)
+		if !ok {
+			return
+		}
+		var req rejoinRequest
+		json.Unmarshal(m.Payload, &req)
+		peer := &remotePeer{node: n, nodeID: m.From, username: m.Username, gameID: m.GameID}
+		if err := sess.reconnect(m.Username, req.Token, req.Addr, peer); err != nil {
+			// sent without a game id so the remote client is not bound to the game
+			payload, _ := json.Marshal(newError(ErrReconnectRejected, "reconnect rejected: "+err.Error()))
+			n.cluster.Send(m.From, ClusterMessage{Kind: "deliver", Username: m.Username, Payload: payload})
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The JSON Schema for the protocol is generated from the message structs in
+// protocol.go, so it cannot drift from what the server actually sends.
+
+type messageDef struct {
+	Type  string
+	Value interface{}
+}
+
+var clientMessageDefs = []messageDef{
+	{MsgHello, HelloMessage{}},
+	{MsgListRooms, ListRoomsMessage{}},
+	{MsgJoin, JoinMessage{}},
+	{MsgCreateRoom, CreateRoomMessage{}},
+	{MsgJoinRoom, JoinRoomMessage{}},
+	{MsgMove, MoveMessage{}},
+	{MsgResync, ResyncMessage{}},
+	{MsgPong, PongMessage{}},
+	{MsgChat, ChatMessage{}},
+	{MsgMute, MuteMessage{}},
+	{MsgEmote, EmoteMessage{}},
+	{MsgSpectate, SpectateMessage{}},
+	{MsgStopWatch, StopSpectatingMessage{}},
+	{MsgListGames, ListGamesMessage{}},
+	{MsgListOnline, ListOnlineMessage{}},
+	{MsgListQueues, ListQueuesMessage{}},
+	{MsgLeaveQueue, LeaveQueueMessage{}},
+	{MsgChallenge, ChallengeMessage{}},
+	{MsgAccept, ChallengeReplyMessage{}},
+	{MsgDecline, ChallengeReplyMessage{}},
+	{MsgCancel, ChallengeReplyMessage{}},
+	{MsgRoomInvite, RoomInviteMessage{}},
+	{MsgRoomReady, RoomReadyMessage{}},
+	{MsgKick, RoomPlayerMessage{}},
+	{MsgTransfer, RoomPlayerMessage{}},
+	{MsgRoomConfig, RoomSettingsMessage{}},
+}
+
+var serverMessageDefs = []messageDef{
+	{MsgWelcome, WelcomeMessage{}},
+	{MsgError, ErrorMessage{}},
+	{MsgWaiting, WaitingMessage{}},
+	{MsgQueueStatus, QueueStatusMessage{}},
+	{MsgQueueLeft, QueueLeftMessage{}},
+	{MsgChallenge, ChallengeEvent{}},
+	{MsgChallengeClosed, ChallengeClosedMessage{}},
+	{MsgRoomCreated, RoomMessage{}},
+	{MsgRoomJoined, RoomMessage{}},
+	{MsgRoomUpdate, RoomMessage{}},
+	{MsgRoomInvite, RoomInviteEvent{}},
+	{MsgRoomClosed, RoomClosedMessage{}},
+	{MsgRooms, RoomListMessage{}},
+	{MsgStart, StartMessage{}},
+	{MsgState, StateMessage{}},
+	{MsgDelta, DeltaMessage{}},
+	{MsgReconnected, ReconnectedMessage{}},
+	{MsgMoveAck, MoveAckMessage{}},
+	{MsgShutdown, ShutdownMessage{}},
+	{MsgPing, PingMessage{}},
+	{MsgLatency, LatencyMessage{}},
+	{MsgChat, ChatEvent{}},
+	{MsgChatHistory, ChatHistoryMessage{}},
+	{MsgEmote, EmoteEvent{}},
+	{MsgSpectating, SpectatingMessage{}},
+	{MsgSpectators, SpectatorsMessage{}},
+	{MsgLiveGames, LiveGamesMessage{}},
+	{MsgOnlineUsers, OnlineUsersMessage{}},
+	{MsgQueues, QueuesMessage{}},
+}
+
+var (
+	schemaOnce sync.Once
+	schemaJSON []byte
+)
+
+// protocolSchema builds the JSON Schema document for the protocol
+func protocolSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	refs := func(list []messageDef, prefix string) []interface{} {
+		var out []interface{}
+		for _, d := range list {
+			name := prefix + d.Type
+			s := schemaFor(reflect.TypeOf(d.Value), defs, true)
+			props := s["properties"].(map[string]interface{})
+			props["type"] = map[string]interface{}{"const": d.Type}
+			defs[name] = s
+			out = append(out, map[string]interface{}{"$ref": "#/$defs/" + name})
+		}
+		return out
+	}
+	defs["clientMessage"] = map[string]interface{}{"oneOf": refs(clientMessageDefs, "client_")}
+	defs["serverMessage"] = map[string]interface{}{"oneOf": refs(serverMessageDefs, "server_")}
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "/protocol/schema.json",
+		"title":   "Connect Four WebSocket protocol",
+		"version": ProtocolVersion,
+		"$defs":   defs,
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/clientMessage"},
+			map[string]interface{}{"$ref": "#/$defs/serverMessage"},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor describes t. Named structs other than the message itself are
+// added to defs and referenced.
+func schemaFor(t reflect.Type, defs map[string]interface{}, inline bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), defs, false)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), defs, false)}
+	case reflect.Struct:
+		if !inline {
+			if _, ok := defs[t.Name()]; !ok {
+				defs[t.Name()] = map[string]interface{}{} // placeholder for recursive types
+				defs[t.Name()] = schemaFor(t, defs, true)
+			}
+			return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		}
+		props := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaFor(f.Type, defs, false)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+// schemaHandler serves the protocol's JSON Schema
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	schemaOnce.Do(func() {
+		schemaJSON, _ = json.MarshalIndent(protocolSchema(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schemaJSON)
+}
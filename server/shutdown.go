@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once shutdown starts; no new games are created after that
+var draining atomic.Bool
+
+// shutdown stops the server gracefully: it refuses new games, tells every
+// connected client, gives active games ShutdownGrace seconds to finish,
+// snapshots whatever is still running and then closes all outputs.
+func (n *Node) shutdown(srv *http.Server) {
+	draining.Store(true)
+	grace := time.Duration(config.ShutdownGrace) * time.Second
+	log.Printf("Shutting down, waiting up to %s for active games", grace)
+
+	for _, c := range n.allClients() {
+		c.SendJSON(ShutdownMessage{Type: MsgShutdown, Grace: config.ShutdownGrace})
+	}
+
+	// HTTP requests are still served during the grace period: SSE clients
+	// send their moves as POSTs, and reconnects are allowed while draining
+	deadline := time.Now().Add(grace)
+	for n.activeGames() > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Whatever is still running is picked up again on the next start
+	n.gamesMu.Lock()
+	for _, g := range n.games {
+		g.TurnMu.Lock()
+		if g.State == "playing" {
+			saveSnapshot(g)
+		}
+		g.TurnMu.Unlock()
+	}
+	n.gamesMu.Unlock()
+
+	for _, c := range n.allClients() {
+		c.Close()
+	}
+
+	// Closing the clients ended their SSE streams; upgraded websockets are
+	// not tracked by the server
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	cancel()
+
+	if err := n.cluster.Close(); err != nil {
+		log.Printf("Failed to leave cluster: %v", err)
+	}
+
+	if err := kafkaProducer.Close(); err != nil {
+		log.Printf("Failed to flush Kafka writer: %v", err)
+	}
+	if err := closeEventLog(); err != nil {
+		log.Printf("Failed to close event log: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// activeGames counts sessions that are still being played
+func (n *Node) activeGames() int {
+	n.gamesMu.Lock()
+	sessions := make([]*GameSession, 0, len(n.games))
+	for _, g := range n.games {
+		sessions = append(sessions, g)
+	}
+	n.gamesMu.Unlock()
+
+	count := 0
+	for _, g := range sessions {
+		g.TurnMu.Lock()
+		if g.State == "playing" {
+			count++
+		}
+		g.TurnMu.Unlock()
+	}
+	return count
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Snapshots of in-progress sessions are written to the configured store after
+// every move so that a restarted server can pick the games back up.
+
+// snapshotOf captures the persistent parts of a session. Caller must hold TurnMu.
+func snapshotOf(s *GameSession) SessionSnapshot {
+	return SessionSnapshot{
+		ID:        s.ID,
+		Player1:   s.Player1,
+		Player2:   s.Player2,
+		IsBot:     s.IsBot,
+		Rated:     s.Rated,
+		Ratings:   s.Ratings,
+		State:     s.State,
+		Game:      s.Game,
+		Moves:     s.Moves,
+		MoveIDs:   s.MoveIDs,
+		Seq:       s.Seq,
+		Chat:      s.Chat,
+		StartedAt: s.StartedAt,
+		UpdatedAt: time.Now(),
+
+		SpectatorDelay: int(s.spectatorDelay / time.Second),
+		NoSpectators:   s.noSpectators,
+		RoomID:         s.roomID,
+
+		Variant:     s.variant,
+		TimeControl: s.timeControl,
+		Clocks:      s.clocksLeft(),
+	}
+}
+
+// saveSnapshot persists the session. Caller must hold TurnMu.
+func saveSnapshot(s *GameSession) {
+	snap := snapshotOf(s)
+	var err error
+	if database.enabled {
+		err = database.SaveSession(snap)
+	} else {
+		err = store.SaveSession(snap)
+	}
+	if err != nil {
+		log.Printf("Failed to snapshot game %s: %v", s.ID, err)
+	}
+}
+
+// deleteSnapshot removes a session that no longer needs to survive a restart
+func deleteSnapshot(id string) {
+	var err error
+	if database.enabled {
+		err = database.DeleteSession(id)
+	} else {
+		err = store.DeleteSession(id)
+	}
+	if err != nil {
+		log.Printf("Failed to delete snapshot for game %s: %v", id, err)
+	}
+}
+
+// restoreSession rebuilds a live session from its snapshot
+func restoreSession(snap SessionSnapshot) *GameSession {
+	// snapshots taken before move ids were recorded have none
+	for len(snap.MoveIDs) < len(snap.Moves) {
+		snap.MoveIDs = append(snap.MoveIDs, "")
+	}
+	// and bots in games from before ratings play at full strength
+	if snap.IsBot && snap.Ratings == nil {
+		snap.Ratings = map[string]int{"Bot": botFullStrength}
+	}
+	s := &GameSession{
+		ID:        snap.ID,
+		Player1:   snap.Player1,
+		Player2:   snap.Player2,
+		Players:   map[string]int{snap.Player1: 1, snap.Player2: 2},
+		Game:      snap.Game,
+		State:     "playing",
+		StartedAt: snap.StartedAt,
+		IsBot:     snap.IsBot,
+		Rated:     snap.Rated,
+		Ratings:   snap.Ratings,
+		Moves:     snap.Moves,
+		MoveIDs:   snap.MoveIDs,
+		Seq:       snap.Seq,
+		Chat:      snap.Chat,
+		clients:   map[string]Peer{},
+
+		spectatorDelay: time.Duration(snap.SpectatorDelay) * time.Second,
+		noSpectators:   snap.NoSpectators,
+		roomID:         snap.RoomID,
+
+		variant: snap.Variant,
+	}
+	// snapshots from before variants were played do not name theirs
+	if s.variant == "" && s.Game != nil {
+		s.variant = variantOf(s.Game.Rows, s.Game.Cols)
+	}
+	s.setTimeControl(snap.TimeControl)
+	if s.clocks != nil && len(snap.Clocks) == 2 {
+		for i, ms := range snap.Clocks {
+			s.clocks[i] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return s
+}
+
+// restoreSessions reloads snapshotted games that no other live node owns.
+// Players get the usual reconnect window to come back before forfeiting.
+func (n *Node) restoreSessions() {
+	var snaps []SessionSnapshot
+	var err error
+	if database.enabled {
+		snaps, err = database.LoadSessions()
+	} else {
+		snaps, err = store.LoadSessions()
+	}
+	if err != nil {
+		log.Printf("Failed to load game snapshots: %v", err)
+		return
+	}
+
+	for _, snap := range snaps {
+		if snap.State != "playing" || snap.Game == nil {
+			deleteSnapshot(snap.ID)
+			continue
+		}
+		if err := n.cluster.ClaimSession(snap.ID); err != nil {
+			continue
+		}
+		g := restoreSession(snap)
+		g.node = n
+		g.startClock()
+		n.gamesMu.Lock()
+		n.games[g.ID] = g
+		n.gamesMu.Unlock()
+
+		for _, p := range []string{g.Player1, g.Player2} {
+			if g.IsBot && p == "Bot" {
+				continue
+			}
+			go g.awaitReconnect(p)
+		}
+		go g.run()
+		log.Printf("Restored game %s: %s vs %s (%d moves)", g.ID, g.Player1, g.Player2, len(g.Moves))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Spectators watch a game read-only. They get a full state frame after
+// every update instead of deltas, so a slow spectator only ever sees the
+// latest position (frames are coalesced) and never needs to resync.
+//
+// Games can show spectators the board with a delay, to keep anyone from
+// relaying moves to a player during tournament games. Delayed frames are
+// queued on the session and released by a goroutine in order.
+
+// maxSpectatorDelay bounds the delay a room may ask for
+const maxSpectatorDelay = 10 * time.Minute
+
+// spectatorFrame is a state frame and the time it happened
+type spectatorFrame struct {
+	at  time.Time
+	msg StateMessage
+}
+
+// setWatching records the game c is spectating ("" for none)
+func (c *Client) setWatching(gameID string) {
+	c.gameMu.Lock()
+	c.watching = gameID
+	c.gameMu.Unlock()
+}
+
+func (c *Client) watchingGame() string {
+	c.gameMu.Lock()
+	defer c.gameMu.Unlock()
+	return c.watching
+}
+
+// handleSpectate starts watching a game, dropping any game watched before
+func (n *Node) handleSpectate(c *Client, m *SpectateMessage) error {
+	if m.GameID == "" {
+		return c.reject(ErrBadMessage, "gameId is required")
+	}
+	if m.GameID == c.watchingGame() {
+		return nil
+	}
+	if sess, ok := n.localGame(m.GameID); ok {
+		n.stopSpectating(c)
+		c.setWatching(m.GameID)
+		sess.addSpectator(c.Username, c)
+		return nil
+	}
+	owner, err := n.cluster.SessionOwner(m.GameID)
+	if err != nil {
+		return c.reject(ErrGameNotFound, "game not found")
+	}
+	n.stopSpectating(c)
+	c.setWatching(m.GameID)
+	n.cluster.Send(owner, ClusterMessage{Kind: "spectate", Username: c.Username, GameID: m.GameID})
+	return nil
+}
+
+// stopSpectating removes c from the game it is watching, if any
+func (n *Node) stopSpectating(c *Client) {
+	gameID := c.watchingGame()
+	if gameID == "" {
+		return
+	}
+	c.setWatching("")
+	if sess, ok := n.localGame(gameID); ok {
+		sess.removeSpectator(c.Username)
+		return
+	}
+	n.forwardToOwner("unspectate", c.Username, gameID, nil)
+}
+
+// addSpectator lets username watch the game through peer
+func (s *GameSession) addSpectator(username string, peer Peer) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	if _, ok := s.Players[username]; ok {
+		peer.SendJSON(newError(ErrBadMessage, "you are playing in this game"))
+		return
+	}
+	if s.noSpectators {
+		peer.SendJSON(newError(ErrNoSpectators, "this game cannot be watched"))
+		return
+	}
+	if s.spectators == nil {
+		s.spectators = map[string]Peer{}
+	}
+	s.spectators[username] = peer
+	log.Printf("%s is spectating game %s (%d watching)", username, s.ID, len(s.spectators))
+
+	peer.SendJSON(SpectatingMessage{
+		Type:       MsgSpectating,
+		GameID:     s.ID,
+		Player1:    s.Player1,
+		Player2:    s.Player2,
+		StartedAt:  s.StartedAt,
+		Delay:      int(s.spectatorDelay / time.Second),
+		Spectators: len(s.spectators),
+	})
+	peer.SendState(s.spectatorView())
+	s.announceSpectators()
+}
+
+// removeSpectator stops sending the game to username
+func (s *GameSession) removeSpectator(username string) {
+	s.TurnMu.Lock()
+	defer s.TurnMu.Unlock()
+	if _, ok := s.spectators[username]; !ok {
+		return
+	}
+	delete(s.spectators, username)
+	s.announceSpectators()
+}
+
+// announceSpectators tells players and spectators how many are watching.
+// Caller must hold TurnMu.
+func (s *GameSession) announceSpectators() {
+	msg := SpectatorsMessage{Type: MsgSpectators, GameID: s.ID, Count: len(s.spectators)}
+	for _, cl := range s.clients {
+		cl.SendJSON(msg)
+	}
+	for _, sp := range s.spectators {
+		sp.SendJSON(msg)
+	}
+}
+
+// spectatorView returns the frame a new spectator starts from: the current
+// position, or the newest one older than the delay. Caller must hold TurnMu.
+func (s *GameSession) spectatorView() StateMessage {
+	if s.spectatorDelay == 0 {
+		return s.snapshotFor("", s.Game.clone())
+	}
+	cutoff := time.Now().Add(-s.spectatorDelay)
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		if !s.frames[i].at.After(cutoff) {
+			return s.frames[i].msg
+		}
+	}
+	// nothing has happened for long enough yet: the empty board
+	board := make([][]int, s.Game.Rows)
+	for r := range board {
+		board[r] = make([]int, s.Game.Cols)
+	}
+	return StateMessage{
+		Type:   MsgState,
+		GameID: s.ID,
+		State:  &Game{Rows: s.Game.Rows, Cols: s.Game.Cols, Board: board, Turn: 1, Started: s.Game.Started},
+		Status: "playing",
+	}
+}
+
+// showSpectators passes the current position to the spectators, straight
+// away or after the delay. Caller must hold TurnMu.
+func (s *GameSession) showSpectators() {
+	frame := spectatorFrame{at: time.Now(), msg: s.snapshotFor("", s.Game.clone())}
+	if s.spectatorDelay == 0 {
+		for _, sp := range s.spectators {
+			sp.SendState(frame.msg)
+		}
+		return
+	}
+
+	// keep the frames still inside the delay, plus the newest one before
+	// it, which is what a spectator joining now is shown
+	cutoff := frame.at.Add(-s.spectatorDelay)
+	keep := 0
+	for keep+1 < len(s.frames) && !s.frames[keep+1].at.After(cutoff) {
+		keep++
+	}
+	s.frames = append(s.frames[keep:], frame)
+
+	if s.feed == nil {
+		// a game has an update per move, and at most one more if it is
+		// forfeited or lost on time, so sends never block and the final
+		// frame is always delivered
+		s.feed = make(chan spectatorFrame, s.Game.Rows*s.Game.Cols+1)
+		go s.runFeed(s.feed)
+	}
+	s.feed <- frame
+}
+
+// runFeed releases delayed frames to the spectators in order, until the
+// final position has been shown
+func (s *GameSession) runFeed(feed <-chan spectatorFrame) {
+	for f := range feed {
+		time.Sleep(time.Until(f.at.Add(s.spectatorDelay)))
+		s.TurnMu.Lock()
+		for _, sp := range s.spectators {
+			sp.SendState(f.msg)
+		}
+		s.TurnMu.Unlock()
+		if f.msg.Status == "finished" {
+			return
+		}
+	}
+}
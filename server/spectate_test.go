@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayedFeedShowsTheFinish(t *testing.T) {
+	s, _ := testSession()
+	s.Game = newGame(maxBoardSize, maxBoardSize)
+	s.spectatorDelay = time.Millisecond
+	watcher := &recordingPeer{}
+	s.spectators = map[string]Peer{"carol": watcher}
+
+	// every update a game on the largest board can have, the last ending it
+	s.TurnMu.Lock()
+	for i := 0; i < maxBoardSize*maxBoardSize; i++ {
+		s.Seq++
+		s.showSpectators()
+	}
+	s.State, s.Result = "finished", "alice"
+	s.Seq++
+	s.showSpectators()
+	s.TurnMu.Unlock()
+
+	var seen []any
+	eventually(t, "the final frame is shown", func() bool {
+		seen = append(seen, watcher.take()...)
+		if len(seen) == 0 {
+			return false
+		}
+		last, _ := seen[len(seen)-1].(StateMessage)
+		return last.Status == "finished"
+	})
+	if want := maxBoardSize*maxBoardSize + 1; len(seen) != want {
+		t.Errorf("spectator was shown %d frames, want %d", len(seen), want)
+	}
+}
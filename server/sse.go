@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events transport, for networks that block WebSockets.
+//
+// The client opens the stream with the fields of its hello as query
+// parameters:
+//
+//	GET /sse?username=alice&v=1&token=...
+//
+// The first event, named "session", carries a stream id. Every other event
+// is a protocol message in JSON, exactly as it would arrive over a
+// WebSocket. The client sends its messages by POSTing them, one per request,
+// to /sse/send?sid=<stream id>.
+
+// maxPostSize bounds the body of a message POSTed to /sse/send
+const maxPostSize = 64 << 10
+
+// sseTransport writes messages as events on an open response
+type sseTransport struct {
+	w       io.Writer
+	flusher http.Flusher
+	rc      *http.ResponseController
+}
+
+func (t *sseTransport) SetWriteDeadline(d time.Time) error { return t.rc.SetWriteDeadline(d) }
+
+func (t *sseTransport) WriteFrame(data []byte) error {
+	if _, err := fmt.Fprintf(t.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// Ping sends a ping message, which the client answers by POSTing a pong
+func (t *sseTransport) Ping(payload []byte) error {
+	data, _ := json.Marshal(PingMessage{Type: MsgPing, ID: string(payload)})
+	return t.WriteFrame(data)
+}
+
+// Close is a no-op: the stream ends when its handler returns, which it does
+// once the client is closed
+func (t *sseTransport) Close() error { return nil }
+
+// sseStreams maps stream ids to the clients reading them
+type sseStreams struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// newStreamID returns an unguessable id; knowing it is enough to send as
+// the stream's user
+func newStreamID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *sseStreams) put(id string, c *Client) {
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = map[string]*Client{}
+	}
+	s.clients[id] = c
+	s.mu.Unlock()
+}
+
+func (s *sseStreams) get(id string) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	return c, ok
+}
+
+func (s *sseStreams) remove(id string) {
+	s.mu.Lock()
+	delete(s.clients, id)
+	s.mu.Unlock()
+}
+
+// sseHandler serves the event stream for one connection
+func (n *Node) sseHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	v, _ := strconv.Atoi(q.Get("v"))
+	hello := &HelloMessage{Type: MsgHello, V: v, Username: q.Get("username"), Token: q.Get("token")}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering
+	t := &sseTransport{w: w, flusher: flusher, rc: http.NewResponseController(w)}
+
+	// the session event has to be written before the client's write pump
+	// starts, so the stream id is chosen up front
+	id := newStreamID()
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", id)
+	flusher.Flush()
+
+	client := n.open(t, jsonCodec{}, r.RemoteAddr, Envelope{Type: MsgHello, V: v}, hello)
+	if client == nil {
+		return
+	}
+	n.sseStreams.put(id, client)
+	defer n.sseStreams.remove(id)
+
+	select {
+	case <-r.Context().Done():
+	case <-client.done:
+	}
+	log.Printf("SSE stream for user %s ended", client.Username)
+	n.playerLeft(client)
+	n.release(client)
+	// the response must not be written to after the handler returns
+	<-client.stopped
+}
+
+// sseSendHandler accepts one message from an SSE client
+func (n *Node) sseSendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := n.sseStreams.get(r.URL.Query().Get("sid"))
+	if !ok {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPostSize))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	client.receive(data)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -4,27 +4,33 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
 // Simple file-based persistent store for completed games and leaderboard
 
 type FileStore struct {
-	gamesPath string
-	lbPath    string
-	mu        sync.Mutex
+	gamesPath   string
+	lbPath      string
+	ratingsPath string
+	sessionsDir string // one JSON snapshot per in-progress game
+	mu          sync.Mutex
 }
 
-func NewFileStore(gamesPath, lbPath string) *FileStore {
+func NewFileStore(gamesPath, lbPath, sessionsDir string) *FileStore {
 	// ensure files exist
-	os.MkdirAll("data", 0755)
+	os.MkdirAll(filepath.Dir(gamesPath), 0755)
 	if _, err := os.Stat(gamesPath); os.IsNotExist(err) {
 		ioutil.WriteFile(gamesPath, []byte("[]"), 0644)
 	}
 	if _, err := os.Stat(lbPath); os.IsNotExist(err) {
 		ioutil.WriteFile(lbPath, []byte("{}"), 0644)
 	}
-	return &FileStore{gamesPath: gamesPath, lbPath: lbPath}
+	os.MkdirAll(sessionsDir, 0755)
+	ratingsPath := filepath.Join(filepath.Dir(lbPath), "ratings.json")
+	return &FileStore{gamesPath: gamesPath, lbPath: lbPath, ratingsPath: ratingsPath, sessionsDir: sessionsDir}
 }
 
 func (s *FileStore) AppendGame(rec GameRecord) error {
@@ -60,3 +66,80 @@ func (s *FileStore) IncrementWinner(username string) error {
 	b2, _ := json.MarshalIndent(lb, "", "  ")
 	return ioutil.WriteFile(s.lbPath, b2, 0644)
 }
+
+// LoadRatings reads every player's rating
+func (s *FileStore) LoadRatings() Ratings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRatings()
+}
+
+// UpdateRatings replaces the ratings of two players with what update makes
+// of them
+func (s *FileStore) UpdateRatings(p1, p2 string, update func(r1, r2 int) (int, int)) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ratings := s.readRatings()
+	r1, r2 := update(ratings.get(p1), ratings.get(p2))
+	ratings[p1], ratings[p2] = r1, r2
+	b, _ := json.MarshalIndent(ratings, "", "  ")
+	return r1, r2, ioutil.WriteFile(s.ratingsPath, b, 0644)
+}
+
+// readRatings reads the ratings file, which is missing until the first
+// rated game. Caller must hold mu.
+func (s *FileStore) readRatings() Ratings {
+	bs, _ := ioutil.ReadFile(s.ratingsPath)
+	var r Ratings
+	json.Unmarshal(bs, &r)
+	if r == nil {
+		r = Ratings{}
+	}
+	return r
+}
+
+// SaveSession writes a snapshot via a temp file and rename so a crash
+// mid-write never leaves a truncated snapshot behind
+func (s *FileStore) SaveSession(snap SessionSnapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.sessionsDir, snap.ID+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) DeleteSession(id string) error {
+	err := os.Remove(filepath.Join(s.sessionsDir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) LoadSessions() ([]SessionSnapshot, error) {
+	entries, err := ioutil.ReadDir(s.sessionsDir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []SessionSnapshot
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(s.sessionsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var snap SessionSnapshot
+		if err := json.Unmarshal(bs, &snap); err != nil {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
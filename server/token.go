@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Reconnect tokens are handed to each player in the "start" message and
+// must be presented to take the seat back after a disconnect. A token is an
+// HMAC of the game id and username, so it only works for that seat and is
+// useless once the game is over.
+
+// tokenKey signs reconnect tokens; set by loadTokenKey
+var tokenKey []byte
+
+// loadTokenKey uses RECONNECT_SECRET if set, otherwise a random key kept in
+// the data dir so tokens survive a restart. Instances sharing a cluster must
+// share the secret.
+func loadTokenKey(config *Config) {
+	if config.ReconnectSecret != "" {
+		tokenKey = []byte(config.ReconnectSecret)
+		return
+	}
+
+	path := filepath.Join(config.DataDir, "reconnect.key")
+	if bs, err := ioutil.ReadFile(path); err == nil {
+		if key, err := hex.DecodeString(strings.TrimSpace(string(bs))); err == nil && len(key) > 0 {
+			tokenKey = key
+			return
+		}
+	}
+
+	tokenKey = make([]byte, 32)
+	if _, err := rand.Read(tokenKey); err != nil {
+		log.Fatalf("Failed to generate reconnect key: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(tokenKey)), 0600); err != nil {
+		log.Printf("Failed to save reconnect key, tokens will not survive a restart: %v", err)
+	}
+}
+
+// issueReconnectToken returns the token for username's seat in gameID
+func issueReconnectToken(gameID, username string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(gameID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(username))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyReconnectToken reports whether token was issued for username's seat in gameID
+func verifyReconnectToken(token, gameID, username string) bool {
+	want := issueReconnectToken(gameID, username)
+	return hmac.Equal([]byte(token), []byte(want))
+}
+
+// Session tokens are random, issued when a user connects while not
+// connected anywhere else and shared by all of their further connections.
+// They are kept in the cluster so every node can check them, and revoked
+// once the user's last connection closes.
+
+// sessionToken returns username's session token for a new connection to
+// this node, issuing a new one for a fresh login or when none is held
+func (n *Node) sessionToken(username string, fresh bool) string {
+	if !fresh {
+		if token, err := n.cluster.SessionToken(username); err == nil {
+			if err := n.cluster.HoldSessionToken(username); err == nil {
+				return token
+			}
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate session token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := n.cluster.PutSessionToken(username, token); err != nil {
+		log.Printf("Failed to store session token for %s: %v", username, err)
+	}
+	return token
+}
+
+// verifySessionToken reports whether token is username's current session
+// token
+func (n *Node) verifySessionToken(token, username string) bool {
+	if token == "" {
+		return false
+	}
+	want, err := n.cluster.SessionToken(username)
+	return err == nil && hmac.Equal([]byte(token), []byte(want))
+}
+
+// auditEvent records security-relevant events in audit.jsonl and the server log
+func auditEvent(e map[string]interface{}) {
+	log.Printf("AUDIT %v", e)
+	emitAudit(e)
+}
@@ -1,135 +1,267 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Client wraps a websocket connection and username
+const (
+	writeWait     = 5 * time.Second
+	pongWait      = 60 * time.Second
+	pingPeriod    = 10 * time.Second // also how often round-trip times are measured
+	sendQueueSize = 32
+)
+
+var errClientClosed = errors.New("client closed")
+
+// Transport carries encoded messages to one client. Sessions only deal with
+// *Client, so they do not know whether it is on a WebSocket or an SSE stream.
+type Transport interface {
+	SetWriteDeadline(t time.Time) error
+	WriteFrame(data []byte) error
+	Ping(payload []byte) error // the client echoes payload back to Client.pong
+	Close() error
+}
+
+// wsTransport sends frames over a WebSocket
+type wsTransport struct {
+	conn      *websocket.Conn
+	frameType int
+}
+
+func (t *wsTransport) SetWriteDeadline(d time.Time) error { return t.conn.SetWriteDeadline(d) }
+func (t *wsTransport) WriteFrame(data []byte) error       { return t.conn.WriteMessage(t.frameType, data) }
+func (t *wsTransport) Ping(p []byte) error                { return t.conn.WriteMessage(websocket.PingMessage, p) }
+func (t *wsTransport) Close() error                       { return t.conn.Close() }
+
+// Client is a connected user.
+// All writes go through a buffered queue drained by a single writePump
+// goroutine, since transports allow only one concurrent writer.
 type Client struct {
 	Username string
-	Conn     *websocket.Conn
-	sendMu   chan struct{}
+	conn     Transport
+	node     *Node
+	version  int    // negotiated protocol version
+	codec    Codec  // encoding chosen by the client
+	addr     string // remote address, for the audit log
+
+	recvMu sync.Mutex // messages from one client are handled in order
+
+	pingMu sync.Mutex
+	pingID string        // id of the ping awaiting an answer
+	pingAt time.Time     // when it was sent
+	rtt    time.Duration // smoothed round-trip time
+
+	liveMu   sync.Mutex
+	live     *LiveFilter // live games directory this client follows, if any
+	presence bool        // whether this client follows who is online
+	queues   bool        // whether this client follows the matchmaking queues
+
+	gameMu   sync.Mutex
+	gameID   string // game this client is playing, possibly owned by another node
+	watching string // game this client is spectating
+	seeking  bool   // queued or in a room, waiting to be seated in a game
+
+	send chan any // outbound messages, in order
+
+	// state frames are coalesced: while one is still queued, newer ones
+	// replace its payload instead of queueing behind it
+	stateMu      sync.Mutex
+	state        any
+	statePending bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{} // closed once writePump has returned
 }
 
-func (c *Client) SendJSON(v any) error {
-	c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	return c.Conn.WriteJSON(v)
+// stateMarker is queued in place of a state frame; writePump swaps in the
+// latest state payload when it reaches the marker.
+type stateMarker struct{}
+
+// NewClient wraps conn and starts its write pump
+func NewClient(username string, conn Transport, codec Codec) *Client {
+	c := &Client{
+		Username: username,
+		conn:     conn,
+		codec:    codec,
+		send:     make(chan any, sendQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go c.writePump()
+	return c
 }
 
-// readPump listens for incoming messages from a client and routes them
-func (c *Client) readPump(sess *GameSession) {
-	defer c.Conn.Close()
+// SendJSON queues v for delivery. A client whose queue is full is too slow
+// to keep up and gets disconnected rather than blocking the caller.
+func (c *Client) SendJSON(v any) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+	select {
+	case c.send <- v:
+		return nil
+	default:
+		log.Printf("send queue full for user %s, disconnecting slow consumer", c.Username)
+		c.kill()
+		return errClientClosed
+	}
+}
 
-	// Set up ping/pong to keep connection alive
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+// SendState queues a state frame. If an earlier state frame has not been
+// written yet it is dropped in favour of this one.
+func (c *Client) SendState(v any) error {
+	c.stateMu.Lock()
+	c.state = v
+	if c.statePending {
+		c.stateMu.Unlock()
 		return nil
-	})
+	}
+	c.statePending = true
+	c.stateMu.Unlock()
+	return c.SendJSON(stateMarker{})
+}
+
+func (c *Client) setGame(gameID string) {
+	c.gameMu.Lock()
+	c.gameID = gameID
+	if gameID != "" {
+		c.seeking = false
+	}
+	c.gameMu.Unlock()
+}
+
+// setSeeking marks the client as the one to seat when the user's next
+// game starts
+func (c *Client) setSeeking(seeking bool) {
+	c.gameMu.Lock()
+	c.seeking = seeking
+	c.gameMu.Unlock()
+}
+
+func (c *Client) isSeeking() bool {
+	c.gameMu.Lock()
+	defer c.gameMu.Unlock()
+	return c.seeking
+}
+
+func (c *Client) currentGame() string {
+	c.gameMu.Lock()
+	defer c.gameMu.Unlock()
+	return c.gameID
+}
 
-	// Start ping ticker to keep connection alive
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// Close stops the client after flushing whatever is already queued.
+// Safe to call more than once and from any goroutine.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// kill closes the connection immediately without flushing
+func (c *Client) kill() {
+	c.Close()
+	c.conn.Close()
+}
+
+// writePump is the only goroutine that writes to the connection
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+		c.conn.Close()
+		close(c.stopped)
+	}()
 
-	go func() {
-		for range ticker.C {
-			c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+	for {
+		select {
+		case <-c.done:
+			c.flush()
+			return
+		case v := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.write(v); err != nil {
+				log.Printf("writePump write error for user %s: %v", c.Username, err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.Ping(c.nextPing()); err != nil {
 				return
 			}
 		}
-	}()
+	}
+}
 
+// flush writes any messages still queued, bounded by a single write deadline
+func (c *Client) flush() {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	for {
-		var m map[string]any
-		if err := c.Conn.ReadJSON(&m); err != nil {
-			log.Printf("readPump read error for user %s: %v", c.Username, err)
-			// if client disconnected, allow reconnection timeout
-			if sess != nil && sess.State == "playing" {
-				// Mark client as disconnected
-				delete(sess.clients, c.Username)
-
-				// Start reconnection timer
-				go func(u string, s *GameSession) {
-					reconnectTimeout := time.Duration(config.ReconnectTimeout) * time.Second
-					time.Sleep(reconnectTimeout)
-
-					// Check if still not reconnected and game still playing
-					s.TurnMu.Lock()
-					defer s.TurnMu.Unlock()
-
-					if s.State != "playing" {
-						return // Game already finished
-					}
-
-					if _, ok := s.clients[u]; !ok {
-						// Player didn't reconnect, declare forfeit
-						log.Printf("Player %s forfeited due to disconnect", u)
-
-						// Determine winner (the other player)
-						winner := s.Player1
-						if u == s.Player1 {
-							winner = s.Player2
-						}
-
-						s.State = "finished"
-						s.Result = winner
-						s.FinishedAt = time.Now()
-
-						// Save game result
-						rec := GameRecord{
-							ID:        s.ID,
-							Player1:   s.Player1,
-							Player2:   s.Player2,
-							Winner:    winner,
-							StartedAt: s.StartedAt,
-							EndedAt:   s.FinishedAt,
-							Duration:  int64(s.FinishedAt.Sub(s.StartedAt).Seconds()),
-						}
-
-						if database.enabled {
-							database.SaveGame(rec)
-							database.IncrementWinner(winner)
-						} else {
-							store.AppendGame(rec)
-							store.IncrementWinner(winner)
-						}
-
-						emitEvent(map[string]any{
-							"type":   "game_finished",
-							"reason": "forfeit",
-							"game":   rec,
-						})
-
-						broadcastState(s)
-					}
-				}(c.Username, sess)
+		select {
+		case v := <-c.send:
+			if err := c.write(v); err != nil {
+				return
 			}
+		default:
 			return
 		}
-		// handle types
-		typ, _ := m["type"].(string)
-		switch typ {
-		case "move":
-			if sess == nil {
-				// find session by id
-				if gid, ok := m["gameId"].(string); ok {
-					gamesMu.Lock()
-					sess = games[gid]
-					gamesMu.Unlock()
-				}
-			}
-			if sess == nil {
-				continue
-			}
-			colf, _ := m["col"].(float64)
-			col := int(colf)
-			sess.applyMove(col)
-		case "join":
-			// ignored here
+	}
+}
+
+func (c *Client) write(v any) error {
+	if _, ok := v.(stateMarker); ok {
+		c.stateMu.Lock()
+		v = c.state
+		c.state = nil
+		c.statePending = false
+		c.stateMu.Unlock()
+		if v == nil {
+			return nil
 		}
 	}
+	return writeFrame(c.conn, c.codec, v)
+}
+
+// readPump reads messages from a WebSocket until it disconnects
+func (c *Client) readPump(conn *websocket.Conn) {
+	defer c.Close()
+
+	// Keep the connection alive; writePump sends the pings
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(payload string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.pong(payload)
+		return nil
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("readPump read error for user %s: %v", c.Username, err)
+			// if client disconnected, allow reconnection timeout
+			c.node.playerLeft(c)
+			return
+		}
+		c.receive(data)
+	}
+}
+
+// receive decodes a message from the client and hands it to the node for
+// routing
+func (c *Client) receive(data []byte) {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	env, msg, err := decodeMessage(c.codec, data)
+	if err != nil {
+		c.SendJSON(newError(ErrBadMessage, "malformed message: "+err.Error()))
+		return
+	}
+	c.node.dispatch(c, env, msg)
 }
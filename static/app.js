@@ -1,5 +1,6 @@
 (function(){
 const wsUrl = (location.protocol==='https:'?'wss':'ws')+'://'+location.host+'/ws'
+const PROTOCOL_VERSION = 1 // see /protocol/schema.json
 let ws
 let gameState = null
 let myPlayer = null
@@ -8,6 +9,13 @@ let opponent = null
 let gameStatus = 'idle'
 let currentUsername = ''
 let currentRoomId = null
+let ply = 0 // number of moves played, sent with each move so the server can spot stale or repeated ones
+let seq = 0 // sequence number of the last game update applied
+let spectating = false // watching someone else's game
+let myRating = null // Elo rating, updated after each rated game
+let clocks = null // milliseconds left to each player in a timed game
+let clocksAt = 0 // when clocks was last set
+let clockTimer = null
 const status = id('status')
 const gameDiv = id('game')
 const lb = id('leaderboard')
@@ -18,6 +26,10 @@ const player2Info = id('player2Info')
 const player1Name = id('player1Name')
 const player2Name = id('player2Name')
 const winnerAnnouncement = id('winnerAnnouncement')
+const player1Latency = id('player1Latency')
+const player2Latency = id('player2Latency')
+const player1Clock = id('player1Clock')
+const player2Clock = id('player2Clock')
 
 // UI sections
 const usernameSection = id('usernameSection')
@@ -29,6 +41,7 @@ const waitingInRoom = id('waitingInRoom')
 // Buttons
 const setUsernameBtn = id('setUsername')
 const quickMatchBtn = id('quickMatch')
+const queueSelect = id('queueSelect')
 const createRoomBtn = id('createRoom')
 const browseRoomsBtn = id('browseRooms')
 const confirmCreateRoomBtn = id('confirmCreateRoom')
@@ -37,6 +50,126 @@ const backToModeBtn = id('backToMode')
 const roomNameInput = id('roomName')
 const roomListDiv = id('roomList')
 const roomInfoDiv = id('roomInfo')
+const spectatorDelayInput = id('spectatorDelay')
+const roomPrivateInput = id('roomPrivate')
+const roomPasswordInput = id('roomPassword')
+const roomRowsInput = id('roomRows')
+const roomColsInput = id('roomCols')
+const roomFirstMoveSelect = id('roomFirstMove')
+const roomRatedInput = id('roomRated')
+const roomSpectatorsInput = id('roomSpectators')
+const roomBotInput = id('roomBot')
+const deleteRoomBtn = id('deleteRoom')
+const roomReadyBtn = id('roomReady')
+const inviteCodeInput = id('inviteCode')
+const joinByInviteBtn = id('joinByInvite')
+const roomInviteDiv = id('roomInvite')
+const roomInviteCode = id('roomInviteCode')
+const roomInviteLink = id('roomInviteLink')
+const regenerateInviteBtn = id('regenerateInvite')
+const revokeInviteBtn = id('revokeInvite')
+
+// invite links land here as /?invite=CODE
+const invitedTo = new URLSearchParams(location.search).get('invite')
+
+// Spectating
+const watchSection = id('watchSection')
+const watchGameBtn = id('watchGame')
+const watchGameIdInput = id('watchGameId')
+const confirmWatchBtn = id('confirmWatch')
+const cancelWatchBtn = id('cancelWatch')
+const stopWatchingBtn = id('stopWatching')
+const leaveQueueBtn = id('leaveQueue')
+const spectatorCount = id('spectatorCount')
+const liveGamesDiv = id('liveGames')
+const liveFilterInput = id('liveFilter')
+const liveSortSelect = id('liveSort')
+
+// Chat
+const chatSection = id('chatSection')
+const chatScopeLabel = id('chatScope')
+const chatLog = id('chatLog')
+const chatInput = id('chatInput')
+const chatSendBtn = id('chatSend')
+const muted = new Set()
+
+// Who's online
+const onlineSection = id('onlineSection')
+const onlineList = id('onlineList')
+const STATUS_LABELS = {
+  idle: 'in the lobby',
+  queueing: 'looking for a game',
+  in_room: 'waiting in a room',
+  playing: 'playing',
+  spectating: 'watching',
+}
+
+function renderOnline(users) {
+  onlineList.innerHTML = ''
+  users.forEach(u => {
+    const item = document.createElement('div')
+    item.className = 'online-user ' + u.status
+    item.textContent = u.username + (u.username === currentUsername ? ' (you)' : '') + ' · ' + (STATUS_LABELS[u.status] || u.status)
+    if(u.username !== currentUsername && u.status === 'idle') {
+      const btn = document.createElement('button')
+      btn.className = 'challenge-btn'
+      btn.textContent = 'Challenge'
+      btn.onclick = () => send({type:'challenge', to:u.username, colour:'random', rated:true})
+      item.appendChild(btn)
+    }
+    onlineList.appendChild(item)
+  })
+}
+
+// Challenges, sent and received, by id
+const challengesDiv = id('challenges')
+const challenges = {}
+
+function renderChallenges() {
+  challengesDiv.innerHTML = ''
+  Object.values(challenges).forEach(c => {
+    const item = document.createElement('div')
+    item.className = 'challenge'
+    const mine = c.from === currentUsername
+    item.textContent = mine
+      ? '⚔️ Waiting for ' + c.to + ' to answer your challenge '
+      : '⚔️ ' + c.from + ' challenges you' + (c.settings.rated ? ' (rated) ' : ' (casual) ')
+    const reply = (type, label) => {
+      const btn = document.createElement('button')
+      btn.textContent = label
+      btn.onclick = () => send({type, challengeId:c.id})
+      item.appendChild(btn)
+    }
+    if(mine) {
+      reply('cancel_challenge', 'Cancel')
+    } else {
+      reply('accept_challenge', 'Accept')
+      reply('decline_challenge', 'Decline')
+    }
+    challengesDiv.appendChild(item)
+  })
+}
+
+const CHALLENGE_ENDINGS = {
+  declined: 'declined the challenge',
+  cancelled: 'The challenge was cancelled',
+  expired: 'The challenge expired',
+  unavailable: 'The challenge is no longer possible',
+}
+
+// Emotes
+const emoteBar = id('emoteBar')
+const EMOTES = {
+  good_luck: '🍀 Good luck',
+  nice_move: '👍 Nice move',
+  oops: '😅 Oops',
+  well_played: '👏 Well played',
+  good_game: '🤝 Good game',
+  thanks: '🙏 Thanks',
+}
+emoteBar.querySelectorAll('button').forEach(b => {
+  b.onclick = () => send({type:'emote', gameId, emote:b.dataset.emote})
+})
 
 // Set username and show mode selection
 setUsernameBtn.onclick = () => {
@@ -46,11 +179,39 @@ setUsernameBtn.onclick = () => {
     return
   }
   currentUsername = username
+  connect(username)
+  showModes()
+  if(invitedTo) {
+    modeSelection.style.display = 'none'
+    joinByInvite(invitedTo)
+  }
+}
+
+function showModes() {
   usernameSection.style.display = 'none'
+  createRoomSection.style.display = 'none'
+  roomListSection.style.display = 'none'
+  watchSection.style.display = 'none'
+  waitingInRoom.style.display = 'none'
   modeSelection.style.display = 'block'
   showStatus('Choose a game mode', 'idle')
 }
 
+// renderQueues fills the queue picker, keeping the current choice
+function renderQueues(queues) {
+  const chosen = queueSelect.value
+  queueSelect.innerHTML = ''
+  queues.forEach(q => {
+    const opt = document.createElement('option')
+    opt.value = q.name
+    let label = q.name + ' (' + q.variant + (q.timeControl ? ', ' + q.timeControl : '') + ') · ' + q.waiting + ' waiting'
+    if(q.eta) label += ', ~' + q.eta + 's'
+    opt.textContent = label
+    queueSelect.appendChild(opt)
+  })
+  if(chosen) queueSelect.value = chosen
+}
+
 // Quick match - original matchmaking
 quickMatchBtn.onclick = () => {
   modeSelection.style.display = 'none'
@@ -72,9 +233,41 @@ confirmCreateRoomBtn.onclick = () => {
     return
   }
   createRoomSection.style.display = 'none'
-  connectCreateRoom(currentUsername, roomName)
+  connectCreateRoom(currentUsername, roomName, parseInt(spectatorDelayInput.value, 10) || 0)
+}
+
+joinByInviteBtn.onclick = () => {
+  const code = inviteCodeInput.value.trim()
+  if(!code) {
+    showStatus('Please enter an invite code', 'error')
+    return
+  }
+  roomListSection.style.display = 'none'
+  joinByInvite(code)
+}
+
+// bot games are never rated
+roomBotInput.onchange = () => {
+  roomRatedInput.disabled = roomBotInput.checked
+  if(roomBotInput.checked) roomRatedInput.checked = false
 }
 
+// Rooms are deleted over the REST API, which takes the session token
+deleteRoomBtn.onclick = () => {
+  fetch('/rooms/' + currentRoomId, {
+    method: 'DELETE',
+    headers: {
+      'X-Username': currentUsername,
+      'Authorization': 'Bearer ' + sessionStorage.getItem('token:' + currentUsername),
+    },
+  }).then(r => {
+    if(!r.ok) r.json().then(e => showStatus('❌ ' + e.error, 'error'))
+  })
+}
+
+regenerateInviteBtn.onclick = () => send({type:'room_invite', roomId:currentRoomId})
+revokeInviteBtn.onclick = () => send({type:'room_invite', roomId:currentRoomId, revoke:true})
+
 cancelCreateRoomBtn.onclick = () => {
   createRoomSection.style.display = 'none'
   modeSelection.style.display = 'block'
@@ -89,73 +282,302 @@ browseRoomsBtn.onclick = () => {
   showStatus('Select a room to join', 'idle')
 }
 
+// Watch a game
+watchGameBtn.onclick = () => {
+  modeSelection.style.display = 'none'
+  watchSection.style.display = 'block'
+  followLiveGames(true)
+  showStatus('Pick a game to watch', 'idle')
+}
+
+// followLiveGames asks for the live games directory, and for updates to it
+// while the watch section is open
+function followLiveGames(subscribe) {
+  send({type:'list_games', player:liveFilterInput.value.trim(), sort:liveSortSelect.value, subscribe})
+}
+
+liveFilterInput.oninput = () => followLiveGames(true)
+liveSortSelect.onchange = () => followLiveGames(true)
+
+function renderLiveGames(games) {
+  if(games.length === 0) {
+    liveGamesDiv.innerHTML = '<div class="empty-rooms">No games in progress</div>'
+    return
+  }
+  liveGamesDiv.innerHTML = ''
+  games.forEach(g => {
+    const item = document.createElement('div')
+    item.className = 'room-item'
+    const info = document.createElement('div')
+    info.className = 'room-item-info'
+    const name = document.createElement('div')
+    name.className = 'room-item-name'
+    name.textContent = g.player1 + ' vs ' + g.player2
+    const details = document.createElement('div')
+    details.className = 'room-item-details'
+    details.textContent = g.moves + ' moves · 👀 ' + g.spectators + ' · ' + g.variant + ' ' + g.rows + '×' + g.cols + (g.time_control ? ' · ' + g.time_control : '')
+    info.appendChild(name)
+    info.appendChild(details)
+    const btn = document.createElement('button')
+    btn.textContent = 'Watch'
+    btn.onclick = () => {
+      watchSection.style.display = 'none'
+      followLiveGames(false)
+      spectate(g.id)
+    }
+    item.appendChild(info)
+    item.appendChild(btn)
+    liveGamesDiv.appendChild(item)
+  })
+}
+
+confirmWatchBtn.onclick = () => {
+  const gid = watchGameIdInput.value.trim()
+  if(!gid) {
+    showStatus('Please enter a game id', 'error')
+    return
+  }
+  watchSection.style.display = 'none'
+  followLiveGames(false)
+  spectate(gid)
+}
+
+cancelWatchBtn.onclick = () => {
+  watchSection.style.display = 'none'
+  followLiveGames(false)
+  modeSelection.style.display = 'block'
+  showStatus('Choose a game mode', 'idle')
+}
+
+stopWatchingBtn.onclick = () => {
+  send({type:'stop_spectating'})
+  resetGame()
+}
+
+leaveQueueBtn.onclick = () => send({type:'leave_queue'})
+
+function spectate(gid) {
+  send({type:'spectate', gameId:gid})
+  showStatus('Joining game as a spectator...', 'waiting')
+}
+
 backToModeBtn.onclick = () => {
   roomListSection.style.display = 'none'
   modeSelection.style.display = 'block'
   showStatus('Choose a game mode', 'idle')
 }
 
-// Quick match connection
-function connectQuickMatch(username){
+// One connection is kept open for everything the player does; messages
+// sent before it is ready are queued
+let pending = []
+let ready = false
+
+function connect(username){
+  ready = false
+  const token = sessionStorage.getItem('token:' + username) || undefined
+  let opened = false
   ws = new WebSocket(wsUrl)
   ws.onopen = ()=>{
-    ws.send(JSON.stringify({type:'join', username}))
-    showStatus('Connected as ' + username, 'playing')
-  }
-  ws.onmessage = (ev)=>{
-    const msg = JSON.parse(ev.data)
-    handle(msg)
+    opened = true
+    ws.send(JSON.stringify({type:'hello', v:PROTOCOL_VERSION, username, token}))
   }
+  ws.onmessage = (ev)=> receive(username, JSON.parse(ev.data))
   ws.onclose = ()=> {
-    showStatus('Disconnected from server', 'error')
-    resetToStart()
+    // networks that block WebSockets get the SSE transport instead
+    if(!opened) { connectSSE(username, token); return }
+    disconnected()
   }
   ws.onerror = (err)=> {
-    showStatus('Connection error', 'error')
-    resetToStart()
+    if(opened) showStatus('Connection error', 'error')
   }
 }
 
-// Create room connection
-function connectCreateRoom(username, roomName){
-  ws = new WebSocket(wsUrl)
-  ws.onopen = ()=>{
-    ws.send(JSON.stringify({type:'create_room', username, roomName}))
-    showStatus('Creating room...', 'waiting')
-  }
-  ws.onmessage = (ev)=>{
-    const msg = JSON.parse(ev.data)
-    handle(msg)
-  }
-  ws.onclose = ()=> {
-    showStatus('Disconnected from server', 'error')
-    resetToStart()
+// connectSSE receives over Server-Sent Events and sends with POST requests.
+// ws is replaced with an object offering the same send.
+function connectSSE(username, token){
+  let url = '/sse?v=' + PROTOCOL_VERSION + '&username=' + encodeURIComponent(username)
+  if(token) url += '&token=' + encodeURIComponent(token)
+  const es = new EventSource(url)
+  let sid = null
+  ws = {
+    send: (text) => fetch('/sse/send?sid=' + sid, {method:'POST', body:text}),
   }
-  ws.onerror = (err)=> {
-    showStatus('Connection error', 'error')
-    resetToStart()
+  es.addEventListener('session', (ev)=>{ sid = ev.data })
+  es.onmessage = (ev)=> receive(username, JSON.parse(ev.data))
+  es.onerror = ()=> {
+    // EventSource would reconnect on its own, but the server has already
+    // released the old stream
+    es.close()
+    disconnected()
   }
 }
 
-// Join room connection
-function connectJoinRoom(username, roomId){
-  ws = new WebSocket(wsUrl)
-  ws.onopen = ()=>{
-    ws.send(JSON.stringify({type:'join_room', username, roomId}))
-    showStatus('Joining room...', 'waiting')
-  }
-  ws.onmessage = (ev)=>{
-    const msg = JSON.parse(ev.data)
-    handle(msg)
+function receive(username, msg){
+  if(msg.type==='welcome'){
+    sessionStorage.setItem('token:' + username, msg.token)
+    myRating = msg.rating
+    chatSection.style.display = 'block'
+    onlineSection.style.display = 'block'
+    ready = true
+    ws.send(JSON.stringify({type:'list_online', subscribe:true}))
+    ws.send(JSON.stringify({type:'list_queues', subscribe:true}))
+    pending.forEach(m => ws.send(JSON.stringify(m)))
+    pending = []
+    return
   }
-  ws.onclose = ()=> {
-    showStatus('Disconnected from server', 'error')
-    resetToStart()
+  handle(msg)
+}
+
+function disconnected(){
+  if(!ws) return
+  ws = null
+  ready = false
+  pending = []
+  chatSection.style.display = 'none'
+  chatLog.innerHTML = ''
+  showStatus('Disconnected from server', 'error')
+  resetToStart()
+}
+
+function send(m){
+  if(ready){
+    ws.send(JSON.stringify(m))
+  } else {
+    pending.push(m)
   }
-  ws.onerror = (err)=> {
-    showStatus('Connection error', 'error')
-    resetToStart()
+}
+
+// Quick match
+function connectQuickMatch(username){
+  send({type:'join', queue:queueSelect.value || undefined})
+  showStatus('Joining matchmaking...', 'waiting')
+}
+
+// Create room
+function connectCreateRoom(username, roomName, spectatorDelay){
+  const password = roomPasswordInput.value || undefined
+  send({
+    type:'create_room', roomName, spectatorDelay, private:roomPrivateInput.checked, password,
+    rows:parseInt(roomRowsInput.value, 10) || undefined,
+    cols:parseInt(roomColsInput.value, 10) || undefined,
+    firstMove:roomFirstMoveSelect.value,
+    rated:roomRatedInput.checked,
+    spectators:roomSpectatorsInput.checked,
+    bot:roomBotInput.checked,
+  })
+  showStatus('Creating room...', 'waiting')
+}
+
+// Join room
+function connectJoinRoom(username, roomId, password){
+  send({type:'join_room', roomId, password})
+  showStatus('Joining room...', 'waiting')
+}
+
+// joinByInvite joins the room an invite code belongs to. The password is
+// asked for once the server says the room has one.
+let invitePending = null
+function joinByInvite(inviteCode, password){
+  invitePending = inviteCode
+  send({type:'join_room', inviteCode, password})
+  showStatus('Joining room...', 'waiting')
+}
+
+// renderRoom shows the room being waited in: its players and whether they
+// are ready, and for the host the controls to kick the other player, hand
+// the room over and change the settings
+let myRoom = null
+function renderRoom(room){
+  myRoom = room
+  currentRoomId = room.id
+  waitingInRoom.style.display = 'block'
+  const host = room.creator === currentUsername
+  const s = room.settings
+  roomInfoDiv.innerHTML = `
+    <div style="background: #e8f5e9; padding: 15px; border-radius: 8px; border: 2px solid #4caf50;">
+      <div style="font-size: 1.2em; font-weight: bold; margin-bottom: 10px;">Room: ${room.name}${room.locked ? ' 🔒' : ''}</div>
+      <div style="color: #666;">Room ID: ${room.id}${room.private ? ' (private)' : ''}</div>
+      <div style="color: #666;">${s.rows}×${s.cols} board · ${s.rated ? 'rated' : 'casual'} · ${{creator:'host moves first', joiner:'guest moves first', random:'random first move'}[s.firstMove]}${s.spectators ? '' : ' · no spectators'}</div>
+    </div>
+  `
+  const ready = room.ready || []
+  ;[room.player1, room.player2].forEach(p => {
+    const line = document.createElement('div')
+    line.className = 'room-player'
+    if(!p) {
+      line.textContent = '… waiting for another player'
+      roomInfoDiv.appendChild(line)
+      return
+    }
+    line.textContent = (ready.includes(p) ? '✅ ' : '⏳ ') + p + (p === room.creator ? ' (host)' : '')
+    if(host && p !== currentUsername) {
+      const button = (label, type) => {
+        const btn = document.createElement('button')
+        btn.textContent = label
+        btn.onclick = () => send({type, roomId:room.id, username:p})
+        line.appendChild(btn)
+      }
+      button('Kick', 'kick_player')
+      button('Make host', 'transfer_room')
+    }
+    roomInfoDiv.appendChild(line)
+  })
+  if(host && !s.bot) roomInfoDiv.appendChild(roomSettingsForm(room))
+
+  if(room.invite_code !== undefined || host) showInvite(room.invite_code)
+  else roomInviteDiv.style.display = 'none'
+  deleteRoomBtn.style.display = host && !s.bot ? 'inline-block' : 'none'
+  const full = room.player1 && room.player2
+  roomReadyBtn.style.display = full ? 'inline-block' : 'none'
+  roomReadyBtn.textContent = ready.includes(currentUsername) ? 'Not ready' : 'Ready'
+  showStatus(full ? 'Press ready when you want to start' : 'Waiting for another player to join...', 'waiting')
+}
+
+roomReadyBtn.onclick = () => {
+  const ready = !(myRoom.ready || []).includes(currentUsername)
+  send({type:'room_ready', roomId:myRoom.id, ready})
+}
+
+// roomSettingsForm lets the host change the game settings; both players
+// then have to press ready again
+function roomSettingsForm(room){
+  const s = room.settings
+  const form = document.createElement('div')
+  form.className = 'room-settings'
+  form.innerHTML = `
+    <input type="number" min="4" max="10" value="${s.rows}" /> ×
+    <input type="number" min="4" max="10" value="${s.cols}" />
+    <select>
+      <option value="creator">Host first</option>
+      <option value="joiner">Guest first</option>
+      <option value="random">Random</option>
+    </select>
+    <label><input type="checkbox" ${s.rated ? 'checked' : ''} /> Rated</label>
+    <label><input type="checkbox" ${s.spectators ? 'checked' : ''} /> Spectators</label>
+    <button>Save</button>
+  `
+  const [rows, cols, rated, spectators] = form.querySelectorAll('input')
+  const firstMove = form.querySelector('select')
+  firstMove.value = s.firstMove
+  form.querySelector('button').onclick = () => send({
+    type:'room_settings', roomId:room.id,
+    rows:parseInt(rows.value, 10) || undefined,
+    cols:parseInt(cols.value, 10) || undefined,
+    firstMove:firstMove.value, rated:rated.checked, spectators:spectators.checked,
+  })
+  return form
+}
+
+// showInvite shows the creator of a room its invite code and link
+function showInvite(code){
+  if(!code) {
+    roomInviteCode.textContent = 'revoked'
+    roomInviteLink.value = ''
+  } else {
+    roomInviteCode.textContent = code
+    roomInviteLink.value = location.origin + '/invite/' + code
   }
+  roomInviteDiv.style.display = 'block'
 }
 
 function resetToStart() {
@@ -163,7 +585,9 @@ function resetToStart() {
   modeSelection.style.display = 'none'
   createRoomSection.style.display = 'none'
   roomListSection.style.display = 'none'
+  watchSection.style.display = 'none'
   waitingInRoom.style.display = 'none'
+  roomInviteDiv.style.display = 'none'
   usernameInput.value = ''
   currentUsername = ''
   currentRoomId = null
@@ -172,56 +596,129 @@ function resetToStart() {
 function handle(m){
   console.log('Received message:', m)
 
-  if(m.type==='room_created'){
-    currentRoomId = m.roomId
-    waitingInRoom.style.display = 'block'
-    roomInfoDiv.innerHTML = `
-      <div style="background: #e8f5e9; padding: 15px; border-radius: 8px; border: 2px solid #4caf50;">
-        <div style="font-size: 1.2em; font-weight: bold; margin-bottom: 10px;">Room: ${m.room.name}</div>
-        <div style="color: #666;">Room ID: ${m.roomId}</div>
-      </div>
-    `
-    showStatus('✅ Room created! Waiting for another player...', 'waiting')
-  } else if(m.type==='room_joined'){
-    currentRoomId = m.roomId
-    waitingInRoom.style.display = 'block'
-    roomInfoDiv.innerHTML = `
-      <div style="background: #e8f5e9; padding: 15px; border-radius: 8px; border: 2px solid #4caf50;">
-        <div style="font-size: 1.2em; font-weight: bold; margin-bottom: 10px;">Room: ${m.room.name}</div>
-        <div style="color: #666;">Room ID: ${m.roomId}</div>
-      </div>
-    `
-    showStatus('✅ Joined room! Waiting for game to start...', 'waiting')
+  if(m.type==='room_update' && m.room.status !== 'waiting' && m.room.status !== 'ready'){
+    // the game has started or ended; its own messages drive the page
+    myRoom = null
+  } else if(m.type==='room_created' || m.type==='room_joined' || m.type==='room_update'){
+    invitePending = null
+    renderRoom(m.room)
+  } else if(m.type==='room_closed'){
+    currentRoomId = null
+    myRoom = null
+    showModes()
+    showStatus({
+      kicked: 'You were removed from the room',
+      host_left: 'The host left, so the room was closed',
+      expired: 'Nobody started a game in time, so the room was closed',
+    }[m.reason] || 'The room was deleted', 'idle')
+  } else if(m.type==='room_invite'){
+    showInvite(m.inviteCode)
+
   } else if(m.type==='waiting'){
     gameStatus = 'waiting'
-    showStatus('⏳ Waiting for opponent... (timeout: ' + m.timeout + 's)', 'waiting')
+    leaveQueueBtn.style.display = 'inline-block'
+    showStatus('⏳ Waiting for opponent in ' + m.queue + '... (timeout: ' + m.timeout + 's)', 'waiting')
+  } else if(m.type==='queue_status'){
+    showStatus('⏳ Waiting for opponent... #' + m.position + ' of ' + m.size + ' in queue, about ' + m.eta + 's', 'waiting')
+  } else if(m.type==='queue_left'){
+    leaveQueueBtn.style.display = 'none'
+    resetGame()
+    if(m.reason === 'timeout') showStatus('Nobody was found to play. Try again later.', 'idle')
+    else if(m.reason === 'shutting_down') showStatus('The server is restarting. Try again in a moment.', 'idle')
   } else if(m.type==='start'){
-    // Hide all room UI
+    // Hide all room and queue UI
     waitingInRoom.style.display = 'none'
+    leaveQueueBtn.style.display = 'none'
 
     gameId = m.gameId
     myPlayer = m.you
     opponent = m.opponent
     gameState = m.state
     gameStatus = 'playing'
+    ply = 0
+    seq = m.seq || 0
 
-    // Show game info
+    // Show game info, with ratings
+    const ratings = m.ratings || {}
+    const me = currentUsername + ' (You' + (ratings[currentUsername] ? ', ' + ratings[currentUsername] : '') + ')'
+    const them = opponent + (ratings[opponent] ? ' (' + ratings[opponent] + ')' : '')
     gameInfo.style.display = 'flex'
     if(myPlayer === 1) {
-      player1Name.textContent = currentUsername + ' (You)'
-      player2Name.textContent = opponent
+      player1Name.textContent = me
+      player2Name.textContent = them
     } else {
-      player1Name.textContent = opponent
-      player2Name.textContent = currentUsername + ' (You)'
+      player1Name.textContent = them
+      player2Name.textContent = me
     }
 
-    showStatus('🎮 Game started! Playing against ' + opponent, 'playing')
+    showClocks(m.clocks, true)
+
+    emoteBar.style.display = 'flex'
+    showStatus('🎮 Game started! Playing against ' + opponent + (m.variant && m.variant !== 'standard' ? ' on a ' + m.variant + ' board' : '') + (m.timeControl ? ' (' + m.timeControl + ')' : ''), 'playing')
     winnerAnnouncement.innerHTML = ''
     render()
     fetchLeaderboard()
-  } else if(m.type==='state'){
+  } else if(m.type==='spectating'){
+    spectating = true
+    gameId = m.gameId
+    myPlayer = null
+    gameStatus = 'spectating'
+    modeSelection.style.display = 'none'
+    gameInfo.style.display = 'flex'
+    player1Name.textContent = m.player1
+    player2Name.textContent = m.player2
+    stopWatchingBtn.style.display = 'inline-block'
+    spectatorCount.textContent = '👀 ' + m.spectators + ' watching'
+    winnerAnnouncement.innerHTML = ''
+    showStatus('👀 Watching ' + m.player1 + ' vs ' + m.player2 + (m.delay ? ' (' + m.delay + 's delay)' : ''), 'playing')
+  } else if(m.type==='challenge'){
+    challenges[m.challenge.id] = m.challenge
+    renderChallenges()
+  } else if(m.type==='challenge_closed'){
+    const c = challenges[m.challengeId]
+    delete challenges[m.challengeId]
+    renderChallenges()
+    if(c && m.reason === 'declined') {
+      if(c.from === currentUsername) showStatus(c.to + ' ' + CHALLENGE_ENDINGS.declined, 'idle')
+    } else if(c && CHALLENGE_ENDINGS[m.reason]) {
+      showStatus(CHALLENGE_ENDINGS[m.reason], 'idle')
+    }
+  } else if(m.type==='online_users'){
+    renderOnline(m.users)
+  } else if(m.type==='queues'){
+    renderQueues(m.queues)
+  } else if(m.type==='live_games'){
+    if(watchSection.style.display !== 'none') renderLiveGames(m.games)
+  } else if(m.type==='spectators'){
+    spectatorCount.textContent = m.count ? '👀 ' + m.count + ' watching' : ''
+  } else if(m.type==='state' && spectating){
+    // spectators always get full positions
     gameState = m.state
     render()
+    showClocks(m.clocks, m.status === 'playing')
+    if(m.status==='finished'){
+      showStatus(m.result === 'draw' ? "🤝 It's a draw!" : '🏆 ' + m.result + ' wins!', 'idle')
+    } else {
+      player1Info.classList.toggle('active', gameState.turn === 1)
+      player2Info.classList.toggle('active', gameState.turn === 2)
+    }
+  } else if(m.type==='delta' || m.type==='state'){
+    if(m.seq <= seq) return // already applied
+    if(m.type==='delta'){
+      if(m.seq !== seq + 1){
+        // missed an update: ask for a full snapshot and wait for it
+        ws.send(JSON.stringify({type:'resync', gameId}))
+        return
+      }
+      if(m.move) gameState.board[m.move.row][m.move.col] = m.move.player
+      gameState.turn = m.turn
+    } else {
+      gameState = m.state
+    }
+    seq = m.seq
+    ply = m.ply
+    render()
+    showClocks(m.clocks, m.status === 'playing')
 
     if(m.status==='finished'){
       gameStatus = 'finished'
@@ -237,21 +734,62 @@ function handle(m){
         console.warn('Result is undefined or null, using empty string')
         handleGameFinished('')
       }
+      if(m.ratings && m.ratings[currentUsername]) showRatingChange(m.ratings[currentUsername])
       fetchLeaderboard()
     } else {
       updateTurnIndicator()
     }
   } else if(m.type==='reconnected'){
     gameState = m.state
+    if(m.ply !== undefined) ply = m.ply
+    seq = m.seq || 0
     gameStatus = 'playing'
+    emoteBar.style.display = 'flex'
     showStatus('Reconnected to game', 'playing')
     render()
+    showClocks(m.clocks, true)
+  } else if(m.type==='move_ack'){
+    if(!m.accepted && m.reason !== 'stale_ply' && m.reason !== 'timeout'){
+      showStatus('❌ Move rejected: ' + m.reason, 'error')
+    }
+  } else if(m.type==='shutdown'){
+    showStatus('⚠️ Server is restarting. Unfinished games can be resumed once it is back.', 'error')
+  } else if(m.type==='ping'){
+    // only sent over SSE; WebSocket pings are answered by the browser
+    ws.send(JSON.stringify({type:'pong', id:m.id}))
+  } else if(m.type==='latency'){
+    showLatency(m.players)
+  } else if(m.type==='rooms'){
+    renderRooms(m.rooms)
+  } else if(m.type==='emote'){
+    const line = document.createElement('div')
+    line.className = 'emote'
+    line.textContent = m.from + ' ' + (EMOTES[m.emote] || m.emote)
+    chatLog.appendChild(line)
+    chatLog.scrollTop = chatLog.scrollHeight
+  } else if(m.type==='chat'){
+    if(m.scope === chatScope().scope) appendChat(m)
+  } else if(m.type==='chat_history'){
+    if(m.scope === chatScope().scope){
+      chatLog.innerHTML = ''
+      m.messages.forEach(appendChat)
+    }
+  } else if(m.code==='wrong_password' && invitePending){
+    const password = prompt('This room has a password')
+    if(password === null) showModes()
+    else joinByInvite(invitePending, password)
+  } else if(m.code==='game_not_found'){
+    showModes()
+    showStatus('❌ No game with that id is being played', 'error')
+  } else if(['chat_too_long', 'rate_limited', 'chat_not_allowed', 'unknown_emote'].includes(m.code)){
+    appendNotice(m.error)
   } else if(m.error){
     showStatus('❌ Error: ' + m.error, 'error')
     setTimeout(() => {
-      resetToStart()
+      if(ws) showModes()
     }, 3000)
   }
+  switchChat()
 }
 
 function handleGameFinished(result) {
@@ -314,23 +852,24 @@ function resetGame() {
 
   // Hide game info
   gameDiv.innerHTML = ''
+  spectating = false
+  stopWatchingBtn.style.display = 'none'
+  spectatorCount.textContent = ''
+  emoteBar.style.display = 'none'
+  showLatency({})
+  showClocks(null)
   gameInfo.style.display = 'none'
   winnerAnnouncement.innerHTML = ''
 
-  // Reset all sections
-  usernameSection.style.display = 'block'
-  modeSelection.style.display = 'none'
-  createRoomSection.style.display = 'none'
-  roomListSection.style.display = 'none'
-  waitingInRoom.style.display = 'none'
-
-  // Reset input
-  usernameInput.value = ''
-  currentUsername = ''
+  // The connection stays open, so go back to choosing a mode
   currentRoomId = null
-
-  // Show join section
-  showStatus('Ready to play! Enter your username and join.', 'idle')
+  switchChat()
+  if(ws) {
+    showModes()
+    showStatus('Ready to play! Choose a game mode.', 'idle')
+  } else {
+    resetToStart()
+  }
 }
 
 function updateTurnIndicator() {
@@ -355,6 +894,100 @@ function updateTurnIndicator() {
   }
 }
 
+// showLatency shows each player's connection quality next to their name
+// showClocks shows the players' time left in a timed game, counting down
+// the player to move while running
+function showClocks(left, running) {
+  clocks = left || null
+  clocksAt = Date.now()
+  clearInterval(clockTimer)
+  clockTimer = clocks && running ? setInterval(tickClocks, 200) : null
+  tickClocks()
+}
+
+function tickClocks() {
+  ;[player1Clock, player2Clock].forEach((el, i) => {
+    if(!clocks) {
+      el.textContent = ''
+      return
+    }
+    let ms = clocks[i]
+    if(clockTimer && gameState && gameState.turn === i + 1) ms = Math.max(0, ms - (Date.now() - clocksAt))
+    const secs = Math.ceil(ms / 1000)
+    el.textContent = '⏱ ' + Math.floor(secs / 60) + ':' + String(secs % 60).padStart(2, '0')
+  })
+}
+
+function showLatency(players) {
+  const me = currentUsername
+  const byPlayer = {}
+  byPlayer[myPlayer] = players[me]
+  byPlayer[3 - myPlayer] = players[opponent]
+  ;[[player1Latency, byPlayer[1]], [player2Latency, byPlayer[2]]].forEach(([el, info]) => {
+    el.textContent = info ? info.rtt + ' ms' : ''
+    el.className = 'latency' + (info ? ' ' + info.quality : '')
+  })
+}
+
+// chatScope picks where chat goes: the game being played, the room being
+// waited in, or the lobby
+function chatScope() {
+  if(gameId && gameStatus === 'playing') return {scope:'game', target:gameId, label:'Game'}
+  if(currentRoomId) return {scope:'room', target:currentRoomId, label:'Room'}
+  return {scope:'lobby', label:'Lobby'}
+}
+
+// switchChat clears the chat log when the scope changes
+function switchChat() {
+  const s = chatScope()
+  if(chatScopeLabel.textContent !== s.label){
+    chatScopeLabel.textContent = s.label
+    chatLog.innerHTML = ''
+  }
+}
+
+function appendChat(m) {
+  switchChat()
+  const line = document.createElement('div')
+  const from = document.createElement('span')
+  from.className = 'from' + (muted.has(m.from) ? ' muted' : '')
+  from.textContent = m.from + ': '
+  from.title = muted.has(m.from) ? 'Click to unmute' : 'Click to mute'
+  from.onclick = () => toggleMute(m.from)
+  line.appendChild(from)
+  line.appendChild(document.createTextNode(m.text))
+  chatLog.appendChild(line)
+  chatLog.scrollTop = chatLog.scrollHeight
+}
+
+function appendNotice(text) {
+  const line = document.createElement('div')
+  line.className = 'muted'
+  line.textContent = text
+  chatLog.appendChild(line)
+  chatLog.scrollTop = chatLog.scrollHeight
+}
+
+function toggleMute(username) {
+  if(username === currentUsername) return
+  const mute = !muted.has(username)
+  if(mute) muted.add(username); else muted.delete(username)
+  send({type:'mute', username, muted:mute})
+  appendNotice(username + (mute ? ' muted' : ' unmuted'))
+}
+
+function sendChat() {
+  const text = chatInput.value.trim()
+  if(!text) return
+  const s = chatScope()
+  switchChat()
+  send({type:'chat', scope:s.scope, target:s.target, text})
+  chatInput.value = ''
+}
+
+chatSendBtn.onclick = sendChat
+chatInput.onkeydown = (e) => { if(e.key === 'Enter') sendChat() }
+
 function showStatus(message, type) {
   status.textContent = message
   status.className = type
@@ -386,7 +1019,8 @@ function render(){
       if(gameStatus === 'playing' && gameState.turn === myPlayer) {
         cell.onclick = ()=>{
           if(ws && gameId) {
-            ws.send(JSON.stringify({type:'move', gameId, col:c}))
+            const moveId = gameId + '-' + ply + '-' + Math.random().toString(36).slice(2)
+            ws.send(JSON.stringify({type:'move', gameId, col:c, moveId, ply}))
           }
         }
       } else {
@@ -404,36 +1038,52 @@ function render(){
 }
 
 function loadRooms(){
-  fetch('/rooms').then(r=>r.json()).then(rooms=>{
-    if(!rooms || rooms.length === 0) {
-      roomListDiv.innerHTML = '<div class="empty-rooms">No rooms available. Create one!</div>'
-      return
-    }
+  send({type:'list_rooms'})
+}
+
+function renderRooms(rooms){
+  if(!rooms || rooms.length === 0) {
+    roomListDiv.innerHTML = '<div class="empty-rooms">No rooms available. Create one!</div>'
+    return
+  }
 
-    let html = ''
-    rooms.forEach(room => {
-      html += `
-        <div class="room-item">
-          <div class="room-item-info">
-            <div class="room-item-name">${room.name}</div>
-            <div class="room-item-details">
-              Created by: ${room.creator} | Players: ${room.players}/${room.max_players}
-            </div>
+  let html = ''
+  rooms.forEach(room => {
+    html += `
+      <div class="room-item">
+        <div class="room-item-info">
+          <div class="room-item-name">${room.name}${room.locked ? ' 🔒' : ''}</div>
+          <div class="room-item-details">
+            Created by: ${room.creator} | Players: ${room.players}/${room.max_players}
           </div>
-          <button onclick="joinRoom('${room.id}')">Join</button>
         </div>
-      `
-    })
-    roomListDiv.innerHTML = html
-  }).catch(() => {
-    roomListDiv.innerHTML = '<div class="empty-rooms">Failed to load rooms</div>'
+        <button onclick="joinRoom('${room.id}', ${!!room.locked})">Join</button>
+      </div>
+    `
   })
+  roomListDiv.innerHTML = html
 }
 
 // Make joinRoom available globally
-window.joinRoom = function(roomId) {
+window.joinRoom = function(roomId, locked) {
+  let password
+  if(locked) {
+    password = prompt('This room has a password')
+    if(password === null) return
+  }
   roomListSection.style.display = 'none'
-  connectJoinRoom(currentUsername, roomId)
+  connectJoinRoom(currentUsername, roomId, password)
+}
+
+// showRatingChange adds the new rating after a rated game to the result
+function showRatingChange(rating){
+  const diff = rating - myRating
+  const line = document.createElement('div')
+  line.style.fontSize = '0.8em'
+  line.style.marginTop = '10px'
+  line.textContent = 'Rating: ' + myRating + ' → ' + rating + ' (' + (diff >= 0 ? '+' : '') + diff + ')'
+  winnerAnnouncement.appendChild(line)
+  myRating = rating
 }
 
 function fetchLeaderboard(){